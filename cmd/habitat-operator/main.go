@@ -16,21 +16,54 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
-	"runtime"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	flag "github.com/spf13/pflag"
+	apiv1 "k8s.io/api/core/v1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
 
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
 	habclient "github.com/kinvolk/habitat-operator/pkg/client"
+	habclientset "github.com/kinvolk/habitat-operator/pkg/client/clientset/versioned"
+	habscheme "github.com/kinvolk/habitat-operator/pkg/client/clientset/versioned/scheme"
 	habcontroller "github.com/kinvolk/habitat-operator/pkg/controller"
+	"github.com/kinvolk/habitat-operator/pkg/version"
+)
+
+const (
+	// leaderElectionLockName is the name of the ConfigMap used as leader
+	// election lock.
+	leaderElectionLockName = "habitat-operator"
+
+	// Formats of the logs.
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+
+	// shutdownTimeout is how long the operator waits for the controller to
+	// stop on SIGTERM. The controller interrupts the reconciliations still in
+	// flight after 30 seconds, so it's only reached if that hangs.
+	shutdownTimeout = 40 * time.Second
 )
 
 type Config struct {
@@ -41,10 +74,35 @@ func run() int {
 	// Parse config flags.
 	kubeconfig := flag.String("kubeconfig", "", "Path to a kubeconfig. Only required if out-of-cluster.")
 	verbose := flag.BoolP("verbose", "v", false, "Enable verbose logging.")
+	logFormat := flag.String("log-format", logFormatLogfmt, "Format of the logs, either `logfmt` or `json`.")
+	leaderElect := flag.Bool("leader-elect", false, "Elect a leader among multiple replicas of the operator. Only the leader manages Habitats.")
+	leaderElectNamespace := flag.String("leader-elect-namespace", apiv1.NamespaceDefault, "Namespace of the ConfigMap used as leader election lock.")
+	metricsAddress := flag.String("metrics-address", "", "Address to serve Prometheus metrics on, e.g. `:8080`. Metrics are not served if empty.")
+	dryRun := flag.Bool("dry-run", false, "Log the objects the operator would write, instead of writing them. The Habitat CRD must already exist.")
+	resyncPeriod := flag.Duration("resync-period", time.Minute, "How often all the resources are reconciled, even if they didn't change.")
+	namespace := flag.String("namespace", apiv1.NamespaceAll, "Namespace to manage Habitats in. All namespaces are managed if empty.")
+	healthAddress := flag.String("health-address", "", "Address to serve the /healthz and /readyz endpoints on, e.g. `:8081`. The endpoints are not served if empty.")
+	webhookAddress := flag.String("webhook-address", "", "Address to serve the validating admission webhook and the conversion webhook on, e.g. `:8443`. The webhooks are not served if empty.")
+	webhookCertFile := flag.String("webhook-cert-file", "", "Path to the TLS certificate used to serve the webhook.")
+	webhookKeyFile := flag.String("webhook-key-file", "", "Path to the TLS key used to serve the webhook.")
+	printVersion := flag.Bool("version", false, "Print the version of the operator and exit.")
+	maxPeers := flag.Int("max-peers", 3, "Maximum number of IPs of running Pods written to the peer file, used by supervisors to join the ring.")
+	workers := flag.Int("workers", 4, "Number of Habitats reconciled concurrently.")
+	serviceMonitors := flag.Bool("service-monitors", false, "Create a Prometheus operator ServiceMonitor scraping the supervisors of each Habitat, if the ServiceMonitor CRD exists.")
+	defaultsFile := flag.String("habitat-defaults", "", "Path to a YAML file with the default values of the fields of the spec of Habitats, applied to the Habitats that don't set them.")
 	flag.Parse()
 
+	if *printVersion {
+		fmt.Println(version.String())
+		return 0
+	}
+
 	// Set up logging.
-	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+	logger, err := newLogger(*logFormat, log.NewSyncWriter(os.Stderr))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
 	logger = log.With(logger, "ts", log.DefaultTimestamp)
 
 	if *verbose {
@@ -53,6 +111,20 @@ func run() int {
 		logger = level.NewFilter(logger, level.AllowInfo())
 	}
 
+	if *dryRun && *leaderElect {
+		// Leader election writes to its lock.
+		level.Error(logger).Log("msg", "--dry-run and --leader-elect can't be used together")
+		return 1
+	}
+
+	var defaults *habv1beta1.HabitatSpec
+	if *defaultsFile != "" {
+		if defaults, err = habcontroller.LoadDefaults(*defaultsFile); err != nil {
+			level.Error(logger).Log("msg", err)
+			return 1
+		}
+	}
+
 	// Build operator config.
 	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
 	if err != nil {
@@ -68,19 +140,27 @@ func run() int {
 	}
 
 	// Create Habitat CRD.
-	_, crdErr := habclient.CreateCRD(apiextensionsclientset)
-	if crdErr != nil {
+	if *dryRun {
+		level.Info(logger).Log("msg", "dry run, not creating or updating Habitat CRD")
+	} else if _, crdErr := habclient.CreateCRD(apiextensionsclientset); crdErr != nil {
 		if !apierrors.IsAlreadyExists(crdErr) {
 			level.Error(logger).Log("msg", crdErr)
 			return 1
 		}
 
+		// Make sure the existing CRD matches the one this version of the
+		// operator expects.
+		if _, err := habclient.UpdateCRD(apiextensionsclientset); err != nil {
+			level.Error(logger).Log("msg", err)
+			return 1
+		}
+
 		level.Info(logger).Log("msg", "Habitat CRD already exists, continuing")
 	} else {
 		level.Info(logger).Log("msg", "created Habitat CRD")
 	}
 
-	habClient, scheme, err := habclient.NewClient(config)
+	habClient, err := habclientset.NewForConfig(config)
 	if err != nil {
 		level.Error(logger).Log("msg", err)
 		return 1
@@ -93,10 +173,36 @@ func run() int {
 		return 1
 	}
 
+	// Events are recorded through a single broadcaster, in the namespace of
+	// the object they are about.
+	broadcaster := record.NewBroadcaster()
+	if *dryRun {
+		broadcaster.StartLogging(func(format string, args ...interface{}) {
+			level.Info(logger).Log("msg", "dry run, not recording event", "event", fmt.Sprintf(format, args...))
+		})
+	} else {
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	}
+	eventSource := apiv1.EventSource{Component: "habitat-operator"}
+
 	controllerConfig := habcontroller.Config{
 		HabitatClient:       habClient,
 		KubernetesClientset: clientset,
-		Scheme:              scheme,
+		Scheme:              habscheme.Scheme,
+		EventRecorder:       broadcaster.NewRecorder(habscheme.Scheme, eventSource),
+		MetricsAddress:      *metricsAddress,
+		HealthAddress:       *healthAddress,
+		LeaderElection:      *leaderElect,
+		ResyncPeriod:        *resyncPeriod,
+		DryRun:              *dryRun,
+		Namespace:           *namespace,
+		WebhookAddress:      *webhookAddress,
+		WebhookCertFile:     *webhookCertFile,
+		WebhookKeyFile:      *webhookKeyFile,
+		MaxPeers:            *maxPeers,
+		Workers:             *workers,
+		ServiceMonitors:     *serviceMonitors,
+		Defaults:            defaults,
 	}
 	hc, err := habcontroller.New(controllerConfig, log.With(logger, "component", "controller"))
 	if err != nil {
@@ -106,20 +212,135 @@ func run() int {
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
-	go hc.Run(runtime.NumCPU(), ctx)
+
+	// runController runs the controller until the context is canceled. If
+	// the controller fails, the error is sent on errCh. running tracks
+	// whether it's still running, so that the reconciliations in flight can
+	// be drained before exiting.
+	errCh := make(chan error, 1)
+	var running sync.WaitGroup
+	runController := func() {
+		defer running.Done()
+		if err := hc.Run(ctx); err != nil && err != context.Canceled {
+			errCh <- err
+		}
+	}
+
+	// The health endpoints are served whether this replica leads or not.
+	go hc.ServeHealth(ctx)
+
+	if *leaderElect {
+		recorder := broadcaster.NewRecorder(kubescheme.Scheme, eventSource)
+		le, err := newLeaderElector(clientset, *leaderElectNamespace, recorder, logger, leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(stop <-chan struct{}) {
+				level.Info(logger).Log("msg", "started leading")
+				running.Add(1)
+				runController()
+			},
+			OnStoppedLeading: func() {
+				// Another replica might already be managing the Habitats, stop
+				// immediately.
+				level.Error(logger).Log("msg", "leader election lost")
+				cancelFunc()
+			},
+		})
+		if err != nil {
+			level.Error(logger).Log("msg", err)
+			return 1
+		}
+
+		go le.Run()
+	} else {
+		running.Add(1)
+		go runController()
+	}
 
 	term := make(chan os.Signal)
 	// Relay these signals to the `term` channel.
 	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
 
-	select {
-	case <-term:
-		level.Info(logger).Log("msg", "received SIGTERM, exiting gracefully...")
-	case <-ctx.Done():
-		level.Info(logger).Log("msg", "context channel closed, exiting")
+	// SIGHUP reconciles all the Habitats immediately.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-hup:
+			n := hc.EnqueueAll()
+			level.Info(logger).Log("msg", "received SIGHUP, reconciling all Habitats", "count", n)
+		case <-term:
+			level.Info(logger).Log("msg", "received SIGTERM, exiting gracefully...")
+			cancelFunc()
+
+			// Wait for the controller to finish the reconciliations in flight.
+			// It never started if this replica wasn't leading.
+			stopped := make(chan struct{})
+			go func() {
+				running.Wait()
+				close(stopped)
+			}()
+
+			select {
+			case <-stopped:
+			case <-time.After(shutdownTimeout):
+				level.Warn(logger).Log("msg", "controller not stopped within timeout, exiting", "timeout", shutdownTimeout)
+			}
+
+			return 0
+		case <-ctx.Done():
+			level.Info(logger).Log("msg", "context channel closed, exiting")
+			return 0
+		case err := <-errCh:
+			level.Error(logger).Log("msg", "controller failed", "err", err)
+			return 1
+		}
+	}
+}
+
+// newLeaderElector returns a LeaderElector using a ConfigMap in the given
+// namespace as lock. Replicas that are not leading block until the lease
+// expires, and then try to acquire it.
+// The recorder is used to record leadership changes as Events.
+func newLeaderElector(clientset *kubernetes.Clientset, namespace string, recorder record.EventRecorder, logger log.Logger, callbacks leaderelection.LeaderCallbacks) (*leaderelection.LeaderElector, error) {
+	id, err := os.Hostname()
+	if err != nil {
+		return nil, err
 	}
 
-	return 0
+	lock := &resourcelock.ConfigMapLock{
+		ConfigMapMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      leaderElectionLockName,
+		},
+		Client: clientset.CoreV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity:      id,
+			EventRecorder: recorder,
+		},
+	}
+
+	level.Info(logger).Log("msg", "starting leader election", "id", id, "namespace", namespace)
+
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Callbacks:     callbacks,
+	})
+}
+
+// newLogger returns a logger writing to w in the given format. The keys are
+// the same in all formats, so that logs can be queried regardless of it.
+func newLogger(format string, w io.Writer) (log.Logger, error) {
+	switch format {
+	case logFormatLogfmt:
+		return log.NewLogfmtLogger(w), nil
+	case logFormatJSON:
+		return log.NewJSONLogger(w), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected %q or %q", format, logFormatLogfmt, logFormatJSON)
+	}
 }
 
 func main() {
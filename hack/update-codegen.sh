@@ -0,0 +1,20 @@
+#!/usr/bin/env bash
+
+# Regenerates the deepcopy functions, and the typed clientset, informers and
+# listers of the Habitat API in pkg/client.
+#
+# It requires k8s.io/code-generator to be checked out at kubernetes-1.10.0 in
+# the GOPATH, or CODEGEN_PKG to point to it.
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+SCRIPT_ROOT=$(dirname "${BASH_SOURCE}")/..
+CODEGEN_PKG=${CODEGEN_PKG:-${GOPATH}/src/k8s.io/code-generator}
+
+"${CODEGEN_PKG}"/generate-groups.sh "deepcopy,client,informer,lister" \
+  github.com/kinvolk/habitat-operator/pkg/client \
+  github.com/kinvolk/habitat-operator/pkg/apis \
+  habitat:v1beta1 \
+  --go-header-file "${SCRIPT_ROOT}"/hack/boilerplate.go.txt
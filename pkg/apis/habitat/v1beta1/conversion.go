@@ -0,0 +1,29 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// addConversionFuncs registers the conversions between this version of the
+// API and the other ones with the scheme. The conversion webhook of the
+// operator converts Habitats with the scheme, so that the API server can
+// serve them in any version.
+// This is the only version so far, which the scheme converts to itself, so
+// there's nothing to register yet.
+func addConversionFuncs(scheme *runtime.Scheme) error {
+	return nil
+}
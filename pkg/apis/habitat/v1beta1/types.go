@@ -15,7 +15,10 @@
 package v1beta1
 
 import (
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 const (
@@ -27,10 +30,26 @@ const (
 	// HabitatNameLabel contains the user defined Habitat Service name.
 	// Example: 'habitat-name: db'
 	HabitatNameLabel = "habitat-name"
+	// CreatedByLabel labels the resources created by the operator, so that
+	// they can be told apart from resources created by users with the same
+	// labels.
+	// Example: 'created-by: habitat-operator'
+	CreatedByLabel = "created-by"
+	CreatedBy      = "habitat-operator"
 
 	TopologyLabel = "topology"
+	// RingLabel contains the name of the ring the Pods of a Habitat join,
+	// unless it's the default ring of the namespace.
+	// Example: 'habitat-ring: payments'
+	RingLabel = "habitat-ring"
+	// ApplicationLabel and EnvironmentLabel contain the Habitat application
+	// and environment the services of a Habitat belong to.
+	// Example: 'habitat-application: shop', 'habitat-environment: staging'
+	ApplicationLabel = "habitat-application"
+	EnvironmentLabel = "habitat-environment"
 )
 
+// +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 type Habitat struct {
@@ -46,15 +65,384 @@ type HabitatSpec struct {
 	// Image is the Docker image of the Habitat Service.
 	Image   string  `json:"image"`
 	Service Service `json:"service"`
+	// Kind is the kind of workload that runs the Habitat Service.
+	// Use `StatefulSet` for services that need stable network identities,
+	// and `Job` for services that run to completion.
+	// Optional. Defaults to `Deployment`.
+	Kind WorkloadKind `json:"kind,omitempty"`
+	// DeploymentName is the name of the Deployment, StatefulSet or Job that runs
+	// the Habitat Service. It can't be changed after creation.
+	// Optional. Defaults to the name of the Habitat, shortened to 63
+	// characters if needed.
+	DeploymentName string `json:"deploymentName,omitempty"`
+	// DeploymentAnnotations are added to the annotations of the Deployment,
+	// StatefulSet or Job that runs the Habitat Service, e.g. for GitOps
+	// tooling. Keys with the `habitat.sh/` prefix are reserved for the
+	// operator.
+	// Optional.
+	DeploymentAnnotations map[string]string `json:"deploymentAnnotations,omitempty"`
+	// Resources are the compute resources required by the Habitat Service container.
+	// Optional. Defaults to no requests and limits.
+	Resources *apiv1.ResourceRequirements `json:"resources,omitempty"`
+	// SupervisorArgs are additional arguments passed to the Habitat supervisor,
+	// after the ones set by the operator.
+	// Optional.
+	SupervisorArgs []string `json:"supervisorArgs,omitempty"`
+	// Command replaces the entrypoint of the image in the Habitat Service
+	// container. The supervisor arguments set by the operator are still
+	// passed to it, so it must start the supervisor with them.
+	// Optional. Defaults to the entrypoint of the image.
+	Command []string `json:"command,omitempty"`
+	// Args are passed to Command, or to the entrypoint of the image, before
+	// the supervisor arguments set by the operator, e.g. to run a subcommand.
+	// They can't contain the flags set by the operator, see SupervisorArgs to
+	// override them.
+	// Optional.
+	Args []string `json:"args,omitempty"`
+	// Probe overrides the probes of the Habitat Service container.
+	// Optional. Defaults to probing the supervisor's HTTP gateway.
+	Probe *Probe `json:"probe,omitempty"`
+	// Services are additional Habitat Services run in the same Pods, each in
+	// its own container. They join the ring of the main Habitat Service.
+	// Optional.
+	Services []ServiceSpec `json:"services,omitempty"`
+	// PersistentStorage requests a persistent volume for each Pod.
+	// Only supported with the `StatefulSet` kind.
+	// Optional.
+	PersistentStorage *PersistentStorage `json:"persistentStorage,omitempty"`
+	// PodLabels are added to the labels of the Pods.
+	// The labels set by the operator can't be overridden.
+	// Optional.
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+	// PodAnnotations are added to the annotations of the Pods.
+	// Optional.
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
+	// ImagePullSecrets are the names of the Secrets used to pull the images
+	// of the Habitat Services from private registries.
+	// Optional.
+	ImagePullSecrets []string `json:"imagePullSecrets,omitempty"`
+	// ServiceAccountName is the name of the ServiceAccount the Pods run as,
+	// in the namespace of the Habitat.
+	// Optional. Defaults to the `default` ServiceAccount.
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// PriorityClassName is the name of the PriorityClass of the Pods, e.g. to
+	// protect critical services from being preempted by less important Pods.
+	// Optional. Defaults to the default priority of the cluster.
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// Affinity constrains the nodes the Pods are scheduled on.
+	// Optional.
+	Affinity *apiv1.Affinity `json:"affinity,omitempty"`
+	// Tolerations allow the Pods to be scheduled on nodes with matching taints.
+	// Optional.
+	Tolerations []apiv1.Toleration `json:"tolerations,omitempty"`
+	// DNSPolicy is the DNS policy of the Pods. Either `ClusterFirst`,
+	// `ClusterFirstWithHostNet`, `Default` or `None`, which requires
+	// DNSConfig.
+	// Optional. Defaults to `ClusterFirst`.
+	DNSPolicy apiv1.DNSPolicy `json:"dnsPolicy,omitempty"`
+	// DNSConfig sets additional nameservers, search domains and resolver
+	// options of the Pods, merged with the ones of DNSPolicy.
+	// Optional.
+	DNSConfig *apiv1.PodDNSConfig `json:"dnsConfig,omitempty"`
+	// HostAliases are entries added to the hosts file of the Pods, e.g. to
+	// resolve external systems the Habitat Services bind to.
+	// Optional.
+	HostAliases []apiv1.HostAlias `json:"hostAliases,omitempty"`
+	// HostNetwork runs the Pods in the network namespace of their node, e.g.
+	// to lower the latency of the gossip between supervisors. The ports of
+	// the supervisors are then bound on the node, so that only one Pod of
+	// the Habitat can run per node.
+	// Optional. Defaults to false.
+	HostNetwork bool `json:"hostNetwork,omitempty"`
+	// GossipListenPort is the port the supervisor of the Habitat Service
+	// gossips with its peers on, e.g. to run several supervisors with host
+	// networking. The supervisors of additional services listen on the ports
+	// following it by steps of 100.
+	// Optional. Defaults to 9638.
+	GossipListenPort int32 `json:"gossipListenPort,omitempty"`
+	// HTTPListenPort is the port of the HTTP gateway of the supervisor of the
+	// Habitat Service. The supervisors of additional services listen on the
+	// ports following it by steps of 100.
+	// Optional. Defaults to 9631.
+	HTTPListenPort int32 `json:"httpListenPort,omitempty"`
+	// MinAvailable is the number of Pods that must remain available during
+	// voluntary disruptions, such as node drains, enforced by a
+	// PodDisruptionBudget. It must not be greater than Count.
+	// Optional. Defaults to no PodDisruptionBudget.
+	MinAvailable *int32 `json:"minAvailable,omitempty"`
+	// Expose publishes the ports of the Habitat Service through a Kubernetes
+	// Service named after the Habitat.
+	// Optional. Defaults to no Service.
+	Expose *Expose `json:"expose,omitempty"`
+	// UpdateStrategy is the strategy used to replace old Pods by new ones.
+	// Only supported with the `Deployment` kind.
+	// Optional. Defaults to a rolling update.
+	UpdateStrategy *UpdateStrategy `json:"updateStrategy,omitempty"`
+	// RevisionHistoryLimit is the number of old ReplicaSets kept to allow
+	// rolling back. Only supported with the `Deployment` kind.
+	// Optional. Defaults to 10.
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+	// ProgressDeadlineSeconds is how long a rollout can make no progress
+	// before it's reported as failed in the status of the Deployment. Only
+	// supported with the `Deployment` kind.
+	// Optional. Defaults to 600 seconds.
+	ProgressDeadlineSeconds *int32 `json:"progressDeadlineSeconds,omitempty"`
+	// PodManagementPolicy is either `OrderedReady` or `Parallel`. Use
+	// `Parallel` to start all the Pods at once, so that the ring forms faster.
+	// Only supported with the `StatefulSet` kind.
+	// Optional. Defaults to `OrderedReady`.
+	PodManagementPolicy appsv1.PodManagementPolicyType `json:"podManagementPolicy,omitempty"`
+	// BackoffLimit is the number of retries before the Job is marked as
+	// failed. Only supported with the `Job` kind.
+	// Optional. Defaults to 6.
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+	// RestartPolicy is either `OnFailure` or `Never`. Use `Never` to replace
+	// failed Pods instead of restarting their containers. Only supported with
+	// the `Job` kind.
+	// Optional. Defaults to `OnFailure`.
+	RestartPolicy apiv1.RestartPolicy `json:"restartPolicy,omitempty"`
+	// ContainerName is the name of the container running the main Habitat
+	// Service. It must not clash with the names of the other containers.
+	// Changing it triggers a rolling update.
+	// Optional. Defaults to `habitat-service`.
+	ContainerName string `json:"containerName,omitempty"`
+	// InitContainers are run before the supervisors are started. They can
+	// mount the `config` volume containing the peer file and, if
+	// ConfigSecretName is set, the `initialconfig` volume containing the
+	// user.toml file.
+	// Optional.
+	InitContainers []apiv1.Container `json:"initContainers,omitempty"`
+	// Sidecars are additional containers run in the Pods alongside the
+	// Habitat Services, e.g. to forward logs. They can mount the volumes
+	// listed in Volumes. Their names must not clash with the names of the
+	// other containers.
+	// Optional.
+	Sidecars []apiv1.Container `json:"sidecars,omitempty"`
+	// Volumes are additional volumes of the Pods, e.g. an `emptyDir` shared
+	// by the Habitat Service container and a sidecar. Their names must not
+	// clash with the names of the volumes created by the operator.
+	// Optional.
+	Volumes []apiv1.Volume `json:"volumes,omitempty"`
+	// VolumeMounts are additional volume mounts of the Habitat Service
+	// container, e.g. of one of the Volumes.
+	// Optional.
+	VolumeMounts []apiv1.VolumeMount `json:"volumeMounts,omitempty"`
+	// Env are the environment variables set in the Habitat Service container,
+	// e.g. `HAB_LICENSE`. Values can be read from ConfigMaps and Secrets.
+	// Optional.
+	Env []apiv1.EnvVar `json:"env,omitempty"`
+	// SupervisorVersion is the version of the Habitat supervisor the image
+	// must contain, e.g. `0.56.0`. Pods of an image containing another
+	// version fail to start, and the mismatch is reported in the status.
+	// Optional.
+	SupervisorVersion string `json:"supervisorVersion,omitempty"`
+	// ConfigMapRef mounts the keys of a ConfigMap as files in the Habitat
+	// Service container. Changing the ConfigMap triggers a rolling update.
+	// Optional.
+	ConfigMapRef *ConfigMapRef `json:"configMapRef,omitempty"`
+	// Config is the content of the user.toml file of the Habitat Service, as
+	// a Go template. It can refer to `.Name`, `.Namespace`, `.Count`,
+	// `.Service`, `.Group`, `.Topology` and `.Ring`. It can't be set together
+	// with ConfigSecretName. Changing it, or the values it refers to,
+	// triggers a rolling update.
+	// Optional.
+	Config string `json:"config,omitempty"`
+	// PreStop is run in the containers of the Habitat Services before they
+	// are stopped, so that the supervisors leave the ring cleanly.
+	// Optional. Defaults to running `hab sup term`.
+	PreStop *apiv1.Handler `json:"preStop,omitempty"`
+	// TerminationGracePeriodSeconds is how long the Pods are given to stop,
+	// including the time taken by PreStop, before being killed.
+	// Optional. Defaults to 30 seconds.
+	TerminationGracePeriodSeconds *int64 `json:"terminationGracePeriodSeconds,omitempty"`
+	// GatewayAuthTokenSecretName is the name of the Secret containing the
+	// token required by the supervisors' HTTP gateways, under the `token` key.
+	// Optional. Defaults to an unauthenticated gateway.
+	GatewayAuthTokenSecretName string `json:"gatewayAuthTokenSecretName,omitempty"`
+	// PeerWatchFile configures where the file containing the IP of a peer
+	// is mounted in the Habitat Service container, for images that expect
+	// another layout.
+	// Optional. Defaults to `/habitat-operator/peer-ip`.
+	PeerWatchFile *PeerWatchFile `json:"peerWatchFile,omitempty"`
+	// ConfigProjections are ConfigMaps and Secrets projected into the
+	// directory of the peer file, next to it, for images that read all their
+	// configuration files from a single directory. Only the `configMap` and
+	// `secret` sources are supported, and their files can't be named after
+	// the peer file.
+	// Optional.
+	ConfigProjections []apiv1.VolumeProjection `json:"configProjections,omitempty"`
+	// SecurityContext is the security context of the Pods, e.g. to run them
+	// as a non-root user.
+	// Optional.
+	SecurityContext *apiv1.PodSecurityContext `json:"securityContext,omitempty"`
+	// ContainerSecurityContext is the security context of the containers of
+	// the Habitat Services, unless overridden for an additional service. It
+	// replaces the default one entirely.
+	// Optional. Defaults to a non-privileged container that can't gain
+	// privileges, and drops all capabilities but `CHOWN`, `DAC_OVERRIDE`,
+	// `FOWNER`, `KILL`, `SETGID` and `SETUID`, which the supervisor needs to
+	// run the services as the hab user.
+	ContainerSecurityContext *apiv1.SecurityContext `json:"containerSecurityContext,omitempty"`
+	// HabUpdateStrategy is the strategy the supervisors use to update their
+	// service in place when a newer package is promoted to UpdateChannel,
+	// without replacing the Pods. Either `none`, `at-once` or `rolling`.
+	// Optional. Defaults to `none`.
+	HabUpdateStrategy HabUpdateStrategy `json:"habUpdateStrategy,omitempty"`
+	// UpdateChannel is the Builder channel the supervisors watch for newer
+	// packages of their service, e.g. `stable`.
+	// Optional. Defaults to the supervisors' default channel.
+	UpdateChannel string `json:"updateChannel,omitempty"`
+	// AdoptExisting makes the operator take over an existing Deployment
+	// with the name of the Habitat, instead of reporting a name conflict.
+	// The Deployment must not be controlled by another resource, and its
+	// selector must match the labels of the Pods of the Habitat, e.g. by
+	// setting PodLabels. Only supported with the `Deployment` kind.
+	// Optional.
+	AdoptExisting bool `json:"adoptExisting,omitempty"`
+	// Ring is the name of the ring the supervisors join. The Habitats of a
+	// namespace with the same Ring peer with each other's Pods, and those
+	// without a Ring form the default ring of the namespace. Rings can't span
+	// namespaces. Changing it triggers a rolling update.
+	// Optional.
+	Ring string `json:"ring,omitempty"`
+	// PeerSelection is the strategy used to choose the Pods written to the
+	// peer file of the ring, when there are more running Pods than peers.
+	// Either `OldestReady`, which prefers the ready Pods that were created
+	// first, or `LowestOrdinal`, which prefers the Pods of StatefulSets with
+	// the lowest ordinal. The Habitats of a ring should use the same strategy.
+	// Optional. Defaults to `OldestReady`.
+	PeerSelection PeerSelection `json:"peerSelection,omitempty"`
+	// Application and Environment are the Habitat application and
+	// environment the services belong to, for grouping them. Both must be set
+	// together, and they are also set as labels of the Pods.
+	// Optional.
+	Application string `json:"application,omitempty"`
+	Environment string `json:"environment,omitempty"`
+}
+
+type ConfigMapRef struct {
+	// Name is the name of the ConfigMap, in the namespace of the Habitat.
+	Name string `json:"name"`
+	// Items maps keys of the ConfigMap to file paths, relative to MountPath.
+	// Optional. Defaults to a file per key, named after the key.
+	Items []apiv1.KeyToPath `json:"items,omitempty"`
+	// MountPath is the directory the files are mounted in.
+	// Optional. Defaults to `/hab/svc/<service name>/files`, the directory of
+	// the files distributed over the ring.
+	MountPath string `json:"mountPath,omitempty"`
+}
+
+type PeerWatchFile struct {
+	// MountPath is the directory the peer file is mounted in. It must be
+	// absolute.
+	// Optional. Defaults to `/habitat-operator`.
+	MountPath string `json:"mountPath,omitempty"`
+	// Filename is the name of the peer file in MountPath.
+	// Optional. Defaults to `peer-ip`.
+	Filename string `json:"filename,omitempty"`
+}
+
+type Expose struct {
+	// Type is the type of the Service. Either `ClusterIP`, `NodePort` or
+	// `LoadBalancer`.
+	// Optional. Defaults to `ClusterIP`.
+	Type apiv1.ServiceType `json:"type,omitempty"`
+	// Ports are the ports exposed by the Service, targeting the ports the
+	// Habitat Service listens on.
+	Ports []apiv1.ServicePort `json:"ports"`
+	// Annotations are added to the annotations of the Service, e.g. to
+	// configure the load balancer of a cloud provider.
+	// Optional.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type UpdateStrategy struct {
+	// Type is either `RollingUpdate` or `Recreate`. Use `Recreate` for
+	// services that can't have two versions gossiping at once.
+	// Optional. Defaults to `RollingUpdate`.
+	Type appsv1.DeploymentStrategyType `json:"type,omitempty"`
+	// MaxSurge is the maximum number of Pods that can be created over the
+	// desired number during a rolling update. Either a number or a percentage.
+	// Optional.
+	MaxSurge *intstr.IntOrString `json:"maxSurge,omitempty"`
+	// MaxUnavailable is the maximum number of Pods that can be unavailable
+	// during a rolling update. Either a number or a percentage.
+	// Optional.
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+}
+
+type PersistentStorage struct {
+	// Size is the size of the volume claimed by each Pod, e.g. `10Gi`.
+	Size string `json:"size"`
+	// StorageClassName is the name of the StorageClass of the claimed volumes.
+	// Optional. Defaults to the default StorageClass of the cluster.
+	StorageClassName string `json:"storageClassName,omitempty"`
+	// MountPath is the path the volume is mounted at in the container.
+	// Optional. Defaults to `/hab/svc/<service name>/data`.
+	MountPath string `json:"mountPath,omitempty"`
+}
+
+type ServiceSpec struct {
+	// Name is the name of the Habitat Service, also used as the name of its
+	// container.
+	Name string `json:"name"`
+	// Image is the Docker image of the Habitat Service.
+	Image string `json:"image"`
+	// Bind is when one service connects to another forming a producer/consumer relationship.
+	// Optional.
+	Bind []Bind `json:"bind,omitempty"`
+	// SecurityContext is the security context of the container of the
+	// Habitat Service.
+	// Optional. Defaults to the ContainerSecurityContext of the Habitat.
+	SecurityContext *apiv1.SecurityContext `json:"securityContext,omitempty"`
+}
+
+type Probe struct {
+	// Readiness replaces the default readiness probe.
+	// Optional.
+	Readiness *apiv1.Probe `json:"readiness,omitempty"`
+	// Liveness replaces the default liveness probe.
+	// Optional.
+	Liveness *apiv1.Probe `json:"liveness,omitempty"`
 }
 
 type HabitatStatus struct {
 	State   HabitatState `json:"state,omitempty"`
 	Message string       `json:"message,omitempty"`
+	// DesiredReplicas is the amount of Services requested in the spec.
+	DesiredReplicas int `json:"desiredReplicas,omitempty"`
+	// ReadyReplicas is the amount of Services that are ready.
+	ReadyReplicas int `json:"readyReplicas,omitempty"`
+	// Phase is `Running` once at least DesiredReplicas Services are ready,
+	// and `Pending` otherwise.
+	Phase HabitatPhase `json:"phase,omitempty"`
+	// Leader is the name of the Pod running the elected leader of a Habitat
+	// with the leader topology. It's empty while there's no leader, e.g.
+	// during an election.
+	Leader string `json:"leader,omitempty"`
+	// Conditions are the latest observations of the Habitat's state.
+	Conditions []HabitatCondition `json:"conditions,omitempty"`
+}
+
+type HabitatCondition struct {
+	// Type is the type of the condition.
+	Type HabitatConditionType `json:"type"`
+	// Status is either `True`, `False` or `Unknown`.
+	Status apiv1.ConditionStatus `json:"status"`
+	// LastTransitionTime is the last time the status changed.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Reason is a machine readable reason for the last transition.
+	Reason string `json:"reason,omitempty"`
+	// Message is a human readable description of the last transition.
+	Message string `json:"message,omitempty"`
 }
 
+type HabitatConditionType string
+
 type HabitatState string
 
+type HabitatPhase string
+
 type Service struct {
 	// Group is the value of the --group flag for the hab client.
 	// Optional. Defaults to `default`.
@@ -68,6 +456,11 @@ type Service struct {
 	// The name of the secret that contains the ring key.
 	// Optional.
 	RingSecretName string `json:"ringSecretName,omitempty"`
+	// UserKeySecretName is the name of the Secret that contains the user key
+	// pair, used to encrypt the configuration sent to the service. Each key of
+	// the Secret is the filename of a key, e.g. `user-20180101000000.pub`.
+	// Optional.
+	UserKeySecretName string `json:"userKeySecretName,omitempty"`
 	// Bind is when one service connects to another forming a producer/consumer relationship.
 	// Optional.
 	Bind []Bind `json:"bind,omitempty"`
@@ -82,11 +475,18 @@ type Bind struct {
 	// Service is the name of the service this bind refers to.
 	Service string `json:"service"`
 	// Group is the group of the service this bind refers to.
+	// Optional. Defaults to `default`.
 	Group string `json:"group"`
 }
 
 type Topology string
 
+type WorkloadKind string
+
+type HabUpdateStrategy string
+
+type PeerSelection string
+
 func (t Topology) String() string {
 	return string(t)
 }
@@ -95,8 +495,45 @@ const (
 	HabitatStateCreated   HabitatState = "Created"
 	HabitatStateProcessed HabitatState = "Processed"
 
+	HabitatPhasePending HabitatPhase = "Pending"
+	HabitatPhaseRunning HabitatPhase = "Running"
+
 	TopologyStandalone Topology = "standalone"
 	TopologyLeader     Topology = "leader"
+
+	WorkloadKindDeployment  WorkloadKind = "Deployment"
+	WorkloadKindStatefulSet WorkloadKind = "StatefulSet"
+	WorkloadKindJob         WorkloadKind = "Job"
+
+	HabUpdateStrategyNone    HabUpdateStrategy = "none"
+	HabUpdateStrategyAtOnce  HabUpdateStrategy = "at-once"
+	HabUpdateStrategyRolling HabUpdateStrategy = "rolling"
+
+	PeerSelectionOldestReady   PeerSelection = "OldestReady"
+	PeerSelectionLowestOrdinal PeerSelection = "LowestOrdinal"
+
+	// HabitatConditionSupervisorVersionMismatch is true when the image doesn't
+	// contain the requested supervisor version.
+	HabitatConditionSupervisorVersionMismatch HabitatConditionType = "SupervisorVersionMismatch"
+	// HabitatConditionNameConflict is true when a resource the operator needs
+	// to create for the Habitat already exists, and is not managed by the
+	// operator for it.
+	HabitatConditionNameConflict HabitatConditionType = "NameConflict"
+	// HabitatConditionValidationFailed is true when the spec of the Habitat
+	// is invalid, and the Habitat is not reconciled until it's fixed.
+	HabitatConditionValidationFailed HabitatConditionType = "ValidationFailed"
+	// HabitatConditionValidationWarning is true when the spec of the Habitat
+	// is valid, but likely to prevent it from working as expected.
+	HabitatConditionValidationWarning HabitatConditionType = "ValidationWarning"
+	// HabitatConditionAvailable is true when as many Pods as requested by
+	// count are ready.
+	HabitatConditionAvailable HabitatConditionType = "Available"
+	// HabitatConditionDeploymentAvailable has the same status as
+	// HabitatConditionAvailable, whatever the kind of the workload.
+	HabitatConditionDeploymentAvailable HabitatConditionType = "DeploymentAvailable"
+	// HabitatConditionConfigMapReady is true when the ConfigMap containing
+	// the peer file exists.
+	HabitatConditionConfigMapReady HabitatConditionType = "ConfigMapReady"
 )
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -20,6 +20,7 @@ import (
 
 	"github.com/google/gofuzz"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/api/testing/fuzzer"
 	roundtrip "k8s.io/apimachinery/pkg/api/testing/roundtrip"
 	metafuzzer "k8s.io/apimachinery/pkg/apis/meta/fuzzer"
@@ -27,6 +28,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	runtimeserializer "k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 var _ runtime.Object = &Habitat{}
@@ -37,6 +39,18 @@ var _ metav1.ListMetaAccessor = &HabitatList{}
 
 func habitatFuzzerFuncs(codecs runtimeserializer.CodecFactory) []interface{} {
 	return []interface{}{
+		// Quantities only round trip when they are in canonical form.
+		func(q *resource.Quantity, c fuzz.Continue) {
+			*q = *resource.NewQuantity(c.Int63n(1000), resource.DecimalSI)
+		},
+		// IntOrStrings only marshal when their type is valid.
+		func(is *intstr.IntOrString, c fuzz.Continue) {
+			if c.RandBool() {
+				*is = intstr.FromInt(c.Int())
+			} else {
+				*is = intstr.FromString(c.RandString())
+			}
+		},
 		func(obj *HabitatList, c fuzz.Continue) {
 			c.FuzzNoCustom(obj)
 			obj.Items = make([]Habitat, c.Intn(10))
@@ -12,10 +12,13 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package client manages the Habitat CustomResourceDefinition. The typed
+// clientset, informers and listers for Habitats are in its subpackages.
 package client
 
 import (
 	"reflect"
+	"strings"
 	"time"
 
 	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
@@ -33,6 +36,10 @@ const (
 	habitatCRDName           = habv1beta1.HabitatResourcePlural + "." + habv1beta1.GroupName
 	habitatResourceShortName = "hab"
 
+	// The paths of the fields exposed through the scale subresource.
+	specReplicasPath   = ".spec.count"
+	statusReplicasPath = ".status.readyReplicas"
+
 	pollInterval = 500 * time.Millisecond
 	timeOut      = 10 * time.Second
 )
@@ -40,7 +47,53 @@ const (
 // CreateCRD creates the Habitat Custom Resource Definition.
 // It checks if creation has completed successfully, and deletes the CRD in case of error.
 func CreateCRD(clientset apiextensionsclient.Interface) (*apiextensionsv1beta1.CustomResourceDefinition, error) {
-	crd := &apiextensionsv1beta1.CustomResourceDefinition{
+	_, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Create(newCRD())
+	if err != nil {
+		return nil, err
+	}
+
+	crd, err := waitForCRDEstablished(clientset)
+
+	// delete CRD if there was an error.
+	if err != nil {
+		deleteErr := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(habitatCRDName, nil)
+		if deleteErr != nil {
+			return nil, errors.NewAggregate([]error{err, deleteErr})
+		}
+
+		return nil, err
+	}
+
+	return crd, nil
+}
+
+// UpdateCRD brings an already existing Habitat Custom Resource Definition up
+// to date, e.g. after it has been created by an older version of the operator.
+// It checks if the CRD is established, but unlike CreateCRD it never deletes it,
+// as that would delete all the Habitat objects as well.
+func UpdateCRD(clientset apiextensionsclient.Interface) (*apiextensionsv1beta1.CustomResourceDefinition, error) {
+	crd, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Get(habitatCRDName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	desired := newCRD()
+
+	if !reflect.DeepEqual(crd.Spec, desired.Spec) {
+		crd.Spec = desired.Spec
+
+		if _, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Update(crd); err != nil {
+			return nil, err
+		}
+	}
+
+	return waitForCRDEstablished(clientset)
+}
+
+func newCRD() *apiextensionsv1beta1.CustomResourceDefinition {
+	kind := reflect.TypeOf(habv1beta1.Habitat{}).Name()
+
+	return &apiextensionsv1beta1.CustomResourceDefinition{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: habitatCRDName,
 		},
@@ -49,20 +102,36 @@ func CreateCRD(clientset apiextensionsclient.Interface) (*apiextensionsv1beta1.C
 			Version: habv1beta1.SchemeGroupVersion.Version,
 			Scope:   apiextensionsv1beta1.NamespaceScoped,
 			Names: apiextensionsv1beta1.CustomResourceDefinitionNames{
-				Plural:     habv1beta1.HabitatResourcePlural,
-				Kind:       reflect.TypeOf(habv1beta1.Habitat{}).Name(),
+				Plural: habv1beta1.HabitatResourcePlural,
+				// Singular and ListKind are defaulted by the API server, set them
+				// explicitly so that an up to date CRD is not needlessly updated.
+				Singular:   strings.ToLower(kind),
+				Kind:       kind,
+				ListKind:   reflect.TypeOf(habv1beta1.HabitatList{}).Name(),
 				ShortNames: []string{habitatResourceShortName},
 			},
+			// The scale subresource allows Habitats to be scaled with
+			// `kubectl scale`, and the status subresource keeps the status
+			// written by the operator and the spec written by users from
+			// overwriting each other. They require Kubernetes 1.10 with the
+			// CustomResourceSubresources feature gate enabled, or 1.11.
+			Subresources: &apiextensionsv1beta1.CustomResourceSubresources{
+				Status: &apiextensionsv1beta1.CustomResourceSubresourceStatus{},
+				Scale: &apiextensionsv1beta1.CustomResourceSubresourceScale{
+					SpecReplicasPath:   specReplicasPath,
+					StatusReplicasPath: statusReplicasPath,
+				},
+			},
 		},
 	}
+}
 
-	_, err := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Create(crd)
-	if err != nil {
-		return nil, err
-	}
+// waitForCRDEstablished polls the API until the Habitat CRD is established.
+func waitForCRDEstablished(clientset apiextensionsclient.Interface) (*apiextensionsv1beta1.CustomResourceDefinition, error) {
+	var crd *apiextensionsv1beta1.CustomResourceDefinition
 
-	// wait for CRD being established.
-	err = wait.Poll(pollInterval, timeOut, func() (bool, error) {
+	err := wait.Poll(pollInterval, timeOut, func() (bool, error) {
+		var err error
 		crd, err = clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Get(habitatCRDName, metav1.GetOptions{})
 
 		if err != nil {
@@ -85,14 +154,7 @@ func CreateCRD(clientset apiextensionsclient.Interface) (*apiextensionsv1beta1.C
 
 		return false, err
 	})
-
-	// delete CRD if there was an error.
 	if err != nil {
-		deleteErr := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(habitatCRDName, nil)
-		if deleteErr != nil {
-			return nil, errors.NewAggregate([]error{err, deleteErr})
-		}
-
 		return nil, err
 	}
 
@@ -100,12 +162,17 @@ func CreateCRD(clientset apiextensionsclient.Interface) (*apiextensionsv1beta1.C
 }
 
 // WaitForHabitatInstanceProcessed polls the API for a specific Habitat with a state of "Processed".
-func WaitForHabitatInstanceProcessed(client *rest.RESTClient, name string) error {
+// If namespace is empty, the default namespace is used.
+func WaitForHabitatInstanceProcessed(client *rest.RESTClient, namespace, name string) error {
+	if namespace == "" {
+		namespace = apiv1.NamespaceDefault
+	}
+
 	return wait.Poll(100*time.Millisecond, 10*time.Second, func() (bool, error) {
 		var hab habv1beta1.Habitat
 		err := client.Get().
 			Resource(habv1beta1.HabitatResourcePlural).
-			Namespace(apiv1.NamespaceDefault).
+			Namespace(namespace).
 			Name(name).
 			Do().Into(&hab)
 
@@ -0,0 +1,68 @@
+// Copyright (c) 2017 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+)
+
+// TestScaleSubresourcePaths checks that the paths of the scale subresource
+// point at the replica fields of a serialized Habitat, so that scaling it
+// round-trips through Spec.Count.
+func TestScaleSubresourcePaths(t *testing.T) {
+	h := habv1beta1.Habitat{
+		Spec:   habv1beta1.HabitatSpec{Count: 3},
+		Status: habv1beta1.HabitatStatus{ReadyReplicas: 2},
+	}
+
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	scale := newCRD().Spec.Subresources.Scale
+
+	tests := []struct {
+		path     string
+		expected float64
+	}{
+		{scale.SpecReplicasPath, float64(h.Spec.Count)},
+		{scale.StatusReplicasPath, float64(h.Status.ReadyReplicas)},
+	}
+
+	for _, tt := range tests {
+		var v interface{} = obj
+		for _, field := range strings.Split(strings.TrimPrefix(tt.path, "."), ".") {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				t.Fatalf("%s: %v is not an object", tt.path, v)
+			}
+			v = m[field]
+		}
+
+		if v != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.path, tt.expected, v)
+		}
+	}
+}
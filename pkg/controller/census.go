@@ -0,0 +1,205 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// censusTimeout is how long a supervisor can take to return its census.
+	censusTimeout = 5 * time.Second
+	// leaderPollInterval is how often the leaders of the Habitats with the
+	// leader topology are polled.
+	leaderPollInterval = 30 * time.Second
+)
+
+// census is the part of the census returned by the HTTP gateway of a
+// supervisor that the operator needs.
+type census struct {
+	CensusGroups map[string]censusGroup `json:"census_groups"`
+}
+
+type censusGroup struct {
+	Population map[string]censusMember `json:"population"`
+}
+
+type censusMember struct {
+	Leader bool `json:"leader"`
+	Alive  bool `json:"alive"`
+	Sys    struct {
+		IP       string `json:"ip"`
+		Hostname string `json:"hostname"`
+	} `json:"sys"`
+}
+
+// ringLeader returns the leader of the Habitat last found by pollLeaders, so
+// that reconciliations don't wait for the supervisors. current is the leader
+// in the status of the Habitat, which is kept until the leader is polled.
+func (hc *HabitatController) ringLeader(h *habv1beta1.Habitat, current string) string {
+	if h.Spec.Service.Topology != habv1beta1.TopologyLeader || hc.censusClient == nil {
+		return ""
+	}
+
+	k, err := cache.MetaNamespaceKeyFunc(h)
+	if err != nil {
+		return current
+	}
+
+	hc.leadersMu.Lock()
+	defer hc.leadersMu.Unlock()
+
+	leader, ok := hc.leaders[k]
+	if !ok {
+		return current
+	}
+
+	return leader
+}
+
+// pollLeaders finds the leaders of the Habitats with the leader topology, and
+// enqueues the ones whose leader changed, so that their status is updated.
+func (hc *HabitatController) pollLeaders(ctx context.Context) {
+	if hc.censusClient == nil {
+		return
+	}
+
+	habitats, err := hc.habLister.List(labels.Everything())
+	if err != nil {
+		level.Error(hc.logger).Log("msg", "Could not list Habitats", "err", err)
+		return
+	}
+
+	leaders := make(map[string]string)
+	for _, h := range habitats {
+		if h.Spec.Service.Topology != habv1beta1.TopologyLeader {
+			continue
+		}
+
+		k, err := cache.MetaNamespaceKeyFunc(h)
+		if err != nil {
+			continue
+		}
+
+		current := hc.ringLeader(h, h.Status.Leader)
+		leader := hc.censusLeader(ctx, h, current)
+		leaders[k] = leader
+
+		if leader != h.Status.Leader {
+			hc.enqueue(h)
+		}
+	}
+
+	hc.leadersMu.Lock()
+	hc.leaders = leaders
+	hc.leadersMu.Unlock()
+}
+
+// censusLeader returns the name of the Pod whose supervisor is the elected
+// leader of the service group of the Habitat, according to the census of one
+// of its supervisors, or an empty string while there's no leader, e.g. during
+// an election. current is the last known leader, which is kept if the census
+// can't be retrieved, so that the status doesn't flap because of a transient
+// error.
+func (hc *HabitatController) censusLeader(ctx context.Context, h *habv1beta1.Habitat, current string) string {
+
+	pods, err := hc.getRunningPods(h)
+	if err != nil {
+		return current
+	}
+
+	// Any supervisor of the ring knows the leader, but only the ones of the
+	// Habitat are known to run its service.
+	var own []apiv1.Pod
+	for _, p := range pods {
+		if p.Labels[habv1beta1.HabitatNameLabel] == habitatLabelValue(h) {
+			own = append(own, p)
+		}
+	}
+	if len(own) == 0 {
+		return ""
+	}
+
+	c, err := hc.getCensus(ctx, h, own[0].Status.PodIP)
+	if err != nil {
+		level.Debug(hc.logger).Log("msg", "Could not get census", "name", h.Name, "pod", own[0].Name, "err", err)
+		return current
+	}
+
+	for _, m := range c.CensusGroups[fmt.Sprintf("%s.%s", h.Spec.Service.Name, groupOrDefault(h.Spec.Service.Group))].Population {
+		if !m.Leader || !m.Alive {
+			continue
+		}
+
+		for _, p := range pods {
+			if p.Status.PodIP == m.Sys.IP || p.Name == m.Sys.Hostname {
+				return p.Name
+			}
+		}
+	}
+
+	return ""
+}
+
+// getCensus returns the census of the supervisor listening on ip.
+func (hc *HabitatController) getCensus(ctx context.Context, h *habv1beta1.Habitat, ip string) (*census, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/census", net.JoinHostPort(ip, strconv.Itoa(int(httpListenPort(h))))), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if name := h.Spec.GatewayAuthTokenSecretName; name != "" {
+		obj, exists, err := hc.secretInformer.GetStore().GetByKey(h.Namespace + "/" + name)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("secret %s not found", name)
+		}
+		req.Header.Set("Authorization", "Bearer "+string(obj.(*apiv1.Secret).Data[gatewayAuthTokenKey]))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, censusTimeout)
+	defer cancel()
+
+	resp, err := hc.censusClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var c census
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
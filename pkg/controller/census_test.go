@@ -0,0 +1,194 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	hablisters "github.com/kinvolk/habitat-operator/pkg/client/listers/habitat/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// redirectTransport sends all the requests to the server at url.
+type redirectTransport struct {
+	url *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = t.url.Scheme
+	req.URL.Host = t.url.Host
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRingLeader(t *testing.T) {
+	var census string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if census == "" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(census))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{
+		logger:       log.NewNopLogger(),
+		podInformer:  cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Pod{}, 0, cache.Indexers{ringIndex: podRingIndexFunc}),
+		censusClient: &http.Client{Transport: redirectTransport{url: u}},
+	}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Service: habv1beta1.Service{
+				Name:     "redis",
+				Topology: habv1beta1.TopologyLeader,
+			},
+		},
+	}
+
+	for name, ip := range map[string]string{"db-0": "10.0.0.1", "db-1": "10.0.0.2"} {
+		hc.podInformer.GetIndexer().Add(&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels:    map[string]string{habv1beta1.HabitatLabel: "true", habv1beta1.HabitatNameLabel: "db"},
+			},
+			Status: apiv1.PodStatus{Phase: apiv1.PodRunning, PodIP: ip},
+		})
+	}
+
+	tests := []struct {
+		name    string
+		census  string
+		current string
+		leader  string
+	}{
+		{
+			name:   "leader elected",
+			census: `{"census_groups": {"redis.default": {"population": {"a": {"leader": false, "alive": true, "sys": {"ip": "10.0.0.1"}}, "b": {"leader": true, "alive": true, "sys": {"ip": "10.0.0.2"}}}}}}`,
+			leader: "db-1",
+		},
+		{
+			name:    "election in progress",
+			census:  `{"census_groups": {"redis.default": {"population": {"a": {"leader": false, "alive": true, "sys": {"ip": "10.0.0.1"}}}}}}`,
+			current: "db-1",
+			leader:  "",
+		},
+		{
+			name:    "dead leader",
+			census:  `{"census_groups": {"redis.default": {"population": {"b": {"leader": true, "alive": false, "sys": {"ip": "10.0.0.2"}}}}}}`,
+			current: "db-1",
+			leader:  "",
+		},
+		{
+			name:    "census unavailable",
+			current: "db-1",
+			leader:  "db-1",
+		},
+	}
+
+	for _, tt := range tests {
+		census = tt.census
+
+		if got := hc.censusLeader(context.Background(), h, tt.current); got != tt.leader {
+			t.Errorf("%s: expected leader %q, got %q", tt.name, tt.leader, got)
+		}
+	}
+
+	// The leader is only reported for the leader topology.
+	h.Spec.Service.Topology = habv1beta1.TopologyStandalone
+	if got := hc.ringLeader(h, "db-1"); got != "" {
+		t.Errorf("expected no leader with the standalone topology, got %q", got)
+	}
+}
+
+func TestPollLeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"census_groups": {"redis.default": {"population": {"b": {"leader": true, "alive": true, "sys": {"ip": "10.0.0.2"}}}}}}`))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	hc := &HabitatController{
+		logger:         log.NewNopLogger(),
+		queue:          workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		habLister:      hablisters.NewHabitatLister(indexer),
+		podInformer:    cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Pod{}, 0, cache.Indexers{ringIndex: podRingIndexFunc}),
+		secretInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Secret{}, 0, cache.Indexers{}),
+		censusClient:   &http.Client{Transport: redirectTransport{url: u}},
+	}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Service: habv1beta1.Service{
+				Name:     "redis",
+				Topology: habv1beta1.TopologyLeader,
+			},
+			GatewayAuthTokenSecretName: "gateway-token",
+		},
+	}
+	indexer.Add(h)
+
+	hc.secretInformer.GetIndexer().Add(&apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "gateway-token", Namespace: "default"},
+		Data:       map[string][]byte{gatewayAuthTokenKey: []byte("secret")},
+	})
+	hc.podInformer.GetIndexer().Add(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "db-1",
+			Namespace: "default",
+			Labels:    map[string]string{habv1beta1.HabitatLabel: "true", habv1beta1.HabitatNameLabel: "db"},
+		},
+		Status: apiv1.PodStatus{Phase: apiv1.PodRunning, PodIP: "10.0.0.2"},
+	})
+
+	// Until the leader is polled, the one in the status is kept.
+	if got := hc.ringLeader(h, "db-0"); got != "db-0" {
+		t.Errorf("expected the current leader before polling, got %q", got)
+	}
+
+	hc.pollLeaders(context.Background())
+
+	if got := hc.ringLeader(h, "db-0"); got != "db-1" {
+		t.Errorf("expected the polled leader db-1, got %q", got)
+	}
+	if n := hc.queue.Len(); n != 1 {
+		t.Errorf("expected the Habitat whose leader changed to be enqueued, got %d keys", n)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	habclientv1beta1 "github.com/kinvolk/habitat-operator/pkg/client/clientset/versioned/typed/habitat/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	schedulingv1alpha1 "k8s.io/api/scheduling/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	batchv1client "k8s.io/client-go/kubernetes/typed/batch/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	policyv1beta1client "k8s.io/client-go/kubernetes/typed/policy/v1beta1"
+	schedulingv1alpha1client "k8s.io/client-go/kubernetes/typed/scheduling/v1alpha1"
+	"k8s.io/client-go/rest"
+)
+
+// The typed clients of client-go don't take a context, so the functions in
+// this file return clients whose requests are bound to one instead. Each of
+// them also returns the function releasing the context, which must be called
+// once the API calls made with the client are done.
+
+// contextClient is a rest.Interface whose requests are canceled once ctx is
+// done.
+type contextClient struct {
+	rest.Interface
+	ctx context.Context
+}
+
+func (c contextClient) Verb(verb string) *rest.Request {
+	return c.Interface.Verb(verb).Context(c.ctx)
+}
+
+func (c contextClient) Post() *rest.Request {
+	return c.Interface.Post().Context(c.ctx)
+}
+
+func (c contextClient) Put() *rest.Request {
+	return c.Interface.Put().Context(c.ctx)
+}
+
+func (c contextClient) Patch(pt types.PatchType) *rest.Request {
+	return c.Interface.Patch(pt).Context(c.ctx)
+}
+
+func (c contextClient) Get() *rest.Request {
+	return c.Interface.Get().Context(c.ctx)
+}
+
+func (c contextClient) Delete() *rest.Request {
+	return c.Interface.Delete().Context(c.ctx)
+}
+
+// appsClient returns an apps/v1 client whose requests time out after
+// apiCallTimeout, or once ctx is done.
+func (hc *HabitatController) appsClient(ctx context.Context) (appsv1client.AppsV1Interface, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, apiCallTimeout)
+	return appsv1client.New(contextClient{hc.config.KubernetesClientset.AppsV1().RESTClient(), ctx}), cancel
+}
+
+// batchClient returns a batch/v1 client whose requests time out after
+// apiCallTimeout, or once ctx is done.
+func (hc *HabitatController) batchClient(ctx context.Context) (batchv1client.BatchV1Interface, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, apiCallTimeout)
+	return batchv1client.New(contextClient{hc.config.KubernetesClientset.BatchV1().RESTClient(), ctx}), cancel
+}
+
+// coreClient returns a core/v1 client whose requests time out after
+// apiCallTimeout, or once ctx is done.
+func (hc *HabitatController) coreClient(ctx context.Context) (corev1client.CoreV1Interface, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, apiCallTimeout)
+	return corev1client.New(contextClient{hc.config.KubernetesClientset.CoreV1().RESTClient(), ctx}), cancel
+}
+
+// policyClient returns a policy/v1beta1 client whose requests time out after
+// apiCallTimeout, or once ctx is done.
+func (hc *HabitatController) policyClient(ctx context.Context) (policyv1beta1client.PolicyV1beta1Interface, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, apiCallTimeout)
+	return policyv1beta1client.New(contextClient{hc.config.KubernetesClientset.PolicyV1beta1().RESTClient(), ctx}), cancel
+}
+
+// schedulingClient returns a scheduling/v1alpha1 client whose requests time
+// out after apiCallTimeout, or once ctx is done.
+func (hc *HabitatController) schedulingClient(ctx context.Context) (schedulingv1alpha1client.SchedulingV1alpha1Interface, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, apiCallTimeout)
+	return schedulingv1alpha1client.New(contextClient{hc.config.KubernetesClientset.SchedulingV1alpha1().RESTClient(), ctx}), cancel
+}
+
+// habitatClient returns a Habitat client whose requests time out after
+// apiCallTimeout, or once ctx is done.
+func (hc *HabitatController) habitatClient(ctx context.Context) (habclientv1beta1.HabitatV1beta1Interface, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, apiCallTimeout)
+	return habclientv1beta1.New(contextClient{hc.config.HabitatClient.HabitatV1beta1().RESTClient(), ctx}), cancel
+}
+
+// isTimeout returns true if err was returned by an API call that didn't
+// complete before its deadline.
+func isTimeout(err error) bool {
+	if uErr, ok := err.(*url.Error); ok {
+		err = uErr.Err
+	}
+
+	return err == context.DeadlineExceeded
+}
+
+// createBackoff is how often creating a resource is attempted when the API
+// server returns a transient error, before giving up until the Habitat is
+// requeued.
+var createBackoff = wait.Backoff{
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    5,
+}
+
+// isRetryable returns true if err is a transient error of the API server,
+// after which the same request can be sent again.
+func isRetryable(err error) bool {
+	return apierrors.IsConflict(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err)
+}
+
+// retryCreate calls create, retrying with exponential backoff as long as it
+// fails with a retryable error. If it still fails once createBackoff is
+// exhausted, a warning Event is recorded for the Habitat and the last error is
+// returned.
+func (hc *HabitatController) retryCreate(ctx context.Context, h *habv1beta1.Habitat, kind, name string, create func() error) error {
+	var err error
+	waitErr := wait.ExponentialBackoff(createBackoff, func() (bool, error) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return false, ctxErr
+		}
+
+		if err = create(); err == nil || !isRetryable(err) {
+			return true, err
+		}
+
+		level.Debug(hc.logger).Log("msg", "Could not create resource, retrying", "kind", kind, "name", name, "err", err)
+
+		return false, nil
+	})
+
+	if waitErr == wait.ErrWaitTimeout {
+		hc.config.EventRecorder.Eventf(h, apiv1.EventTypeWarning, reasonCreateFailed, "Could not create %s %s: %v", kind, name, err)
+
+		return err
+	}
+
+	return waitErr
+}
+
+// The following functions get objects from the API server, for when they're
+// not in the cache of any informer.
+
+func (hc *HabitatController) getSecret(ctx context.Context, ns, name string) (*apiv1.Secret, error) {
+	core, cancel := hc.coreClient(ctx)
+	defer cancel()
+
+	return core.Secrets(ns).Get(name, metav1.GetOptions{})
+}
+
+func (hc *HabitatController) getServiceAccount(ctx context.Context, ns, name string) (*apiv1.ServiceAccount, error) {
+	core, cancel := hc.coreClient(ctx)
+	defer cancel()
+
+	return core.ServiceAccounts(ns).Get(name, metav1.GetOptions{})
+}
+
+func (hc *HabitatController) getPriorityClass(ctx context.Context, name string) (*schedulingv1alpha1.PriorityClass, error) {
+	scheduling, cancel := hc.schedulingClient(ctx)
+	defer cancel()
+
+	return scheduling.PriorityClasses().Get(name, metav1.GetOptions{})
+}
+
+func (hc *HabitatController) getConfigMap(ctx context.Context, ns, name string) (*apiv1.ConfigMap, error) {
+	core, cancel := hc.coreClient(ctx)
+	defer cancel()
+
+	return core.ConfigMaps(ns).Get(name, metav1.GetOptions{})
+}
+
+func (hc *HabitatController) getDeployment(ctx context.Context, ns, name string) (*appsv1.Deployment, error) {
+	apps, cancel := hc.appsClient(ctx)
+	defer cancel()
+
+	return apps.Deployments(ns).Get(name, metav1.GetOptions{})
+}
+
+func (hc *HabitatController) getStatefulSet(ctx context.Context, ns, name string) (*appsv1.StatefulSet, error) {
+	apps, cancel := hc.appsClient(ctx)
+	defer cancel()
+
+	return apps.StatefulSets(ns).Get(name, metav1.GetOptions{})
+}
+
+func (hc *HabitatController) getJob(ctx context.Context, ns, name string) (*batchv1.Job, error) {
+	batch, cancel := hc.batchClient(ctx)
+	defer cancel()
+
+	return batch.Jobs(ns).Get(name, metav1.GetOptions{})
+}
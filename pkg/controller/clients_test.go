@@ -0,0 +1,120 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestContextClientTimesOut(t *testing.T) {
+	// The API server never responds.
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	core := corev1client.New(contextClient{clientset.CoreV1().RESTClient(), ctx})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := core.Secrets("default").Get("foo", metav1.GetOptions{})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !isTimeout(err) {
+			t.Errorf("expected a timeout error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("API call didn't time out")
+	}
+}
+
+func TestRetryCreate(t *testing.T) {
+	defer func(b wait.Backoff) { createBackoff = b }(createBackoff)
+	createBackoff.Duration = time.Millisecond
+
+	gr := schema.GroupResource{Resource: "configmaps"}
+	tooManyRequests := apierrors.NewTooManyRequests("slow down", 0)
+	conflict := apierrors.NewConflict(gr, "foo", nil)
+	invalid := apierrors.NewBadRequest("invalid")
+
+	tests := []struct {
+		name  string
+		errs  []error
+		calls int
+		err   error
+		event bool
+	}{
+		{name: "success", calls: 1},
+		{name: "transient errors", errs: []error{tooManyRequests, conflict}, calls: 3},
+		{name: "permanent error", errs: []error{invalid}, calls: 1, err: invalid},
+		{name: "backoff exhausted", errs: []error{conflict, conflict, conflict, conflict, conflict}, calls: createBackoff.Steps, err: conflict, event: true},
+	}
+
+	for _, tt := range tests {
+		recorder := record.NewFakeRecorder(10)
+		hc := &HabitatController{
+			config: Config{EventRecorder: recorder},
+			logger: log.NewNopLogger(),
+		}
+		h := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+
+		calls := 0
+		err := hc.retryCreate(context.Background(), h, "ConfigMap", "foo", func() error {
+			calls++
+			if calls <= len(tt.errs) {
+				return tt.errs[calls-1]
+			}
+			return nil
+		})
+
+		if err != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+		if calls != tt.calls {
+			t.Errorf("%s: expected %d calls, got %d", tt.name, tt.calls, calls)
+		}
+		if event := len(recorder.Events) > 0; event != tt.event {
+			t.Errorf("%s: expected an Event to be recorded: %t, got %t", tt.name, tt.event, event)
+		}
+	}
+}
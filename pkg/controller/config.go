@@ -0,0 +1,175 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"text/template"
+
+	"github.com/go-kit/kit/log/level"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// configTemplateData are the only values the template of the user.toml file
+// can refer to. Exposing the whole Habitat would leak the fields added to it
+// in the future, and its methods.
+type configTemplateData struct {
+	Name      string
+	Namespace string
+	Count     int
+	Service   string
+	Group     string
+	Topology  string
+	Ring      string
+}
+
+// renderConfig returns the content of the user.toml file of the Habitat,
+// rendered from the template in its Config field.
+func renderConfig(h *habv1beta1.Habitat) (string, error) {
+	// No functions are added, so the template can only format the data.
+	t, err := template.New(userTOMLFile).Option("missingkey=error").Parse(h.Spec.Config)
+	if err != nil {
+		return "", err
+	}
+
+	data := configTemplateData{
+		Name:      h.Name,
+		Namespace: h.Namespace,
+		Count:     h.Spec.Count,
+		Service:   h.Spec.Service.Name,
+		Group:     h.Spec.Service.Group,
+		Topology:  h.Spec.Service.Topology.String(),
+		Ring:      h.Spec.Ring,
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// userConfigMapName returns the name of the ConfigMap containing the rendered
+// user.toml file of the Habitat.
+func userConfigMapName(h *habv1beta1.Habitat) string {
+	return shortName(fmt.Sprintf("%s-user-config", h.Name))
+}
+
+// newUserConfigMap returns the ConfigMap containing the rendered user.toml
+// file of the Habitat. It's owned by the workload running the Habitat, so that
+// it gets garbage collected together with it.
+func newUserConfigMap(h *habv1beta1.Habitat, config string, owner metav1.OwnerReference) *apiv1.ConfigMap {
+	return &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      userConfigMapName(h),
+			Namespace: h.Namespace,
+			Labels: map[string]string{
+				habv1beta1.HabitatLabel:     "true",
+				habv1beta1.HabitatNameLabel: habitatLabelValue(h),
+				habv1beta1.CreatedByLabel:   habv1beta1.CreatedBy,
+			},
+			Annotations:     operatorAnnotations(),
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Data: map[string]string{
+			userTOMLFile: config,
+		},
+	}
+}
+
+// handleUserConfigMap creates or updates the ConfigMap containing the rendered
+// user.toml file of the Habitat, if Config is set, and deletes it otherwise.
+// The Pods can't start until it exists, which the kubelet retries.
+func (hc *HabitatController) handleUserConfigMap(ctx context.Context, h *habv1beta1.Habitat, owner metav1.OwnerReference) error {
+	obj, exists, err := hc.cmInformer.GetStore().GetByKey(h.Namespace + "/" + userConfigMapName(h))
+	if err != nil {
+		return err
+	}
+
+	var current *apiv1.ConfigMap
+	if exists {
+		current = obj.(*apiv1.ConfigMap)
+	}
+
+	if h.Spec.Config == "" {
+		if current == nil || !isOwnedByHabitat(current, h) {
+			return nil
+		}
+
+		if err := hc.deleteConfigMap(ctx, current); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		level.Info(hc.logger).Log("msg", "deleted user config ConfigMap", "name", current.Name)
+
+		return nil
+	}
+
+	config, err := renderConfig(h)
+	if err != nil {
+		return err
+	}
+
+	cm := newUserConfigMap(h, config, owner)
+
+	if current == nil {
+		if _, err := hc.createConfigMap(ctx, cm); err != nil {
+			// The cache is not in sync yet.
+			if apierrors.IsAlreadyExists(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		level.Info(hc.logger).Log("msg", "created user config ConfigMap", "name", cm.Name)
+
+		return nil
+	}
+
+	if !isOwnedByHabitat(current, h) {
+		return nameConflictError{kind: "ConfigMap", name: cm.Name}
+	}
+
+	// ConfigMaps created by older versions of the operator lack the
+	// annotations.
+	if reflect.DeepEqual(current.Data, cm.Data) && !annotationsChanged(current.Annotations, cm.Annotations) {
+		return nil
+	}
+
+	updated := current.DeepCopy()
+	updated.Data = cm.Data
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string, len(cm.Annotations))
+	}
+	for k, v := range cm.Annotations {
+		updated.Annotations[k] = v
+	}
+
+	if _, err := hc.updateConfigMap(ctx, updated); err != nil {
+		return err
+	}
+
+	level.Info(hc.logger).Log("msg", "updated user config ConfigMap", "name", cm.Name)
+
+	return nil
+}
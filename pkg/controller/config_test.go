@@ -0,0 +1,116 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenderConfig(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "staging"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   3,
+			Service: habv1beta1.Service{Name: "redis", Group: "cache", Topology: habv1beta1.TopologyLeader},
+		},
+	}
+
+	tests := []struct {
+		config string
+		want   string
+		valid  bool
+	}{
+		{
+			config: `cluster = "{{.Name}}.{{.Namespace}}"` + "\nreplicas = {{.Count}}\n",
+			want:   `cluster = "db.staging"` + "\nreplicas = 3\n",
+			valid:  true,
+		},
+		{
+			config: `group = "{{.Service}}.{{.Group}}" # {{.Topology}}`,
+			want:   `group = "redis.cache" # leader`,
+			valid:  true,
+		},
+		// Only the documented values are exposed.
+		{config: `image = "{{.Spec.Image}}"`},
+		{config: `{{.Name | html | call}}`},
+		{config: `name = "{{.Name"`},
+	}
+
+	for _, tt := range tests {
+		h.Spec.Config = tt.config
+
+		got, err := renderConfig(h)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tt.config, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.config, err)
+		} else if got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.config, tt.want, got)
+		}
+	}
+}
+
+func TestPodTemplateConfig(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Image:   "foo/bar",
+			Service: habv1beta1.Service{Name: "redis", Topology: habv1beta1.TopologyStandalone},
+			Config:  "replicas = {{.Count}}\n",
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mounted bool
+	for _, v := range template.Spec.Volumes {
+		if v.ConfigMap != nil && v.ConfigMap.Name == userConfigMapName(h) {
+			mounted = true
+		}
+	}
+	if !mounted {
+		t.Errorf("expected the ConfigMap %s to be mounted, got volumes %v", userConfigMapName(h), template.Spec.Volumes)
+	}
+
+	hash := template.Annotations[userConfigHashAnnotation]
+	if hash == "" {
+		t.Fatal("expected the Pod template to be annotated with the hash of the config")
+	}
+
+	// The rendered config changes with the count.
+	h.Spec.Count = 2
+	template, err = hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.Annotations[userConfigHashAnnotation] == hash {
+		t.Error("expected a change of the rendered config to change the hash")
+	}
+}
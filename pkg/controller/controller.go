@@ -16,52 +16,209 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
-	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	habclientset "github.com/kinvolk/habitat-operator/pkg/client/clientset/versioned"
+	habinformers "github.com/kinvolk/habitat-operator/pkg/client/informers/externalversions"
+	hablisters "github.com/kinvolk/habitat-operator/pkg/client/listers/habitat/v1beta1"
+	"github.com/kinvolk/habitat-operator/pkg/version"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	apiv1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 )
 
 const (
-	resyncPeriod = 1 * time.Minute
+	defaultResyncPeriod = 1 * time.Minute
+	defaultMaxPeers     = 3
+	defaultWorkers      = 4
+	// cacheSyncTimeout is how long the controller waits for the caches of its
+	// informers to be filled on startup.
+	cacheSyncTimeout = 5 * time.Minute
+	// apiCallTimeout is how long a single call to the API server can take,
+	// so that a hung API server doesn't block the workers forever.
+	apiCallTimeout = 30 * time.Second
+	// shutdownTimeout is how long the controller waits for the
+	// reconciliations in flight to finish when it's stopped.
+	shutdownTimeout = 30 * time.Second
+	// podIPRequeueDelay is how long the controller waits before reconciling
+	// a Habitat again, while some of its Pods haven't been assigned an IP.
+	podIPRequeueDelay = 5 * time.Second
+
+	// Defaults of the Deployments running Habitats.
+	defaultRevisionHistoryLimit    = 10
+	defaultProgressDeadlineSeconds = 600
 
 	userTOMLFile = "user.toml"
-	configMapDir = "/habitat-operator"
 
-	peerFilename  = "peer-ip"
+	// The default location of the peer file in the containers.
+	defaultPeerWatchDir      = "/habitat-operator"
+	defaultPeerWatchFilename = "peer-ip"
+
 	peerFile      = "peer-watch-file"
 	configMapName = peerFile
 
+	// The name of the index of the Pods by ring.
+	ringIndex = "ring"
+	// The name of the index of the Habitats by the ConfigMap they reference.
+	configMapRefIndex = "configMapRef"
+
 	// The key under which the ring key is stored in the Kubernetes Secret.
 	ringSecretKey = "ring-key"
+	// The key under which the HTTP gateway auth token is stored in the
+	// Kubernetes Secret.
+	gatewayAuthTokenKey = "token"
+	// The environment variable the supervisor reads the auth token from.
+	gatewayAuthTokenEnv = "HAB_SUP_GATEWAY_AUTH_TOKEN"
 	// The extension of the key file.
 	ringKeyFileExt = "sym.key"
 	// Keys are saved to disk with the format `<name>-<revision>.<extension>`.
 	// This regexp captures the name part.
 	ringKeyRegexp = `^([\w_-]+)-\d{14}$`
 
+	// The name of the volume containing the ring and user keys.
+	keysVolumeName = "keys"
+	// The directory the supervisor reads keys from.
+	keysDir = "/hab/cache/keys"
+
 	initialConfigFilename = "initialconfig"
+
+	// The name of the volume containing the peer file.
+	configVolumeName = "config"
+
+	// The name of the volume containing the files of the referenced ConfigMap.
+	configMapRefVolumeName = "configmap"
+	// gatewayAuthTokenHashAnnotation holds the hash of the HTTP gateway auth
+	// token, so that changing the token rolls the Pods.
+	gatewayAuthTokenHashAnnotation = "habitat.sh/gateway-auth-token-hash"
+	// configMapHashAnnotation holds the hash of the data mounted from the
+	// referenced ConfigMap, so that changing the data rolls the Pods.
+	configMapHashAnnotation = "habitat.sh/configmap-hash"
+	// userConfigHashAnnotation holds the hash of the user.toml file rendered
+	// from Config, so that changing it rolls the Pods.
+	userConfigHashAnnotation = "habitat.sh/user-config-hash"
+	// gossipPortAnnotation holds the gossip port of the supervisor of a Pod,
+	// if it's not the default one, so that its peers can reach it.
+	gossipPortAnnotation = "habitat.sh/gossip-port"
+
+	// defaultTerminationGracePeriod is how long the Pods are given to stop by
+	// default, in seconds.
+	defaultTerminationGracePeriod = 30
+
+	// The name of the init container checking the version of the supervisor.
+	supervisorVersionContainerName = "supervisor-version"
+	// The directory the supervisor package is installed to in the images.
+	supervisorPkgDir = "/hab/pkgs/core/hab-sup"
+
+	// Reasons of the Events recorded for Habitats.
+	reasonCreated          = "Created"
+	reasonUpdated          = "Updated"
+	reasonDeleted          = "Deleted"
+	reasonValidationFailed = "ValidationFailed"
+	reasonMissingSecret    = "MissingSecret"
+	reasonNameConflict     = "NameConflict"
+	reasonAdopted          = "Adopted"
+
+	reasonSupervisorVersionMismatch = "SupervisorVersionMismatch"
+	reasonMissingConfigMap          = "MissingConfigMap"
+	reasonMissingServiceAccount     = "MissingServiceAccount"
+	reasonMissingPriorityClass      = "MissingPriorityClass"
+	reasonCreateFailed              = "CreateFailed"
+	reasonValidationWarning         = "ValidationWarning"
+
+	// Reasons of the conditions of Habitats.
+	reasonValid                      = "Valid"
+	reasonMinimumReplicasAvailable   = "MinimumReplicasAvailable"
+	reasonMinimumReplicasUnavailable = "MinimumReplicasUnavailable"
+	reasonConfigMapCreated           = "ConfigMapCreated"
+
+	// Ports the Habitat supervisor listens on.
+	gossipPort      = 9638
+	httpGatewayPort = 9631
+	// The ports of the supervisors of additional services are shifted by
+	// multiples of this offset.
+	servicePortOffset = 100
+	// The name of the HTTP gateway port of the Service exposing the
+	// supervisors.
+	httpGatewayPortName = "http-gateway"
+
+	// The default name of the container running the main Habitat Service.
+	serviceContainerName = "habitat-service"
+
+	// The name of the volume claimed for the persistent storage of a Pod.
+	persistentVolumeName = "persistent"
+
+	// habitatFinalizer prevents Habitats from being removed before the
+	// controller has deleted their resources.
+	habitatFinalizer = "habitat.sh/cleanup"
+
+	// specHashAnnotation holds the hash of the workload spec last generated by
+	// the controller.
+	specHashAnnotation = "habitat.sh/spec-hash"
+	// immutableSpecAnnotation holds the fields of the spec of the Habitat
+	// that can't be changed once its workload has been created.
+	immutableSpecAnnotation = "habitat.sh/immutable-spec"
+	// managedByAnnotation and operatorVersionAnnotation mark the objects
+	// created by the operator, and hold the version of the operator that last
+	// wrote them.
+	managedByAnnotation       = "habitat.sh/managed-by"
+	operatorVersionAnnotation = "habitat.sh/operator-version"
+	// deploymentAnnotationsAnnotation holds the keys of the
+	// DeploymentAnnotations last applied to the workload, so that the ones
+	// removed from the Habitat are removed from the workload too.
+	deploymentAnnotationsAnnotation = "habitat.sh/deployment-annotations"
 )
 
 var ringRegexp *regexp.Regexp = regexp.MustCompile(ringKeyRegexp)
 
+// shortNameRegexp matches the hash suffix of the names shortened by
+// shortName, which can be shorter than a DNS label once trimmed.
+var shortNameRegexp *regexp.Regexp = regexp.MustCompile(`-[0-9a-f]{8}$`)
+
+// supervisorVersionRegexp matches the versions of the Habitat supervisor.
+var supervisorVersionRegexp = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+// operatorFlags are the supervisor flags set by the operator, depending on the
+// spec.
+var operatorFlags = map[string]bool{
+	"--group":           true,
+	"--topology":        true,
+	"--peer-watch-file": true,
+	"--bind":            true,
+	"--strategy":        true,
+	"--channel":         true,
+	"--application":     true,
+	"--environment":     true,
+	"--ring":            true,
+	"--listen-gossip":   true,
+	"--listen-http":     true,
+}
+
 type HabitatController struct {
 	config Config
 	logger log.Logger
@@ -71,20 +228,119 @@ type HabitatController struct {
 	// delay, so that jobs in a crashing loop don't fill the queue.
 	queue workqueue.RateLimitingInterface
 
+	// habInformerFactory provides the Habitat informer, so that it can be
+	// shared with other controllers in the future.
+	habInformerFactory habinformers.SharedInformerFactory
+
 	habInformer    cache.SharedIndexInformer
 	deployInformer cache.SharedIndexInformer
+	stsInformer    cache.SharedIndexInformer
+	jobInformer    cache.SharedIndexInformer
+	svcInformer    cache.SharedIndexInformer
 	cmInformer     cache.SharedIndexInformer
+	podInformer    cache.SharedIndexInformer
+	pdbInformer    cache.SharedIndexInformer
+	secretInformer cache.SharedIndexInformer
+	cmRefInformer  cache.SharedIndexInformer
+	// smInformer is only set if ServiceMonitors are created.
+	smInformer cache.SharedIndexInformer
+
+	habLister hablisters.HabitatLister
 
 	// cache.InformerSynced returns true if the store has been synced at least once.
 	habInformerSynced    cache.InformerSynced
 	deployInformerSynced cache.InformerSynced
+	stsInformerSynced    cache.InformerSynced
+	jobInformerSynced    cache.InformerSynced
+	svcInformerSynced    cache.InformerSynced
 	cmInformerSynced     cache.InformerSynced
+	podInformerSynced    cache.InformerSynced
+	pdbInformerSynced    cache.InformerSynced
+	secretInformerSynced cache.InformerSynced
+	cmRefInformerSynced  cache.InformerSynced
+	smInformerSynced     cache.InformerSynced
+
+	metrics *metrics
+
+	// censusClient queries the HTTP gateways of the supervisors.
+	censusClient *http.Client
+
+	// leaders holds the leaders of the Habitats with the leader topology, by
+	// key, as last polled from their supervisors.
+	leadersMu sync.Mutex
+	leaders   map[string]string
+
+	// serviceMonitors is true if ServiceMonitors are created, which is
+	// detected when the controller starts.
+	serviceMonitors bool
+
+	// started is set to 1 once Run has been called, and synced once the
+	// caches of all the informers have been synced. They must be accessed
+	// atomically.
+	started int32
+	synced  int32
 }
 
 type Config struct {
-	HabitatClient       *rest.RESTClient
+	HabitatClient       habclientset.Interface
 	KubernetesClientset *kubernetes.Clientset
 	Scheme              *runtime.Scheme
+	// EventRecorder records Events about Habitats. It must have been created
+	// with Scheme.
+	EventRecorder record.EventRecorder
+	// MetricsAddress is the address on which Prometheus metrics are served.
+	// Optional. Metrics are not served if empty.
+	MetricsAddress string
+	// HealthAddress is the address on which the `/healthz` and `/readyz`
+	// endpoints are served by ServeHealth.
+	// Optional. The endpoints are not served if empty.
+	HealthAddress string
+	// LeaderElection is true if the controller is only run once this replica
+	// is elected leader. Until then, the replica is reported ready, as a
+	// standby.
+	LeaderElection bool
+	// WebhookAddress is the address on which the validating admission webhook
+	// and the conversion webhook are served, over HTTPS.
+	// Optional. The webhook is not served if empty.
+	WebhookAddress string
+	// WebhookCertFile and WebhookKeyFile are the paths of the certificate and
+	// key used to serve the webhook. Required if WebhookAddress is set.
+	WebhookCertFile string
+	WebhookKeyFile  string
+	// DryRun makes the controller log the objects it would write, instead of
+	// writing them.
+	DryRun bool
+	// ResyncPeriod is how often all the resources are reconciled, even if
+	// they didn't change. A shorter period corrects changes made while
+	// the controller wasn't watching sooner, at the cost of more load on the
+	// API server.
+	// Optional. Defaults to one minute.
+	ResyncPeriod time.Duration
+	// Namespace restricts the controller to the Habitats, and the resources
+	// they own, in a single namespace, so that it only needs permissions in
+	// that namespace.
+	// Optional. Defaults to all namespaces.
+	Namespace string
+	// MaxPeers is the maximum number of IPs of running Pods written to the
+	// peer file, one per line. Supervisors try each of them when joining the
+	// ring, so more peers make it more resilient to Pods being replaced.
+	// Optional. Defaults to 3.
+	MaxPeers int
+	// Workers is the number of Habitats reconciled concurrently. A Habitat
+	// is never reconciled by several workers at once.
+	// Optional. Defaults to 4.
+	Workers int
+	// ServiceMonitors makes the controller create a ServiceMonitor for each
+	// Habitat, so that the Prometheus operator scrapes the metrics of the
+	// HTTP gateways of its supervisors. It's ignored if the ServiceMonitor
+	// CRD doesn't exist when the controller starts.
+	// Optional.
+	ServiceMonitors bool
+	// Defaults are the values of the fields of the spec of Habitats that
+	// don't set them. They're applied when reconciling the Habitats, and
+	// never written to them.
+	// Optional.
+	Defaults *habv1beta1.HabitatSpec
 }
 
 func New(config Config, logger log.Logger) (*HabitatController, error) {
@@ -97,70 +353,192 @@ func New(config Config, logger log.Logger) (*HabitatController, error) {
 	if config.Scheme == nil {
 		return nil, errors.New("invalid controller config: no Schema")
 	}
+	if config.EventRecorder == nil {
+		return nil, errors.New("invalid controller config: no EventRecorder")
+	}
 	if logger == nil {
 		return nil, errors.New("invalid controller config: no logger")
 	}
+	if config.WebhookAddress != "" && (config.WebhookCertFile == "" || config.WebhookKeyFile == "") {
+		return nil, errors.New("invalid controller config: WebhookAddress requires WebhookCertFile and WebhookKeyFile")
+	}
+	if config.ResyncPeriod < 0 {
+		return nil, errors.New("invalid controller config: negative ResyncPeriod")
+	}
+	if config.ResyncPeriod == 0 {
+		config.ResyncPeriod = defaultResyncPeriod
+	}
+	if config.MaxPeers < 0 {
+		return nil, errors.New("invalid controller config: negative MaxPeers")
+	}
+	if config.MaxPeers == 0 {
+		config.MaxPeers = defaultMaxPeers
+	}
+	if config.Workers < 0 {
+		return nil, errors.New("invalid controller config: negative Workers")
+	}
+	if config.Workers == 0 {
+		config.Workers = defaultWorkers
+	}
 
 	hc := &HabitatController{
 		config: config,
 		logger: logger,
 		queue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "habitat"),
+		censusClient: &http.Client{
+			Timeout: censusTimeout,
+		},
 	}
+	hc.metrics = newMetrics(hc)
 
 	return hc, nil
 }
 
 // Run starts a Habitat resource controller.
-func (hc *HabitatController) Run(workers int, ctx context.Context) error {
+func (hc *HabitatController) Run(ctx context.Context) error {
 	// Make sure the work queue is shutdown which will trigger workers to end.
 	defer hc.queue.ShutDown()
 
+	atomic.StoreInt32(&hc.started, 1)
+
+	level.Info(hc.logger).Log("msg", "Starting controller", "version", version.Version, "commit", version.Commit, "build_date", version.BuildDate)
 	level.Info(hc.logger).Log("msg", "Watching Habitat objects")
 
+	hc.serviceMonitors = hc.detectServiceMonitors()
+
 	hc.cacheHabitats()
 	hc.cacheDeployments()
+	hc.cacheStatefulSets()
+	hc.cacheJobs()
+	hc.cacheServices()
 	hc.cacheConfigMaps()
-	hc.watchPods(ctx)
+	hc.cachePods()
+	hc.cachePodDisruptionBudgets()
+	hc.cacheSecrets()
+	hc.cacheConfigMapRefs()
+	if hc.serviceMonitors {
+		hc.cacheServiceMonitors()
+	}
 
-	go hc.habInformer.Run(ctx.Done())
+	hc.habInformerFactory.Start(ctx.Done())
 	go hc.deployInformer.Run(ctx.Done())
+	go hc.stsInformer.Run(ctx.Done())
+	go hc.jobInformer.Run(ctx.Done())
+	go hc.svcInformer.Run(ctx.Done())
 	go hc.cmInformer.Run(ctx.Done())
+	go hc.podInformer.Run(ctx.Done())
+	go hc.pdbInformer.Run(ctx.Done())
+	go hc.secretInformer.Run(ctx.Done())
+	go hc.cmRefInformer.Run(ctx.Done())
+	if hc.smInformer != nil {
+		go hc.smInformer.Run(ctx.Done())
+	}
 
-	// Wait for caches to be synced before starting workers.
-	if !cache.WaitForCacheSync(ctx.Done(), hc.habInformerSynced, hc.deployInformerSynced, hc.cmInformerSynced) {
-		return nil
+	if hc.config.MetricsAddress != "" {
+		go hc.serve(ctx, "metrics", hc.config.MetricsAddress, hc.metricsHandler())
+	}
+	if hc.config.WebhookAddress != "" {
+		go hc.serveTLS(ctx, "webhook", hc.config.WebhookAddress, hc.webhookHandler(), hc.config.WebhookCertFile, hc.config.WebhookKeyFile)
+	}
+
+	// Wait for caches to be synced before starting workers, so that they don't
+	// act on a partial view of the cluster.
+	level.Info(hc.logger).Log("msg", "Waiting for caches to sync")
+
+	syncCtx, cancel := context.WithTimeout(ctx, cacheSyncTimeout)
+	defer cancel()
+
+	synced := []cache.InformerSynced{hc.habInformerSynced, hc.deployInformerSynced, hc.stsInformerSynced, hc.jobInformerSynced, hc.svcInformerSynced, hc.cmInformerSynced, hc.podInformerSynced, hc.pdbInformerSynced, hc.secretInformerSynced, hc.cmRefInformerSynced}
+	if hc.smInformerSynced != nil {
+		synced = append(synced, hc.smInformerSynced)
+	}
+
+	if !cache.WaitForCacheSync(syncCtx.Done(), synced...) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("caches not synced within %s", cacheSyncTimeout)
 	}
-	level.Debug(hc.logger).Log("msg", "Caches synced")
+	level.Info(hc.logger).Log("msg", "Caches synced")
+	atomic.StoreInt32(&hc.synced, 1)
+
+	if err := hc.sweep(ctx); err != nil {
+		// The sweep is retried on the next start, don't prevent the operator
+		// from running.
+		level.Error(hc.logger).Log("msg", "Could not sweep Habitat resources", "err", err)
+	}
+
+	// The API calls of the workers are not bound to ctx, so that the
+	// reconciliations in flight when it's canceled aren't interrupted halfway.
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
 
 	// Start the synchronous queue consumers. If a worker exits because of a
 	// failed job, it will be restarted after a delay of 1 second.
-	for i := 0; i < workers; i++ {
+	// The queue doesn't hand out a key again until it's marked as done, so
+	// that a Habitat is only ever reconciled by one worker at a time.
+	var wg sync.WaitGroup
+	for i := 0; i < hc.config.Workers; i++ {
 		level.Debug(hc.logger).Log("msg", "Starting worker", "id", i)
-		go wait.Until(hc.worker, time.Second, ctx.Done())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(func() { hc.worker(workCtx) }, time.Second, ctx.Done())
+		}()
 	}
 
+	// The supervisors are polled for their leader outside of the workers, so
+	// that unreachable ones don't hold up reconciliations.
+	go wait.Until(func() { hc.pollLeaders(ctx) }, leaderPollInterval, ctx.Done())
+
 	// This channel is closed when the context is canceled or times out.
 	<-ctx.Done()
 
+	hc.drain(&wg, cancelWork)
+
 	// Err() contains the error, if any.
 	return ctx.Err()
 }
 
+// drain stops the queue and waits for the workers to finish the
+// reconciliations in flight. If they don't finish within shutdownTimeout,
+// cancel is called to interrupt their API calls.
+func (hc *HabitatController) drain(wg *sync.WaitGroup, cancel context.CancelFunc) {
+	level.Info(hc.logger).Log("msg", "Shutting down, waiting for reconciliations in flight", "timeout", shutdownTimeout)
+
+	// Items added from now on are ignored, and the workers exit once their
+	// current item is done.
+	hc.queue.ShutDown()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		level.Info(hc.logger).Log("msg", "Shut down cleanly")
+	case <-time.After(shutdownTimeout):
+		level.Warn(hc.logger).Log("msg", "Reconciliations still in flight after timeout, interrupting them", "timeout", shutdownTimeout)
+		cancel()
+		<-done
+	}
+}
+
 func (hc *HabitatController) cacheHabitats() {
-	source := cache.NewListWatchFromClient(
+	hc.habInformerFactory = habinformers.NewFilteredSharedInformerFactory(
 		hc.config.HabitatClient,
-		habv1beta1.HabitatResourcePlural,
-		apiv1.NamespaceAll,
-		fields.Everything())
+		hc.config.ResyncPeriod,
+		hc.config.Namespace,
+		nil)
 
-	hc.habInformer = cache.NewSharedIndexInformer(
-		source,
+	habitats := hc.habInformerFactory.Habitat().V1beta1().Habitats()
+	hc.habInformer = habitats.Informer()
+	hc.habLister = habitats.Lister()
 
-		// The object type.
-		&habv1beta1.Habitat{},
-		resyncPeriod,
-		cache.Indexers{},
-	)
+	hc.habInformer.AddIndexers(cache.Indexers{configMapRefIndex: habitatConfigMapRefIndexFunc})
 
 	hc.habInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    hc.handleHabAdd,
@@ -173,15 +551,15 @@ func (hc *HabitatController) cacheHabitats() {
 
 func (hc *HabitatController) cacheDeployments() {
 	source := newListWatchFromClientWithLabels(
-		hc.config.KubernetesClientset.AppsV1beta1().RESTClient(),
+		hc.config.KubernetesClientset.AppsV1().RESTClient(),
 		"deployments",
-		apiv1.NamespaceAll,
+		hc.config.Namespace,
 		labelListOptions())
 
 	hc.deployInformer = cache.NewSharedIndexInformer(
 		source,
-		&appsv1beta1.Deployment{},
-		resyncPeriod,
+		&appsv1.Deployment{},
+		hc.config.ResyncPeriod,
 		cache.Indexers{},
 	)
 
@@ -198,13 +576,13 @@ func (hc *HabitatController) cacheConfigMaps() {
 	source := newListWatchFromClientWithLabels(
 		hc.config.KubernetesClientset.CoreV1().RESTClient(),
 		"configmaps",
-		apiv1.NamespaceAll,
+		hc.config.Namespace,
 		labelListOptions())
 
 	hc.cmInformer = cache.NewSharedIndexInformer(
 		source,
 		&apiv1.ConfigMap{},
-		resyncPeriod,
+		hc.config.ResyncPeriod,
 		cache.Indexers{},
 	)
 
@@ -217,27 +595,72 @@ func (hc *HabitatController) cacheConfigMaps() {
 	hc.cmInformerSynced = hc.cmInformer.HasSynced
 }
 
-func (hc *HabitatController) watchPods(ctx context.Context) {
+// cacheSecrets caches the Secrets read on each poll of the supervisors, which
+// are created by users and thus not labeled.
+func (hc *HabitatController) cacheSecrets() {
+	source := newListWatchFromClientWithLabels(
+		hc.config.KubernetesClientset.CoreV1().RESTClient(),
+		"secrets",
+		hc.config.Namespace,
+		metav1.ListOptions{})
+
+	hc.secretInformer = cache.NewSharedIndexInformer(
+		source,
+		&apiv1.Secret{},
+		hc.config.ResyncPeriod,
+		cache.Indexers{},
+	)
+
+	hc.secretInformerSynced = hc.secretInformer.HasSynced
+}
+
+// cacheConfigMapRefs watches the ConfigMaps created by users, so that the
+// Habitats referencing them through ConfigMapRef are reconciled when they
+// change.
+func (hc *HabitatController) cacheConfigMapRefs() {
+	source := newListWatchFromClientWithLabels(
+		hc.config.KubernetesClientset.CoreV1().RESTClient(),
+		"configmaps",
+		hc.config.Namespace,
+		metav1.ListOptions{})
+
+	hc.cmRefInformer = cache.NewSharedIndexInformer(
+		source,
+		&apiv1.ConfigMap{},
+		hc.config.ResyncPeriod,
+		cache.Indexers{},
+	)
+
+	hc.cmRefInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    hc.enqueueConfigMapReferrers,
+		UpdateFunc: hc.handleConfigMapRefUpdate,
+		DeleteFunc: hc.enqueueConfigMapReferrers,
+	})
+
+	hc.cmRefInformerSynced = hc.cmRefInformer.HasSynced
+}
+
+func (hc *HabitatController) cachePods() {
 	source := newListWatchFromClientWithLabels(
 		hc.config.KubernetesClientset.CoreV1().RESTClient(),
 		"pods",
-		apiv1.NamespaceAll,
+		hc.config.Namespace,
 		labelListOptions())
 
-	c := cache.NewSharedIndexInformer(
+	hc.podInformer = cache.NewSharedIndexInformer(
 		source,
 		&apiv1.Pod{},
-		resyncPeriod,
-		cache.Indexers{},
+		hc.config.ResyncPeriod,
+		cache.Indexers{ringIndex: podRingIndexFunc},
 	)
 
-	c.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	hc.podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    hc.handlePodAdd,
 		UpdateFunc: hc.handlePodUpdate,
 		DeleteFunc: hc.handlePodDelete,
 	})
 
-	go c.Run(ctx.Done())
+	hc.podInformerSynced = hc.podInformer.HasSynced
 }
 
 func (hc *HabitatController) handleHabAdd(obj interface{}) {
@@ -248,6 +671,10 @@ func (hc *HabitatController) handleHabAdd(obj interface{}) {
 	}
 
 	hc.enqueue(h)
+
+	// Habitats binding to this one might have failed validation while it didn't
+	// exist yet.
+	hc.enqueueBinders(h)
 }
 
 func (hc *HabitatController) handleHabUpdate(oldObj, newObj interface{}) {
@@ -269,7 +696,7 @@ func (hc *HabitatController) handleHabUpdate(oldObj, newObj interface{}) {
 }
 
 func (hc *HabitatController) handleHabDelete(obj interface{}) {
-	h, ok := obj.(*habv1beta1.Habitat)
+	h, ok := unwrapTombstone(obj).(*habv1beta1.Habitat)
 	if !ok {
 		level.Error(hc.logger).Log("msg", "Failed to type assert Habitat", "obj", obj)
 		return
@@ -279,7 +706,7 @@ func (hc *HabitatController) handleHabDelete(obj interface{}) {
 }
 
 func (hc *HabitatController) handleDeployAdd(obj interface{}) {
-	d, ok := obj.(*appsv1beta1.Deployment)
+	d, ok := obj.(*appsv1.Deployment)
 	if !ok {
 		level.Error(hc.logger).Log("msg", "Failed to type assert Deployment", "obj", obj)
 		return
@@ -295,7 +722,7 @@ func (hc *HabitatController) handleDeployAdd(obj interface{}) {
 }
 
 func (hc *HabitatController) handleDeployUpdate(oldObj, newObj interface{}) {
-	d, ok := newObj.(*appsv1beta1.Deployment)
+	d, ok := newObj.(*appsv1.Deployment)
 	if !ok {
 		level.Error(hc.logger).Log("msg", "Failed to type assert deployment", "obj", newObj)
 		return
@@ -311,7 +738,7 @@ func (hc *HabitatController) handleDeployUpdate(oldObj, newObj interface{}) {
 }
 
 func (hc *HabitatController) handleDeployDelete(obj interface{}) {
-	d, ok := obj.(*appsv1beta1.Deployment)
+	d, ok := unwrapTombstone(obj).(*appsv1.Deployment)
 	if !ok {
 		level.Error(hc.logger).Log("msg", "Failed to type assert deployment", "obj", obj)
 		return
@@ -346,6 +773,61 @@ func (hc *HabitatController) enqueueCM(obj interface{}) {
 	})
 }
 
+func (hc *HabitatController) handleConfigMapRefUpdate(oldObj, newObj interface{}) {
+	oldCM, ok1 := oldObj.(*apiv1.ConfigMap)
+	newCM, ok2 := newObj.(*apiv1.ConfigMap)
+	// Periodic resyncs send updates for unchanged ConfigMaps.
+	if ok1 && ok2 && oldCM.ResourceVersion == newCM.ResourceVersion {
+		return
+	}
+
+	hc.enqueueConfigMapReferrers(newObj)
+}
+
+// enqueueConfigMapReferrers enqueues the Habitats referencing the ConfigMap
+// through ConfigMapRef.
+func (hc *HabitatController) enqueueConfigMapReferrers(obj interface{}) {
+	obj = unwrapTombstone(obj)
+
+	cm, ok := obj.(*apiv1.ConfigMap)
+	if !ok {
+		level.Error(hc.logger).Log("msg", "Failed to type assert ConfigMap", "obj", obj)
+		return
+	}
+
+	objs, err := hc.habInformer.GetIndexer().ByIndex(configMapRefIndex, cm.Namespace+"/"+cm.Name)
+	if err != nil {
+		level.Error(hc.logger).Log("msg", "Failed to look up the Habitats referencing ConfigMap", "name", cm.Name, "err", err)
+		return
+	}
+
+	for _, obj := range objs {
+		if h, ok := obj.(*habv1beta1.Habitat); ok {
+			hc.enqueue(h)
+		}
+	}
+}
+
+// enqueueBinders enqueues all the Habitats in the namespace of h that bind to it.
+func (hc *HabitatController) enqueueBinders(h *habv1beta1.Habitat) {
+	cache.ListAll(hc.habInformer.GetStore(), labels.Everything(), func(obj interface{}) {
+		b, ok := obj.(*habv1beta1.Habitat)
+		if !ok {
+			level.Error(hc.logger).Log("msg", "Failed to type assert Habitat", "obj", obj)
+			return
+		}
+		if b.Namespace != h.Namespace {
+			return
+		}
+		for _, bind := range allBinds(b) {
+			if bindTargets(bind, h) {
+				hc.enqueue(b)
+				return
+			}
+		}
+	})
+}
+
 func (hc *HabitatController) handleCMAdd(obj interface{}) {
 	hc.enqueueCM(obj)
 }
@@ -354,7 +836,16 @@ func (hc *HabitatController) handleCMUpdate(oldObj, newObj interface{}) {
 	hc.enqueueCM(newObj)
 }
 
+// handleCMDelete enqueues the Habitats of the namespace of the deleted
+// ConfigMap. If it's the peer IP ConfigMap, reconciling them recreates it, so
+// that the Pods don't lose their peer file.
 func (hc *HabitatController) handleCMDelete(obj interface{}) {
+	obj = unwrapTombstone(obj)
+
+	if cm, ok := obj.(*apiv1.ConfigMap); ok && isPeerConfigMapName(cm.Name) {
+		level.Info(hc.logger).Log("msg", "peer IP ConfigMap deleted, recreating it", "namespace", cm.Namespace)
+	}
+
 	hc.enqueueCM(obj)
 }
 
@@ -408,7 +899,7 @@ func (hc *HabitatController) handlePodUpdate(oldObj, newObj interface{}) {
 }
 
 func (hc *HabitatController) handlePodDelete(obj interface{}) {
-	pod, ok := obj.(*apiv1.Pod)
+	pod, ok := unwrapTombstone(obj).(*apiv1.Pod)
 	if !ok {
 		level.Error(hc.logger).Log("msg", "Failed to type assert pod", "obj", obj)
 		return
@@ -434,39 +925,99 @@ func (hc *HabitatController) handlePodDelete(obj interface{}) {
 	hc.enqueue(h)
 }
 
-func (hc *HabitatController) getRunningPods(namespace string) ([]apiv1.Pod, error) {
-	fs := fields.SelectorFromSet(fields.Set{
-		"status.phase": "Running",
-	})
-	ls := fields.SelectorFromSet(fields.Set(map[string]string{
-		habv1beta1.HabitatLabel: "true",
-	}))
+// getRunningPods returns the Pods of the ring of the Habitat that can act as
+// peers, according to the cache, the preferred peers first.
+func (hc *HabitatController) getRunningPods(h *habv1beta1.Habitat) ([]apiv1.Pod, error) {
+	objs, err := hc.podInformer.GetIndexer().ByIndex(ringIndex, ringIndexKey(h.Namespace, h.Spec.Ring))
+	if err != nil {
+		return nil, err
+	}
+
+	// Only Pods that are running, have already been assigned an IP, and are
+	// not being terminated, can act as peers.
+	var peers []apiv1.Pod
+	for _, obj := range objs {
+		p, ok := obj.(*apiv1.Pod)
+		if !ok {
+			continue
+		}
 
-	running := metav1.ListOptions{
-		FieldSelector: fs.String(),
-		LabelSelector: ls.String(),
+		if p.Status.Phase == apiv1.PodRunning && p.Status.PodIP != "" && p.DeletionTimestamp == nil {
+			peers = append(peers, *p)
+		}
 	}
 
-	pods, err := hc.config.KubernetesClientset.CoreV1().Pods(namespace).List(running)
-	if err != nil {
-		return nil, err
+	// The index is unordered, sort the Pods so that the same peers are chosen
+	// on each reconciliation.
+	sortPeers(peers, h.Spec.PeerSelection)
+
+	return peers, nil
+}
+
+// choosePeerIPs returns the content of the peer file: the addresses of at
+// most max running Pods, one per line. The current peers are kept as long as
+// one of the running Pods still has their address, so that the ring isn't
+// needlessly disturbed; the remaining lines are filled with the addresses of
+// the other running Pods, in order. All the running Pods are peers if there
+// are fewer than max.
+func choosePeerIPs(current string, running []apiv1.Pod, max int) string {
+	isRunning := make(map[string]bool, len(running))
+	for _, p := range running {
+		isRunning[peerAddress(p)] = true
+	}
+
+	var peers []string
+	chosen := map[string]bool{}
+	for _, ip := range strings.Split(current, "\n") {
+		if len(peers) < max && isRunning[ip] && !chosen[ip] {
+			peers = append(peers, ip)
+			chosen[ip] = true
+		}
+	}
+
+	for _, p := range running {
+		if ip := peerAddress(p); len(peers) < max && !chosen[ip] {
+			peers = append(peers, ip)
+			chosen[ip] = true
+		}
+	}
+
+	return strings.Join(peers, "\n")
+}
+
+// peerAddress returns the address of the supervisor of the Pod in the peer
+// file: its IP, followed by its gossip port if it's not the default one.
+func peerAddress(p apiv1.Pod) string {
+	if port, ok := p.Annotations[gossipPortAnnotation]; ok {
+		return net.JoinHostPort(p.Status.PodIP, port)
 	}
 
-	return pods.Items, nil
+	return p.Status.PodIP
 }
 
-func (hc *HabitatController) writeLeaderIP(cm *apiv1.ConfigMap, ip string) error {
-	cm.Data[peerFile] = ip
+func (hc *HabitatController) writePeerIPs(ctx context.Context, cm *apiv1.ConfigMap, peers string) error {
+	// The ConfigMap comes from the cache, which must not be modified.
+	cm = cm.DeepCopy()
+	cm.Data[peerFile] = peers
+	// ConfigMaps created by older versions of the operator lack the label and
+	// the annotations.
+	cm.Labels[habv1beta1.CreatedByLabel] = habv1beta1.CreatedBy
+	if cm.Annotations == nil {
+		cm.Annotations = make(map[string]string, 2)
+	}
+	for k, v := range operatorAnnotations() {
+		cm.Annotations[k] = v
+	}
 
-	if _, err := hc.config.KubernetesClientset.CoreV1().ConfigMaps(cm.Namespace).Update(cm); err != nil {
+	if _, err := hc.updateConfigMap(ctx, cm); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (hc *HabitatController) handleConfigMap(h *habv1beta1.Habitat) error {
-	runningPods, err := hc.getRunningPods(h.Namespace)
+func (hc *HabitatController) handleConfigMap(ctx context.Context, h *habv1beta1.Habitat) error {
+	runningPods, err := hc.getRunningPods(h)
 	if err != nil {
 		return err
 	}
@@ -475,7 +1026,11 @@ func (hc *HabitatController) handleConfigMap(h *habv1beta1.Habitat) error {
 		// No running Pods, create an empty ConfigMap.
 		newCM := newConfigMap("", h)
 
-		cm, err := hc.config.KubernetesClientset.CoreV1().ConfigMaps(h.Namespace).Create(newCM)
+		var cm *apiv1.ConfigMap
+		err := hc.retryCreate(ctx, h, "ConfigMap", newCM.Name, func() (err error) {
+			cm, err = hc.createConfigMap(ctx, newCM)
+			return err
+		})
 		if err != nil {
 			// Was the error due to the ConfigMap already existing?
 			if !apierrors.IsAlreadyExists(err) {
@@ -489,7 +1044,7 @@ func (hc *HabitatController) handleConfigMap(h *habv1beta1.Habitat) error {
 				return err
 			}
 
-			if err := hc.writeLeaderIP(cm, ""); err != nil {
+			if err := hc.writePeerIPs(ctx, cm, ""); err != nil {
 				return err
 			}
 
@@ -503,250 +1058,1149 @@ func (hc *HabitatController) handleConfigMap(h *habv1beta1.Habitat) error {
 		return nil
 	}
 
-	// There are running Pods, add the IP of one of them to the ConfigMap.
-	leaderIP := runningPods[0].Status.PodIP
+	// There are running Pods, add the IPs of some of them to the ConfigMap.
+	peers := choosePeerIPs("", runningPods, hc.config.MaxPeers)
 
-	newCM := newConfigMap(leaderIP, h)
+	newCM := newConfigMap(peers, h)
 
-	cm, err := hc.config.KubernetesClientset.CoreV1().ConfigMaps(h.Namespace).Create(newCM)
+	var cm *apiv1.ConfigMap
+	err = hc.retryCreate(ctx, h, "ConfigMap", newCM.Name, func() (err error) {
+		cm, err = hc.createConfigMap(ctx, newCM)
+		return err
+	})
 	if err != nil {
 		// Was the error due to the ConfigMap already existing?
 		if !apierrors.IsAlreadyExists(err) {
 			return err
 		}
 
-		// The ConfigMap already exists. Retrieve it and find out if the the leader
-		// is still running.
+		// The ConfigMap already exists. Retrieve it and find out if the peers
+		// are still running.
 		cm, err := hc.findConfigMapInCache(newCM)
 		if err != nil {
 			return err
 		}
 
-		curLeader := cm.Data[peerFile]
+		curPeers := cm.Data[peerFile]
 
-		for _, p := range runningPods {
-			if p.Status.PodIP == curLeader {
-				// The leader is still up, nothing to do.
-				level.Debug(hc.logger).Log("msg", "Leader still running", "ip", curLeader)
+		peers = choosePeerIPs(curPeers, runningPods, hc.config.MaxPeers)
+		if peers == curPeers {
+			// The peers are still up, nothing to do.
+			level.Debug(hc.logger).Log("msg", "Peers still running", "ips", strings.Replace(curPeers, "\n", ",", -1))
 
-				return nil
-			}
+			return nil
 		}
 
-		// The leader is not in the list of running Pods, so the ConfigMap must be updated.
-		if err := hc.writeLeaderIP(cm, leaderIP); err != nil {
+		// A peer is gone or has changed IP, or more Pods can be peers, so the
+		// ConfigMap must be updated.
+		if err := hc.writePeerIPs(ctx, cm, peers); err != nil {
 			return err
 		}
 
-		level.Info(hc.logger).Log("msg", "updated peer IP in ConfigMap", "name", cm.Name, "ip", leaderIP)
+		level.Info(hc.logger).Log("msg", "updated peer IPs in ConfigMap", "name", cm.Name, "ips", strings.Replace(peers, "\n", ",", -1))
 	} else {
-		level.Info(hc.logger).Log("msg", "created peer IP ConfigMap", "name", cm.Name, "ip", leaderIP)
+		level.Info(hc.logger).Log("msg", "created peer IP ConfigMap", "name", cm.Name, "ips", strings.Replace(peers, "\n", ",", -1))
 	}
 
 	return nil
 }
 
-func (hc *HabitatController) handleHabitatDeletion(key string) error {
-	// Delete deployment.
-	deploymentNS, deploymentName, err := cache.SplitMetaNamespaceKey(key)
+// handleDeployment creates or updates the Deployment running the Habitat, and
+// returns a reference to it.
+func (hc *HabitatController) handleDeployment(ctx context.Context, h *habv1beta1.Habitat) (*metav1.OwnerReference, error) {
+	deployment, err := hc.newDeployment(ctx, h)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	deploymentsClient := hc.config.KubernetesClientset.AppsV1beta1().Deployments(deploymentNS)
+	d, err := hc.findDeploymentInCache(deployment)
+	if err != nil {
+		if _, ok := err.(keyNotFoundError); !ok {
+			return nil, err
+		}
 
-	// With this policy, dependent resources will be deleted, but we don't wait
-	// for that to happen.
-	deletePolicy := metav1.DeletePropagationBackground
-	deleteOptions := &metav1.DeleteOptions{
-		PropagationPolicy: &deletePolicy,
-	}
+		// Create Deployment, if it doesn't already exist.
+		err = hc.retryCreate(ctx, h, "Deployment", deployment.Name, func() (err error) {
+			d, err = hc.createDeployment(ctx, deployment)
+			return err
+		})
+		if err != nil {
+			// Was the error due to the Deployment already existing?
+			if !apierrors.IsAlreadyExists(err) {
+				return nil, err
+			}
 
-	if err := deploymentsClient.Delete(deploymentName, deleteOptions); err != nil {
-		level.Error(hc.logger).Log("msg", err)
-		return err
-	}
+			// If yes, either the cache is not in sync yet, or the Deployment
+			// was not created by the operator.
+			existing, err := hc.getDeployment(ctx, deployment.Namespace, deployment.Name)
+			if err != nil {
+				return nil, err
+			}
 
-	level.Info(hc.logger).Log("msg", "deleted deployment", "name", deploymentName)
+			if !isOwnedByHabitat(existing, h) {
+				return hc.adoptDeployment(ctx, h, existing, deployment)
+			}
 
-	return nil
+			// It's ours, so update it.
+			deployment.Spec.Selector = existing.Spec.Selector
+			deployment.ResourceVersion = existing.ResourceVersion
+
+			if d, err = hc.updateDeployment(ctx, deployment); err != nil {
+				return nil, err
+			}
+
+			level.Debug(hc.logger).Log("msg", "deployment already existed", "name", deployment.Name)
+		} else {
+			level.Info(hc.logger).Log("msg", "created deployment", "name", deployment.Name)
+			hc.config.EventRecorder.Eventf(h, apiv1.EventTypeNormal, reasonCreated, "Created deployment %s", deployment.Name)
+		}
+	} else if !isOwnedByHabitat(d, h) {
+		return hc.adoptDeployment(ctx, h, d, deployment)
+	} else if deploymentNeedsUpdate(d, deployment) {
+		// The selector is immutable, and was defaulted to the Pod labels for
+		// Deployments created through apps/v1beta1.
+		deployment.Spec.Selector = d.Spec.Selector
+
+		if d, err = hc.updateDeployment(ctx, deployment); err != nil {
+			return nil, err
+		}
+
+		level.Info(hc.logger).Log("msg", "updated deployment", "name", deployment.Name)
+		hc.config.EventRecorder.Eventf(h, apiv1.EventTypeNormal, reasonUpdated, "Updated deployment %s", deployment.Name)
+	} else {
+		level.Debug(hc.logger).Log("msg", "deployment up to date", "name", deployment.Name)
+	}
+
+	return newOwnerReference(d, appsv1.SchemeGroupVersion.WithKind("Deployment")), nil
 }
 
-func (hc *HabitatController) newDeployment(h *habv1beta1.Habitat) (*appsv1beta1.Deployment, error) {
-	// This value needs to be passed as a *int32, so we convert it, assign it to a
-	// variable and afterwards pass a pointer to it.
-	count := int32(h.Spec.Count)
+// adoptDeployment takes over an existing Deployment that was not created by
+// the operator for the Habitat, if the Habitat opted in to it, by replacing it
+// with the desired one. Otherwise, the name conflict is returned.
+func (hc *HabitatController) adoptDeployment(ctx context.Context, h *habv1beta1.Habitat, existing, desired *appsv1.Deployment) (*metav1.OwnerReference, error) {
+	conflict := nameConflictError{kind: "Deployment", name: desired.Name}
 
-	// Set the service arguments we send to Habitat.
-	var habArgs []string
-	if h.Spec.Service.Group != "" {
-		// When a service is started without explicitly naming the group,
-		// it's assigned to the default group.
-		habArgs = append(habArgs,
-			"--group", h.Spec.Service.Group)
+	if !h.Spec.AdoptExisting {
+		return nil, conflict
 	}
 
-	// As we want to label our pods with the
-	// topology type we set standalone as the default one.
-	// We do not need to pass this to habitat, as if no topology
-	// is set, habitat by default sets standalone topology.
-	topology := habv1beta1.TopologyStandalone
+	if owner := metav1.GetControllerOf(existing); owner != nil {
+		level.Error(hc.logger).Log("msg", "Deployment can't be adopted, it's controlled by another resource", "name", existing.Name, "owner", owner.Name)
+		return nil, conflict
+	}
 
-	if h.Spec.Service.Topology == habv1beta1.TopologyLeader {
-		topology = habv1beta1.TopologyLeader
+	// The selector is immutable, so the Pods of the Habitat must match the
+	// existing one.
+	selector, err := metav1.LabelSelectorAsSelector(existing.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	if !selector.Matches(labels.Set(desired.Spec.Template.Labels)) {
+		level.Error(hc.logger).Log("msg", "Deployment can't be adopted, its selector doesn't match the Pods of the Habitat", "name", existing.Name, "selector", selector)
+		return nil, conflict
 	}
 
-	path := fmt.Sprintf("%s/%s", configMapDir, peerFilename)
+	desired.Spec.Selector = existing.Spec.Selector
+	desired.ResourceVersion = existing.ResourceVersion
 
-	habArgs = append(habArgs,
-		"--topology", topology.String(),
-		"--peer-watch-file", path,
-	)
+	d, err := hc.updateDeployment(ctx, desired)
+	if err != nil {
+		return nil, err
+	}
 
-	// Runtime binding.
-	// One Service connects to another forming a producer/consumer relationship.
-	for _, bind := range h.Spec.Service.Bind {
-		// Pass --bind flag.
-		bindArg := fmt.Sprintf("%s:%s.%s", bind.Name, bind.Service, bind.Group)
-		habArgs = append(habArgs,
-			"--bind", bindArg)
+	level.Info(hc.logger).Log("msg", "adopted deployment", "name", d.Name)
+	hc.config.EventRecorder.Eventf(h, apiv1.EventTypeNormal, reasonAdopted, "Adopted deployment %s", d.Name)
+
+	return newOwnerReference(d, appsv1.SchemeGroupVersion.WithKind("Deployment")), nil
+}
+
+func (hc *HabitatController) handleHabitatDeletion(ctx context.Context, key string) error {
+	// The Habitat is gone, so we don't know which kind of workload was running
+	// it. Delete all the kinds, ignoring the ones that don't exist.
+	// Habitats without the finalizer were created by older versions of the
+	// operator, which didn't support DeploymentName, so their workloads have
+	// the default name.
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
 	}
 
-	base := &appsv1beta1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: h.Name,
-		},
-		Spec: appsv1beta1.DeploymentSpec{
-			Replicas: &count,
-			Template: apiv1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						habv1beta1.HabitatLabel:     "true",
-						habv1beta1.HabitatNameLabel: h.Name,
-						habv1beta1.TopologyLabel:    topology.String(),
-					},
-				},
-				Spec: apiv1.PodSpec{
-					Containers: []apiv1.Container{
-						{
-							Name:  "habitat-service",
-							Image: h.Spec.Image,
-							Args:  habArgs,
-							VolumeMounts: []apiv1.VolumeMount{
-								{
-									Name:      "config",
-									MountPath: configMapDir,
-									ReadOnly:  true,
-								},
-							},
-						},
-					},
-					// Define the volume for the ConfigMap.
-					Volumes: []apiv1.Volume{
-						{
-							Name: "config",
-							VolumeSource: apiv1.VolumeSource{
-								ConfigMap: &apiv1.ConfigMapVolumeSource{
-									LocalObjectReference: apiv1.LocalObjectReference{
-										Name: configMapName,
-									},
-									Items: []apiv1.KeyToPath{
-										{
-											Key:  peerFile,
-											Path: peerFilename,
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
+	deleted, err := hc.deleteHabitatResources(ctx, ns, shortName(name))
+	if err != nil {
+		return err
 	}
 
-	// If we have a secret name present we should mount that secret.
-	if h.Spec.Service.ConfigSecretName != "" {
-		// Let's make sure our secret is there before mounting it.
-		secret, err := hc.config.KubernetesClientset.CoreV1().Secrets(h.Namespace).Get(h.Spec.Service.ConfigSecretName, metav1.GetOptions{})
-		if err != nil {
-			return nil, err
-		}
+	// Habitats with the finalizer have already been cleaned up.
+	if !deleted {
+		return nil
+	}
 
-		secretVolume := &apiv1.Volume{
-			Name: initialConfigFilename,
-			VolumeSource: apiv1.VolumeSource{
-				Secret: &apiv1.SecretVolumeSource{
-					SecretName: secret.Name,
-					Items: []apiv1.KeyToPath{
-						{
-							Key:  userTOMLFile,
-							Path: userTOMLFile,
-						},
-					},
-				},
-			},
-		}
+	// The Habitat is gone from the cache, so record the Event against a
+	// reference to it.
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+		},
+	}
+	hc.config.EventRecorder.Event(h, apiv1.EventTypeNormal, reasonDeleted, "Deleted the resources of the Habitat")
 
-		secretVolumeMount := &apiv1.VolumeMount{
-			Name: initialConfigFilename,
-			// The Habitat supervisor creates a directory for each service under /hab/svc/<servicename>.
-			// We need to place the user.toml file in there in order for it to be detected.
-			MountPath: fmt.Sprintf("/hab/user/%s/config", h.Spec.Service.Name),
-			ReadOnly:  false,
-		}
+	return nil
+}
 
-		base.Spec.Template.Spec.Containers[0].VolumeMounts = append(base.Spec.Template.Spec.Containers[0].VolumeMounts, *secretVolumeMount)
-		base.Spec.Template.Spec.Volumes = append(base.Spec.Template.Spec.Volumes, *secretVolume)
+// finalizeHabitat deletes the resources of a Habitat that is being deleted,
+// and then removes the finalizer, allowing the API server to remove it.
+func (hc *HabitatController) finalizeHabitat(ctx context.Context, h *habv1beta1.Habitat) error {
+	if !hasFinalizer(h) {
+		return nil
 	}
 
+	if _, err := hc.deleteHabitatResources(ctx, h.Namespace, workloadName(h)); err != nil {
+		return err
+	}
+
+	if err := hc.deleteUnusedPeerConfigMap(ctx, h); err != nil {
+		return err
+	}
+
+	hc.config.EventRecorder.Event(h, apiv1.EventTypeNormal, reasonDeleted, "Deleted the resources of the Habitat")
+
+	hCopy := h.DeepCopy()
+	hCopy.Finalizers = nil
+	for _, f := range h.Finalizers {
+		if f != habitatFinalizer {
+			hCopy.Finalizers = append(hCopy.Finalizers, f)
+		}
+	}
+
+	if hc.dryRun("update", hCopy) {
+		return nil
+	}
+
+	habitats, cancel := hc.habitatClient(ctx)
+	defer cancel()
+
+	_, err := habitats.Habitats(h.Namespace).Update(hCopy)
+	if err != nil {
+		return err
+	}
+
+	level.Debug(hc.logger).Log("msg", "removed finalizer", "name", h.Name)
+
+	return nil
+}
+
+// ensureFinalizer adds the finalizer to the Habitat, so that the API server
+// keeps it around until its resources have been deleted, even if the operator
+// isn't running at the time of the deletion.
+// It returns the updated Habitat.
+func (hc *HabitatController) ensureFinalizer(ctx context.Context, h *habv1beta1.Habitat) (*habv1beta1.Habitat, error) {
+	if hasFinalizer(h) {
+		return h, nil
+	}
+
+	hCopy := h.DeepCopy()
+	hCopy.Finalizers = append(hCopy.Finalizers, habitatFinalizer)
+
+	if hc.dryRun("update", hCopy) {
+		return h, nil
+	}
+
+	habitats, cancel := hc.habitatClient(ctx)
+	defer cancel()
+
+	result, err := habitats.Habitats(h.Namespace).Update(hCopy)
+	if err != nil {
+		return nil, err
+	}
+
+	level.Debug(hc.logger).Log("msg", "added finalizer", "name", h.Name)
+
+	return result, nil
+}
+
+// deleteHabitatResources deletes the workloads with the given name that may be
+// running a Habitat. It returns whether any of them existed.
+func (hc *HabitatController) deleteHabitatResources(ctx context.Context, ns, name string) (bool, error) {
+	// With this policy, dependent resources will be deleted, but we don't wait
+	// for that to happen.
+	deletePolicy := metav1.DeletePropagationBackground
+	deleteOptions := &metav1.DeleteOptions{
+		PropagationPolicy: &deletePolicy,
+	}
+
+	if hc.config.DryRun {
+		level.Info(hc.logger).Log("msg", "dry run", "verb", "delete", "deployment", name, "statefulset", name, "job", name, "namespace", ns)
+		return true, nil
+	}
+
+	deleted := false
+
+	apps, cancel := hc.appsClient(ctx)
+	err := apps.Deployments(ns).Delete(name, deleteOptions)
+	cancel()
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			level.Error(hc.logger).Log("msg", err)
+			return false, err
+		}
+	} else {
+		deleted = true
+		level.Info(hc.logger).Log("msg", "deleted deployment", "name", name)
+	}
+
+	apps, cancel = hc.appsClient(ctx)
+	err = apps.StatefulSets(ns).Delete(name, deleteOptions)
+	cancel()
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			level.Error(hc.logger).Log("msg", err)
+			return false, err
+		}
+	} else {
+		deleted = true
+		level.Info(hc.logger).Log("msg", "deleted statefulset", "name", name)
+	}
+
+	batch, cancel := hc.batchClient(ctx)
+	err = batch.Jobs(ns).Delete(name, deleteOptions)
+	cancel()
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			level.Error(hc.logger).Log("msg", err)
+			return false, err
+		}
+	} else {
+		deleted = true
+		level.Info(hc.logger).Log("msg", "deleted job", "name", name)
+	}
+
+	return deleted, nil
+}
+
+// newPodTemplate returns the Pod template shared by all the workload kinds
+// that can run a Habitat.
+func (hc *HabitatController) newPodTemplate(ctx context.Context, h *habv1beta1.Habitat) (*apiv1.PodTemplateSpec, error) {
+	// Set the service arguments we send to Habitat.
+	var habArgs []string
+	if h.Spec.Service.Group != "" {
+		// When a service is started without explicitly naming the group,
+		// it's assigned to the default group.
+		habArgs = append(habArgs,
+			"--group", h.Spec.Service.Group)
+	}
+
+	// As we want to label our pods with the
+	// topology type we set standalone as the default one.
+	// We do not need to pass this to habitat, as if no topology
+	// is set, habitat by default sets standalone topology.
+	topology := habv1beta1.TopologyStandalone
+
+	if h.Spec.Service.Topology == habv1beta1.TopologyLeader {
+		topology = habv1beta1.TopologyLeader
+	}
+
+	peerDir, peerFilename := peerWatchFile(h)
+	path := fmt.Sprintf("%s/%s", peerDir, peerFilename)
+
+	habArgs = append(habArgs,
+		"--topology", topology.String(),
+		"--peer-watch-file", path,
+	)
+
+	// The default ports are left implicit, so that the Pods of existing
+	// Habitats aren't replaced.
+	if h.Spec.GossipListenPort != 0 {
+		habArgs = append(habArgs, "--listen-gossip", fmt.Sprintf("0.0.0.0:%d", h.Spec.GossipListenPort))
+	}
+	if h.Spec.HTTPListenPort != 0 {
+		habArgs = append(habArgs, "--listen-http", fmt.Sprintf("0.0.0.0:%d", h.Spec.HTTPListenPort))
+	}
+
+	// Runtime binding.
+	// One Service connects to another forming a producer/consumer relationship.
+	habArgs = append(habArgs, bindArgs(h.Spec.Service.Bind)...)
+	habArgs = append(habArgs, updateArgs(h)...)
+	habArgs = append(habArgs, applicationArgs(h)...)
+
+	base := &apiv1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				habv1beta1.HabitatLabel:     "true",
+				habv1beta1.HabitatNameLabel: habitatLabelValue(h),
+				habv1beta1.TopologyLabel:    topology.String(),
+			},
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Name:  containerName(h),
+					Image: h.Spec.Image,
+					Args:  habArgs,
+					Env:   h.Spec.Env,
+					VolumeMounts: []apiv1.VolumeMount{
+						{
+							Name:      configVolumeName,
+							MountPath: peerDir,
+							ReadOnly:  true,
+						},
+					},
+				},
+			},
+			// Define the volume for the ConfigMap.
+			Volumes: []apiv1.Volume{
+				{
+					Name: configVolumeName,
+					VolumeSource: apiv1.VolumeSource{
+						ConfigMap: &apiv1.ConfigMapVolumeSource{
+							LocalObjectReference: apiv1.LocalObjectReference{
+								Name: peerConfigMapName(h),
+							},
+							Items: []apiv1.KeyToPath{
+								{
+									Key:  peerFile,
+									Path: peerFilename,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// The peer file is projected together with the configuration sources of
+	// the Habitat. A plain ConfigMap volume is kept otherwise, so that the Pods
+	// of existing Habitats aren't replaced.
+	if len(h.Spec.ConfigProjections) > 0 {
+		sources := []apiv1.VolumeProjection{
+			{
+				ConfigMap: &apiv1.ConfigMapProjection{
+					LocalObjectReference: base.Spec.Volumes[0].ConfigMap.LocalObjectReference,
+					Items:                base.Spec.Volumes[0].ConfigMap.Items,
+				},
+			},
+		}
+
+		base.Spec.Volumes[0].VolumeSource = apiv1.VolumeSource{
+			Projected: &apiv1.ProjectedVolumeSource{
+				Sources: append(sources, h.Spec.ConfigProjections...),
+			},
+		}
+	}
+
+	if h.Spec.Ring != "" {
+		base.Labels[habv1beta1.RingLabel] = h.Spec.Ring
+	}
+	if h.Spec.Application != "" {
+		base.Labels[habv1beta1.ApplicationLabel] = h.Spec.Application
+		base.Labels[habv1beta1.EnvironmentLabel] = h.Spec.Environment
+	}
+
+	// Validation has already ensured that the user defined labels don't
+	// override ours.
+	for k, v := range h.Spec.PodLabels {
+		base.Labels[k] = v
+	}
+
+	if len(h.Spec.PodAnnotations) > 0 {
+		base.Annotations = make(map[string]string, len(h.Spec.PodAnnotations))
+		for k, v := range h.Spec.PodAnnotations {
+			base.Annotations[k] = v
+		}
+	}
+
+	if p := h.Spec.GossipListenPort; p != 0 {
+		if base.Annotations == nil {
+			base.Annotations = map[string]string{}
+		}
+		base.Annotations[gossipPortAnnotation] = strconv.Itoa(int(p))
+	}
+
+	propagateMetadata(h, base)
+
+	if h.Spec.Resources != nil {
+		base.Spec.Containers[0].Resources = *h.Spec.Resources
+	}
+
+	if v := h.Spec.SupervisorVersion; v != "" {
+		// Fail before starting the supervisor if the image contains another
+		// version, instead of silently running it.
+		base.Spec.InitContainers = append(base.Spec.InitContainers, apiv1.Container{
+			Name:    supervisorVersionContainerName,
+			Image:   h.Spec.Image,
+			Command: []string{"sh", "-c", fmt.Sprintf("test -d %s/%s", supervisorPkgDir, v)},
+			// It runs the same image as the Habitat Service container.
+			SecurityContext: newSecurityContext(h),
+		})
+	}
+	base.Spec.InitContainers = append(base.Spec.InitContainers, h.Spec.InitContainers...)
+
+	if h.Spec.ConfigMapRef != nil {
+		if err := hc.mountConfigMapRef(ctx, h, base); err != nil {
+			return nil, err
+		}
+	}
+	base.Spec.Affinity = h.Spec.Affinity
+	base.Spec.Tolerations = h.Spec.Tolerations
+	base.Spec.HostNetwork = h.Spec.HostNetwork
+	base.Spec.DNSPolicy = h.Spec.DNSPolicy
+	// Without it, Pods on the host network resolve names with the DNS
+	// settings of the node, and can't find the Services of the cluster.
+	if h.Spec.HostNetwork && h.Spec.DNSPolicy == "" {
+		base.Spec.DNSPolicy = apiv1.DNSClusterFirstWithHostNet
+	}
+	base.Spec.DNSConfig = h.Spec.DNSConfig
+	base.Spec.HostAliases = h.Spec.HostAliases
+	base.Spec.TerminationGracePeriodSeconds = newTerminationGracePeriod(h)
+	base.Spec.Containers[0].Lifecycle = newLifecycle(h)
+	base.Spec.Containers[0].SecurityContext = newSecurityContext(h)
+	base.Spec.SecurityContext = h.Spec.SecurityContext
+
+	for _, name := range h.Spec.ImagePullSecrets {
+		// A missing Secret only prevents pulling private images, and it might
+		// still be created, so only warn about it.
+		if _, err := hc.getSecret(ctx, h.Namespace, name); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, err
+			}
+
+			level.Warn(hc.logger).Log("msg", "Could not find image pull Secret", "name", name, "namespace", h.Namespace)
+			hc.config.EventRecorder.Eventf(h, apiv1.EventTypeWarning, reasonMissingSecret, "Image pull secret %s not found", name)
+		}
+
+		base.Spec.ImagePullSecrets = append(base.Spec.ImagePullSecrets, apiv1.LocalObjectReference{Name: name})
+	}
+
+	if name := h.Spec.ServiceAccountName; name != "" {
+		// The Pods can't be created until the ServiceAccount exists, but it
+		// might still be created, so only warn about it.
+		if _, err := hc.getServiceAccount(ctx, h.Namespace, name); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, err
+			}
+
+			level.Warn(hc.logger).Log("msg", "Could not find ServiceAccount", "name", name, "namespace", h.Namespace)
+			hc.config.EventRecorder.Eventf(h, apiv1.EventTypeWarning, reasonMissingServiceAccount, "ServiceAccount %s not found", name)
+		}
+
+		base.Spec.ServiceAccountName = name
+	}
+
+	if name := h.Spec.PriorityClassName; name != "" {
+		// The Pods can't be created until the PriorityClass exists, but it
+		// might still be created, so only warn about it. Other errors are
+		// ignored, as the scheduling API might not be enabled, or the
+		// operator not allowed to read it.
+		if _, err := hc.getPriorityClass(ctx, name); err != nil {
+			if apierrors.IsNotFound(err) {
+				level.Warn(hc.logger).Log("msg", "Could not find PriorityClass", "name", name)
+				hc.config.EventRecorder.Eventf(h, apiv1.EventTypeWarning, reasonMissingPriorityClass, "PriorityClass %s not found", name)
+			} else {
+				level.Debug(hc.logger).Log("msg", "Could not get PriorityClass", "name", name, "err", err)
+			}
+		}
+
+		base.Spec.PriorityClassName = name
+	}
+
+	base.Spec.Containers[0].ReadinessProbe, base.Spec.Containers[0].LivenessProbe = newProbes(h)
+
+	// The environment variable setting the HTTP gateway auth token, if any.
+	var gatewayEnv []apiv1.EnvVar
+
+	if name := h.Spec.GatewayAuthTokenSecretName; name != "" {
+		s, err := hc.getSecret(ctx, h.Namespace, name)
+		if err != nil {
+			level.Error(hc.logger).Log("msg", "Could not find Secret containing HTTP gateway auth token", "name", name, "namespace", h.Namespace)
+			if apierrors.IsNotFound(err) {
+				hc.config.EventRecorder.Eventf(h, apiv1.EventTypeWarning, reasonMissingSecret, "HTTP gateway auth token secret %s not found", name)
+			}
+			return nil, err
+		}
+
+		token, ok := s.Data[gatewayAuthTokenKey]
+		if !ok {
+			return nil, fmt.Errorf("Secret %s does not contain the %q key", s.Name, gatewayAuthTokenKey)
+		}
+
+		hash, err := specHash(token)
+		if err != nil {
+			return nil, err
+		}
+
+		if base.Annotations == nil {
+			base.Annotations = make(map[string]string, 1)
+		}
+		base.Annotations[gatewayAuthTokenHashAnnotation] = hash
+
+		gatewayEnv = []apiv1.EnvVar{
+			{
+				Name: gatewayAuthTokenEnv,
+				ValueFrom: &apiv1.EnvVarSource{
+					SecretKeyRef: &apiv1.SecretKeySelector{
+						LocalObjectReference: apiv1.LocalObjectReference{Name: s.Name},
+						Key:                  gatewayAuthTokenKey,
+					},
+				},
+			},
+		}
+
+		// User defined variables come last, so that they can override ours.
+		base.Spec.Containers[0].Env = append(gatewayEnv, h.Spec.Env...)
+	}
+
+	// If we have a secret name present we should mount that secret.
+	if h.Spec.Service.ConfigSecretName != "" {
+		// Let's make sure our secret is there before mounting it.
+		secret, err := hc.getSecret(ctx, h.Namespace, h.Spec.Service.ConfigSecretName)
+		if err != nil {
+			return nil, err
+		}
+
+		// Without the key the Pods would fail to mount the volume.
+		if _, ok := secret.Data[userTOMLFile]; !ok {
+			return nil, fmt.Errorf("Secret %s does not contain the %q key", secret.Name, userTOMLFile)
+		}
+
+		secretVolume := &apiv1.Volume{
+			Name: initialConfigFilename,
+			VolumeSource: apiv1.VolumeSource{
+				Secret: &apiv1.SecretVolumeSource{
+					SecretName: secret.Name,
+					Items: []apiv1.KeyToPath{
+						{
+							Key:  userTOMLFile,
+							Path: userTOMLFile,
+						},
+					},
+				},
+			},
+		}
+
+		secretVolumeMount := &apiv1.VolumeMount{
+			Name: initialConfigFilename,
+			// The Habitat supervisor creates a directory for each service under /hab/svc/<servicename>.
+			// We need to place the user.toml file in there in order for it to be detected.
+			MountPath: fmt.Sprintf("/hab/user/%s/config", h.Spec.Service.Name),
+			ReadOnly:  false,
+		}
+
+		base.Spec.Containers[0].VolumeMounts = append(base.Spec.Containers[0].VolumeMounts, *secretVolumeMount)
+		base.Spec.Volumes = append(base.Spec.Volumes, *secretVolume)
+	}
+
+	// The user.toml file rendered from Config is mounted like the one of
+	// ConfigSecretName.
+	if h.Spec.Config != "" {
+		config, err := renderConfig(h)
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err := specHash(config)
+		if err != nil {
+			return nil, err
+		}
+
+		if base.Annotations == nil {
+			base.Annotations = make(map[string]string, 1)
+		}
+		base.Annotations[userConfigHashAnnotation] = hash
+
+		base.Spec.Volumes = append(base.Spec.Volumes, apiv1.Volume{
+			Name: initialConfigFilename,
+			VolumeSource: apiv1.VolumeSource{
+				ConfigMap: &apiv1.ConfigMapVolumeSource{
+					LocalObjectReference: apiv1.LocalObjectReference{Name: userConfigMapName(h)},
+					Items:                []apiv1.KeyToPath{{Key: userTOMLFile, Path: userTOMLFile}},
+				},
+			},
+		})
+		base.Spec.Containers[0].VolumeMounts = append(base.Spec.Containers[0].VolumeMounts, apiv1.VolumeMount{
+			Name:      initialConfigFilename,
+			MountPath: fmt.Sprintf("/hab/user/%s/config", h.Spec.Service.Name),
+		})
+	}
+
+	// Arguments the additional services need to join an encrypted ring.
+	var ringArgs []string
+	// The ring and user keys share the keys directory, so they are projected
+	// into a single volume.
+	var keySources []apiv1.VolumeProjection
+
 	// Handle ring key, if one is specified.
 	if ringSecretName := h.Spec.Service.RingSecretName; ringSecretName != "" {
-		s, err := hc.config.KubernetesClientset.CoreV1().Secrets(apiv1.NamespaceDefault).Get(ringSecretName, metav1.GetOptions{})
+		s, err := hc.getSecret(ctx, h.Namespace, ringSecretName)
 		if err != nil {
-			level.Error(hc.logger).Log("msg", "Could not find Secret containing ring key")
+			level.Error(hc.logger).Log("msg", "Could not find Secret containing ring key", "name", ringSecretName, "namespace", h.Namespace)
+			return nil, err
+		}
+
+		// Without the key the supervisor would join the ring unencrypted.
+		if _, ok := s.Data[ringSecretKey]; !ok {
+			return nil, fmt.Errorf("Secret %s does not contain the %q key", s.Name, ringSecretKey)
+		}
+
+		// The filename under which the ring key is saved.
+		ringKeyFile := fmt.Sprintf("%s.%s", ringSecretName, ringKeyFileExt)
+
+		// Extract the bare ring name, by removing the revision.
+		// Validation has already been performed by this point.
+		ringName := ringRegexp.FindStringSubmatch(ringSecretName)[1]
+
+		keySources = append(keySources, apiv1.VolumeProjection{
+			Secret: &apiv1.SecretProjection{
+				LocalObjectReference: apiv1.LocalObjectReference{Name: s.Name},
+				Items: []apiv1.KeyToPath{
+					{
+						Key:  ringSecretKey,
+						Path: ringKeyFile,
+					},
+				},
+			},
+		})
+
+		// Add --ring argument to supervisor invocation.
+		base.Spec.Containers[0].Args = append(base.Spec.Containers[0].Args, "--ring", ringName)
+
+		ringArgs = []string{"--ring", ringName}
+	}
+
+	// Handle user key, if one is specified.
+	if userKeySecretName := h.Spec.Service.UserKeySecretName; userKeySecretName != "" {
+		s, err := hc.getSecret(ctx, h.Namespace, userKeySecretName)
+		if err != nil {
+			level.Error(hc.logger).Log("msg", "Could not find Secret containing user key", "name", userKeySecretName, "namespace", h.Namespace)
+			if apierrors.IsNotFound(err) {
+				hc.config.EventRecorder.Eventf(h, apiv1.EventTypeWarning, reasonMissingSecret, "User key secret %s not found", userKeySecretName)
+			}
 			return nil, err
 		}
 
-		// The filename under which the ring key is saved.
-		ringKeyFile := fmt.Sprintf("%s.%s", ringSecretName, ringKeyFileExt)
+		if len(s.Data) == 0 {
+			return nil, fmt.Errorf("Secret %s does not contain any keys", s.Name)
+		}
+
+		// The keys of the Secret are the filenames of the user key pair, so
+		// all of them are projected.
+		keySources = append(keySources, apiv1.VolumeProjection{
+			Secret: &apiv1.SecretProjection{
+				LocalObjectReference: apiv1.LocalObjectReference{Name: s.Name},
+			},
+		})
+	}
+
+	var keyMounts []apiv1.VolumeMount
+	if len(keySources) > 0 {
+		base.Spec.Volumes = append(base.Spec.Volumes, apiv1.Volume{
+			Name: keysVolumeName,
+			VolumeSource: apiv1.VolumeSource{
+				Projected: &apiv1.ProjectedVolumeSource{
+					Sources: keySources,
+				},
+			},
+		})
+
+		keyMounts = []apiv1.VolumeMount{
+			{
+				Name:      keysVolumeName,
+				MountPath: keysDir,
+				// This directory cannot be made read-only, as the supervisor writes to
+				// it during its operation.
+				ReadOnly: false,
+			},
+		}
+
+		base.Spec.Containers[0].VolumeMounts = append(base.Spec.Containers[0].VolumeMounts, keyMounts...)
+	}
+
+	for i, svc := range h.Spec.Services {
+		c := newServiceContainer(h, i, svc)
+		c.Args = append(c.Args, ringArgs...)
+		c.VolumeMounts = append(c.VolumeMounts, keyMounts...)
+		c.Lifecycle = newLifecycle(h)
+		c.Env = gatewayEnv
+		c.SecurityContext = newSecurityContext(h)
+		if svc.SecurityContext != nil {
+			c.SecurityContext = svc.SecurityContext
+		}
+
+		base.Spec.Containers = append(base.Spec.Containers, c)
+	}
+
+	base.Spec.Containers = append(base.Spec.Containers, h.Spec.Sidecars...)
+	base.Spec.Volumes = append(base.Spec.Volumes, h.Spec.Volumes...)
+	base.Spec.Containers[0].VolumeMounts = append(base.Spec.Containers[0].VolumeMounts, h.Spec.VolumeMounts...)
+
+	base.Spec.Containers[0].Command = h.Spec.Command
+	if len(h.Spec.Args) > 0 {
+		base.Spec.Containers[0].Args = append(append([]string{}, h.Spec.Args...), base.Spec.Containers[0].Args...)
+	}
+
+	// User defined arguments come last, so that they can override ours.
+	base.Spec.Containers[0].Args = append(base.Spec.Containers[0].Args, h.Spec.SupervisorArgs...)
+
+	return base, nil
+}
+
+func (hc *HabitatController) newDeployment(ctx context.Context, h *habv1beta1.Habitat) (*appsv1.Deployment, error) {
+	// This value needs to be passed as a *int32, so we convert it, assign it to a
+	// variable and afterwards pass a pointer to it.
+	count := int32(h.Spec.Count)
+
+	template, err := hc.newPodTemplate(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	revisionHistoryLimit := int32(defaultRevisionHistoryLimit)
+	if h.Spec.RevisionHistoryLimit != nil {
+		revisionHistoryLimit = *h.Spec.RevisionHistoryLimit
+	}
+
+	progressDeadlineSeconds := int32(defaultProgressDeadlineSeconds)
+	if h.Spec.ProgressDeadlineSeconds != nil {
+		progressDeadlineSeconds = *h.Spec.ProgressDeadlineSeconds
+	}
+
+	base := &appsv1.Deployment{
+		ObjectMeta: newWorkloadObjectMeta(h),
+		Spec: appsv1.DeploymentSpec{
+			Replicas:                &count,
+			Selector:                newWorkloadSelector(h),
+			Template:                *template,
+			RevisionHistoryLimit:    &revisionHistoryLimit,
+			ProgressDeadlineSeconds: &progressDeadlineSeconds,
+		},
+	}
+
+	if us := h.Spec.UpdateStrategy; us != nil {
+		base.Spec.Strategy.Type = us.Type
+		if us.MaxSurge != nil || us.MaxUnavailable != nil {
+			base.Spec.Strategy.RollingUpdate = &appsv1.RollingUpdateDeployment{
+				MaxSurge:       us.MaxSurge,
+				MaxUnavailable: us.MaxUnavailable,
+			}
+		}
+	}
+
+	// Record the hash of the desired spec, so that we can later tell whether
+	// the Deployment needs to be updated without comparing it field by field
+	// against an object that has been defaulted by the API server.
+	hash, err := specHash(&base.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	base.Annotations[specHashAnnotation] = hash
+
+	immutable, err := json.Marshal(immutableSpec(h.Spec))
+	if err != nil {
+		return nil, err
+	}
+
+	base.Annotations[immutableSpecAnnotation] = string(immutable)
+
+	return base, nil
+}
+
+// mountConfigMapRef mounts the ConfigMap referenced by the Habitat in the
+// Habitat Service container of the template, and annotates the template with
+// the hash of its data.
+func (hc *HabitatController) mountConfigMapRef(ctx context.Context, h *habv1beta1.Habitat, template *apiv1.PodTemplateSpec) error {
+	ref := h.Spec.ConfigMapRef
+
+	cm, err := hc.getConfigMap(ctx, h.Namespace, ref.Name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			hc.config.EventRecorder.Eventf(h, apiv1.EventTypeWarning, reasonMissingConfigMap, "ConfigMap %s not found", ref.Name)
+		}
+		return err
+	}
+
+	// Without the keys the Pods would fail to mount the volume.
+	for _, item := range ref.Items {
+		if _, ok := cm.Data[item.Key]; !ok {
+			return fmt.Errorf("ConfigMap %s does not contain the %q key", cm.Name, item.Key)
+		}
+	}
+
+	hash, err := specHash(mountedData(cm, ref.Items))
+	if err != nil {
+		return err
+	}
+
+	if template.Annotations == nil {
+		template.Annotations = make(map[string]string, 1)
+	}
+	template.Annotations[configMapHashAnnotation] = hash
+
+	mountPath := ref.MountPath
+	if mountPath == "" {
+		mountPath = fmt.Sprintf("/hab/svc/%s/files", h.Spec.Service.Name)
+	}
+
+	template.Spec.Volumes = append(template.Spec.Volumes, apiv1.Volume{
+		Name: configMapRefVolumeName,
+		VolumeSource: apiv1.VolumeSource{
+			ConfigMap: &apiv1.ConfigMapVolumeSource{
+				LocalObjectReference: apiv1.LocalObjectReference{Name: cm.Name},
+				Items:                ref.Items,
+			},
+		},
+	})
+	template.Spec.Containers[0].VolumeMounts = append(template.Spec.Containers[0].VolumeMounts, apiv1.VolumeMount{
+		Name:      configMapRefVolumeName,
+		MountPath: mountPath,
+		ReadOnly:  true,
+	})
+
+	return nil
+}
+
+// mountedData returns the data of cm mounted in the Pods: the given keys, or
+// all of them if none are given. Changes to other keys don't reach the Pods,
+// so they don't need to roll them.
+func mountedData(cm *apiv1.ConfigMap, items []apiv1.KeyToPath) map[string]string {
+	if len(items) == 0 {
+		return cm.Data
+	}
+
+	data := make(map[string]string, len(items))
+	for _, item := range items {
+		data[item.Key] = cm.Data[item.Key]
+	}
+
+	return data
+}
+
+// newServiceContainer returns the container running the i-th additional
+// service of the Habitat. The containers of a Pod share its network namespace,
+// so each supervisor listens on its own ports, and joins the ring by peering
+// with the supervisor of the main service.
+func newServiceContainer(h *habv1beta1.Habitat, i int, svc habv1beta1.ServiceSpec) apiv1.Container {
+	offset := (i + 1) * servicePortOffset
+
+	args := []string{
+		"--listen-gossip", fmt.Sprintf("0.0.0.0:%d", gossipListenPort(h)+int32(offset)),
+		"--listen-http", fmt.Sprintf("0.0.0.0:%d", httpListenPort(h)+int32(offset)),
+		"--peer", fmt.Sprintf("127.0.0.1:%d", gossipListenPort(h)),
+	}
+
+	if h.Spec.Service.Group != "" {
+		args = append(args, "--group", h.Spec.Service.Group)
+	}
+
+	args = append(args, bindArgs(svc.Bind)...)
+	args = append(args, updateArgs(h)...)
+	args = append(args, applicationArgs(h)...)
+
+	return apiv1.Container{
+		Name:  svc.Name,
+		Image: svc.Image,
+		Args:  args,
+	}
+}
+
+// bindArgs returns the supervisor arguments for the given binds.
+func bindArgs(binds []habv1beta1.Bind) []string {
+	var args []string
+	for _, bind := range binds {
+		bindArg := fmt.Sprintf("%s:%s.%s", bind.Name, bind.Service, groupOrDefault(bind.Group))
+		args = append(args, "--bind", bindArg)
+	}
+
+	return args
+}
+
+// updateArgs returns the supervisor arguments making it update its service
+// in place.
+func updateArgs(h *habv1beta1.Habitat) []string {
+	var args []string
+	if s := h.Spec.HabUpdateStrategy; s != "" {
+		args = append(args, "--strategy", string(s))
+	}
+	if c := h.Spec.UpdateChannel; c != "" {
+		args = append(args, "--channel", c)
+	}
+
+	return args
+}
+
+// applicationArgs returns the supervisor arguments grouping its service by
+// application and environment.
+func applicationArgs(h *habv1beta1.Habitat) []string {
+	if h.Spec.Application == "" {
+		return nil
+	}
+
+	return []string{"--application", h.Spec.Application, "--environment", h.Spec.Environment}
+}
+
+// newLifecycle returns the lifecycle of the containers running supervisors.
+// By default, the supervisors are told to leave the ring before being stopped,
+// so that their peers don't need to detect their departure.
+func newLifecycle(h *habv1beta1.Habitat) *apiv1.Lifecycle {
+	if h.Spec.PreStop != nil {
+		return &apiv1.Lifecycle{PreStop: h.Spec.PreStop}
+	}
+
+	return &apiv1.Lifecycle{
+		PreStop: &apiv1.Handler{
+			Exec: &apiv1.ExecAction{
+				Command: []string{"hab", "sup", "term"},
+			},
+		},
+	}
+}
+
+// newSecurityContext returns the security context of the containers of the
+// Habitat Services. Unless overridden in the spec, they're not privileged, and
+// can't gain privileges.
+func newSecurityContext(h *habv1beta1.Habitat) *apiv1.SecurityContext {
+	if h.Spec.ContainerSecurityContext != nil {
+		return h.Spec.ContainerSecurityContext
+	}
+
+	privileged := false
+	allowPrivilegeEscalation := false
+
+	// The supervisor runs as root, and only needs the capabilities to run
+	// the services as the hab user, and to signal them.
+	return &apiv1.SecurityContext{
+		Privileged:               &privileged,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		Capabilities: &apiv1.Capabilities{
+			Drop: []apiv1.Capability{"ALL"},
+			Add:  []apiv1.Capability{"CHOWN", "DAC_OVERRIDE", "FOWNER", "KILL", "SETGID", "SETUID"},
+		},
+	}
+}
 
-		// Extract the bare ring name, by removing the revision.
-		// Validation has already been performed by this point.
-		ringName := ringRegexp.FindStringSubmatch(ringSecretName)[1]
+// newTerminationGracePeriod returns how long the Pods of the Habitat are given
+// to stop, in seconds.
+func newTerminationGracePeriod(h *habv1beta1.Habitat) *int64 {
+	period := int64(defaultTerminationGracePeriod)
+	if h.Spec.TerminationGracePeriodSeconds != nil {
+		period = *h.Spec.TerminationGracePeriodSeconds
+	}
 
-		v := &apiv1.Volume{
-			Name: ringSecretName,
-			VolumeSource: apiv1.VolumeSource{
-				Secret: &apiv1.SecretVolumeSource{
-					SecretName: s.Name,
-					Items: []apiv1.KeyToPath{
-						{
-							Key:  ringSecretKey,
-							Path: ringKeyFile,
-						},
-					},
-				},
+	return &period
+}
+
+// newProbes returns the readiness and liveness probes of the Habitat Service
+// container. Unless overridden in the spec, they check that the supervisor's
+// HTTP gateway is responding.
+func newProbes(h *habv1beta1.Habitat) (readiness *apiv1.Probe, liveness *apiv1.Probe) {
+	handler := apiv1.Handler{
+		HTTPGet: &apiv1.HTTPGetAction{
+			Path: "/services",
+			Port: intstr.FromInt(int(httpListenPort(h))),
+		},
+	}
+
+	// The probes can't authenticate without exposing the token in the Pod
+	// spec, so they only check that the gateway accepts connections.
+	if h.Spec.GatewayAuthTokenSecretName != "" {
+		handler = apiv1.Handler{
+			TCPSocket: &apiv1.TCPSocketAction{
+				Port: intstr.FromInt(int(httpListenPort(h))),
 			},
 		}
+	}
+
+	readiness = &apiv1.Probe{
+		Handler:             handler,
+		InitialDelaySeconds: 5,
+	}
+
+	// Give the supervisor some time to start before killing it.
+	liveness = &apiv1.Probe{
+		Handler:             handler,
+		InitialDelaySeconds: 30,
+	}
 
-		vm := &apiv1.VolumeMount{
-			Name:      ringSecretName,
-			MountPath: "/hab/cache/keys",
-			// This directory cannot be made read-only, as the supervisor writes to
-			// it during its operation.
-			ReadOnly: false,
+	if p := h.Spec.Probe; p != nil {
+		if p.Readiness != nil {
+			readiness = p.Readiness
+		}
+		if p.Liveness != nil {
+			liveness = p.Liveness
 		}
+	}
+
+	return readiness, liveness
+}
 
-		// Mount ring key file.
-		base.Spec.Template.Spec.Volumes = append(base.Spec.Template.Spec.Volumes, *v)
-		base.Spec.Template.Spec.Containers[0].VolumeMounts = append(base.Spec.Template.Spec.Containers[0].VolumeMounts, *vm)
+// newOwnerReference returns a reference to the given workload, so that the
+// resources it owns are garbage collected together with it.
+func newOwnerReference(workload metav1.Object, gvk schema.GroupVersionKind) *metav1.OwnerReference {
+	return &metav1.OwnerReference{
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       gvk.Kind,
+		Name:       workload.GetName(),
+		UID:        workload.GetUID(),
+	}
+}
 
-		// Add --ring argument to supervisor invocation.
-		base.Spec.Template.Spec.Containers[0].Args = append(base.Spec.Template.Spec.Containers[0].Args, "--ring", ringName)
+// newWorkloadSelector returns the selector of the workload running a Habitat,
+// matching only the Pods of that Habitat.
+func newWorkloadSelector(h *habv1beta1.Habitat) *metav1.LabelSelector {
+	return &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			habv1beta1.HabitatLabel:     "true",
+			habv1beta1.HabitatNameLabel: habitatLabelValue(h),
+		},
 	}
+}
 
-	return base, nil
+// newWorkloadObjectMeta returns the ObjectMeta of the workload running a Habitat.
+func newWorkloadObjectMeta(h *habv1beta1.Habitat) metav1.ObjectMeta {
+	annotations := operatorAnnotations()
+	keys := make([]string, 0, len(h.Spec.DeploymentAnnotations))
+	for k, v := range h.Spec.DeploymentAnnotations {
+		annotations[k] = v
+		keys = append(keys, k)
+	}
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		annotations[deploymentAnnotationsAnnotation] = strings.Join(keys, ",")
+	}
+
+	return metav1.ObjectMeta{
+		Name:      workloadName(h),
+		Namespace: h.Namespace,
+		Labels: map[string]string{
+			habv1beta1.HabitatLabel:     "true",
+			habv1beta1.HabitatNameLabel: habitatLabelValue(h),
+			habv1beta1.CreatedByLabel:   habv1beta1.CreatedBy,
+		},
+		Annotations: annotations,
+	}
+}
+
+// EnqueueAll enqueues all the Habitats in the cache, so that they're
+// reconciled without waiting for the resync period, e.g. after an issue
+// affecting all of them was fixed. It returns the amount of Habitats enqueued,
+// which is 0 until the caches have been synced.
+func (hc *HabitatController) EnqueueAll() int {
+	if !hc.cachesSynced() {
+		return 0
+	}
+
+	objs := hc.habInformer.GetStore().List()
+	for _, obj := range objs {
+		h, ok := obj.(*habv1beta1.Habitat)
+		if !ok {
+			level.Error(hc.logger).Log("msg", "Failed to type assert Habitat", "obj", obj)
+			continue
+		}
+
+		hc.enqueue(h)
+	}
+
+	return len(objs)
 }
 
 func (hc *HabitatController) enqueue(hab *habv1beta1.Habitat) {
@@ -764,12 +2218,12 @@ func (hc *HabitatController) enqueue(hab *habv1beta1.Habitat) {
 	hc.queue.Add(k)
 }
 
-func (hc *HabitatController) worker() {
-	for hc.processNextItem() {
+func (hc *HabitatController) worker(ctx context.Context) {
+	for hc.processNextItem(ctx) {
 	}
 }
 
-func (hc *HabitatController) processNextItem() bool {
+func (hc *HabitatController) processNextItem(ctx context.Context) bool {
 	// Process an item, unless `queue.ShutDown()` has been called, in which case we exit.
 	key, quit := hc.queue.Get()
 	if quit {
@@ -778,94 +2232,585 @@ func (hc *HabitatController) processNextItem() bool {
 
 	defer hc.queue.Done(key)
 
+	// The items still queued on shutdown are reconciled on the next start.
+	if hc.queue.ShuttingDown() {
+		return false
+	}
+
 	k, ok := key.(string)
 	if !ok {
+		// Retrying won't help, so drop the item and keep the worker running.
 		level.Error(hc.logger).Log("msg", "Failed to type assert key", "obj", key)
-		return false
+		hc.queue.Forget(key)
+		return true
 	}
 
-	err := hc.conform(k)
+	start := time.Now()
+	result, err := hc.conform(ctx, k)
+	hc.metrics.reconcileDuration.Observe(time.Since(start).Seconds())
+
 	if err != nil {
-		level.Error(hc.logger).Log("msg", "Habitat could not be synced, requeueing", "err", err, "obj", k)
+		hc.metrics.reconcileErrors.Inc()
+		if isTimeout(err) {
+			level.Warn(hc.logger).Log("msg", "API server did not respond in time, requeueing", "err", err, "obj", k, "timeout", apiCallTimeout, "retries", hc.queue.NumRequeues(k))
+		} else {
+			level.Error(hc.logger).Log("msg", "Habitat could not be synced, requeueing", "err", err, "obj", k, "retries", hc.queue.NumRequeues(k))
+		}
 
 		hc.queue.AddRateLimited(k)
 
 		return true
 	}
 
+	if result.requeue {
+		hc.queue.AddRateLimited(k)
+		return true
+	}
+
 	// If there was no error, tell the queue it can stop tracking failure history for the key.
 	hc.queue.Forget(k)
 
+	if result.requeueAfter > 0 {
+		hc.queue.AddAfter(k, result.requeueAfter)
+	}
+
 	return true
 }
 
+// reconcileResult tells the worker whether to reconcile a Habitat again,
+// even though its reconciliation succeeded, e.g. to wait for a dependency.
+type reconcileResult struct {
+	// requeue reconciles the Habitat again after the delay of the rate
+	// limiter, which grows with each retry.
+	requeue bool
+	// requeueAfter reconciles the Habitat again after the given delay.
+	requeueAfter time.Duration
+}
+
 // conform is where the reconciliation takes place.
 // It is invoked when any of the following resources get created, updated or deleted:
-// Habitat, Pod, Deployment, ConfigMap.
-func (hc *HabitatController) conform(key string) error {
-	obj, exists, err := hc.habInformer.GetStore().GetByKey(key)
+// Habitat, Pod, Deployment, StatefulSet, Service, ConfigMap.
+func (hc *HabitatController) conform(ctx context.Context, key string) (reconcileResult, error) {
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
-		return err
+		return reconcileResult{}, err
 	}
-	if !exists {
+
+	h, err := hc.habLister.Habitats(ns).Get(name)
+	if apierrors.IsNotFound(err) {
 		// The Habitat was deleted.
-		return hc.handleHabitatDeletion(key)
+		return reconcileResult{}, hc.handleHabitatDeletion(ctx, key)
+	}
+	if err != nil {
+		return reconcileResult{}, err
 	}
 
 	// The Habitat was either created or updated.
-	h, ok := obj.(*habv1beta1.Habitat)
-	if !ok {
-		return fmt.Errorf("unknown event type")
+	level.Debug(hc.logger).Log("function", "handle Habitat Creation", "msg", h.ObjectMeta.SelfLink)
+
+	// The Habitat is being deleted, clean up before letting it go.
+	if h.DeletionTimestamp != nil {
+		return reconcileResult{}, hc.finalizeHabitat(ctx, h)
 	}
 
-	level.Debug(hc.logger).Log("function", "handle Habitat Creation", "msg", h.ObjectMeta.SelfLink)
+	h, err = hc.ensureFinalizer(ctx, h)
+	if err != nil {
+		return reconcileResult{}, err
+	}
+
+	// The Habitat as stored, to which the status is written.
+	stored := h
+	h = applyDefaults(stored, hc.config.Defaults)
 
 	// Validate object.
 	if err := validateCustomObject(*h); err != nil {
-		return err
+		if vErr, ok := err.(validationError); ok {
+			// Retrying won't help, only an update to the Habitat can fix this.
+			level.Error(hc.logger).Log("msg", "Habitat failed validation", "name", h.Name, "err", vErr)
+			hc.config.EventRecorder.Event(h, apiv1.EventTypeWarning, reasonValidationFailed, vErr.Error())
+			return reconcileResult{}, hc.updateHabitatStatus(ctx, stored, h, vErr)
+		}
+
+		return reconcileResult{}, err
+	}
+
+	if err := validateBinds(*h, hc.habInformer.GetStore()); err != nil {
+		if vErr, ok := err.(validationError); ok {
+			// The Habitat will be enqueued again once the target of the bind is created.
+			level.Error(hc.logger).Log("msg", "Habitat failed validation", "name", h.Name, "err", vErr)
+			hc.config.EventRecorder.Event(h, apiv1.EventTypeWarning, reasonValidationFailed, vErr.Error())
+			return reconcileResult{}, hc.updateHabitatStatus(ctx, stored, h, vErr)
+		}
+
+		return reconcileResult{}, err
+	}
+
+	if err := hc.validateAppliedSpec(h); err != nil {
+		if vErr, ok := err.(validationError); ok {
+			// Applying the change would break the ring, so the Habitat is
+			// left as it is until the change is reverted.
+			level.Error(hc.logger).Log("msg", "Habitat changed immutable fields", "name", h.Name, "err", vErr)
+			hc.config.EventRecorder.Event(h, apiv1.EventTypeWarning, reasonValidationFailed, vErr.Error())
+			return reconcileResult{}, hc.updateHabitatStatus(ctx, stored, h, vErr)
+		}
+
+		return reconcileResult{}, err
 	}
 
 	level.Debug(hc.logger).Log("msg", "validated object")
 
-	deployment, err := hc.newDeployment(h)
+	// Handle creation/updating of peer IP ConfigMap. It comes before the
+	// workload, as its Pods can't start without it: if it can't be created,
+	// no Pods are left pending.
+	if err := hc.handleConfigMap(ctx, h); err != nil {
+		return reconcileResult{}, err
+	}
+
+	// Create or update the workload running the Habitat.
+	var owner *metav1.OwnerReference
+	switch h.Spec.Kind {
+	case habv1beta1.WorkloadKindStatefulSet:
+		owner, err = hc.handleStatefulSet(ctx, h)
+	case habv1beta1.WorkloadKindJob:
+		owner, err = hc.handleJob(ctx, h)
+	default:
+		owner, err = hc.handleDeployment(ctx, h)
+	}
+	if err != nil {
+		if cErr, ok := err.(nameConflictError); ok {
+			// Retrying won't help until the conflicting workload is removed,
+			// which is noticed on resync.
+			level.Error(hc.logger).Log("msg", "Habitat name conflict", "name", h.Name, "err", cErr)
+			hc.config.EventRecorder.Event(h, apiv1.EventTypeWarning, reasonNameConflict, cErr.Error())
+			return reconcileResult{}, hc.updateHabitatStatus(ctx, stored, h, cErr)
+		}
+
+		return reconcileResult{}, err
+	}
+	if owner == nil {
+		// The Job is being replaced, and its deletion requeues the Habitat.
+		return reconcileResult{}, nil
+	}
+
+	// Handle creation of the Service exposing the supervisors.
+	if err := hc.handleService(ctx, h, *owner); err != nil {
+		return reconcileResult{}, err
+	}
+
+	// Handle the Service publishing the ports of the Habitat Service.
+	if err := hc.handleExposedService(ctx, h, *owner); err != nil {
+		if cErr, ok := err.(nameConflictError); ok {
+			// The Service might be owned by the user, so it's left alone.
+			level.Error(hc.logger).Log("msg", "Habitat name conflict", "name", h.Name, "err", cErr)
+			hc.config.EventRecorder.Event(h, apiv1.EventTypeWarning, reasonNameConflict, cErr.Error())
+			return reconcileResult{}, hc.updateHabitatStatus(ctx, stored, h, cErr)
+		}
+
+		return reconcileResult{}, err
+	}
+
+	// Handle the ConfigMap containing the user.toml file rendered from Config.
+	if err := hc.handleUserConfigMap(ctx, h, *owner); err != nil {
+		if cErr, ok := err.(nameConflictError); ok {
+			level.Error(hc.logger).Log("msg", "Habitat name conflict", "name", h.Name, "err", cErr)
+			hc.config.EventRecorder.Event(h, apiv1.EventTypeWarning, reasonNameConflict, cErr.Error())
+			return reconcileResult{}, hc.updateHabitatStatus(ctx, stored, h, cErr)
+		}
+
+		return reconcileResult{}, err
+	}
+
+	// Handle creation of the ServiceMonitor scraping the supervisors.
+	if err := hc.handleServiceMonitor(ctx, h, *owner); err != nil {
+		return reconcileResult{}, err
+	}
+
+	// Handle the PodDisruptionBudget keeping the ring available.
+	if err := hc.handlePodDisruptionBudget(ctx, h, *owner); err != nil {
+		return reconcileResult{}, err
+	}
+
+	if err := hc.updateHabitatStatus(ctx, stored, h, nil); err != nil {
+		return reconcileResult{}, err
+	}
+
+	// Pods that are still waiting for an IP can't be written to the peer
+	// file yet. Their update is usually noticed, but check again in case it
+	// was missed.
+	if hc.podsWaitingForIP(h) {
+		level.Debug(hc.logger).Log("msg", "Pods waiting for an IP, requeueing", "name", h.Name, "after", podIPRequeueDelay)
+		return reconcileResult{requeueAfter: podIPRequeueDelay}, nil
+	}
+
+	return reconcileResult{}, nil
+}
+
+// podsWaitingForIP returns true if any of the Pods of the Habitat has been
+// scheduled, but not assigned an IP yet, according to the cache.
+func (hc *HabitatController) podsWaitingForIP(h *habv1beta1.Habitat) bool {
+	objs, err := hc.podInformer.GetIndexer().ByIndex(ringIndex, ringIndexKey(h.Namespace, h.Spec.Ring))
 	if err != nil {
+		return false
+	}
+
+	for _, obj := range objs {
+		p, ok := obj.(*apiv1.Pod)
+		if !ok || p.Labels[habv1beta1.HabitatNameLabel] != habitatLabelValue(h) {
+			continue
+		}
+
+		if p.Spec.NodeName != "" && p.Status.PodIP == "" && p.DeletionTimestamp == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateAppliedSpec returns a validationError if the fields of the spec of
+// the Habitat that can't be changed differ from the ones its workload was
+// created with. Workloads created by older versions of the operator don't
+// record them, and aren't checked.
+func (hc *HabitatController) validateAppliedSpec(h *habv1beta1.Habitat) error {
+	_, store := hc.workloadStore(h)
+
+	obj, exists, err := store.GetByKey(h.Namespace + "/" + workloadName(h))
+	if err != nil || !exists {
 		return err
 	}
 
-	// Create Deployment, if it doesn't already exist.
-	if _, err := hc.config.KubernetesClientset.AppsV1beta1().Deployments(h.Namespace).Create(deployment); err != nil {
-		// Was the error due to the Deployment already existing?
-		if apierrors.IsAlreadyExists(err) {
-			// If yes, update it.
-			if _, err := hc.config.KubernetesClientset.AppsV1beta1().Deployments(h.Namespace).Update(deployment); err != nil {
-				return err
-			}
-		} else {
-			return err
+	workload, ok := obj.(metav1.Object)
+	if !ok {
+		return fmt.Errorf("unexpected workload of type %T", obj)
+	}
+
+	// Workloads that aren't managed for the Habitat are reported as name
+	// conflicts later on.
+	applied, ok := workload.GetAnnotations()[immutableSpecAnnotation]
+	if !ok || !isOwnedByHabitat(workload, h) {
+		return nil
+	}
+
+	var old habv1beta1.HabitatSpec
+	if err := json.Unmarshal([]byte(applied), &old); err != nil {
+		return err
+	}
+
+	if errs := validateImmutableFields(old, h.Spec); len(errs) > 0 {
+		return validationError{errs: errs}
+	}
+
+	return nil
+}
+
+// updateHabitatStatus writes the operator's view of the Habitat to its status.
+// Only the status of a copy of the stored object is modified, and the write is
+// rejected with a conflict if the Habitat has been changed in the meantime.
+// h is the stored Habitat with the defaults applied, and failure the
+// validation error or the name conflict that stopped the reconciliation, if
+// any.
+func (hc *HabitatController) updateHabitatStatus(ctx context.Context, stored, h *habv1beta1.Habitat, failure error) error {
+	status := h.Status
+	status.State = habv1beta1.HabitatStateProcessed
+	status.DesiredReplicas = h.Spec.Count
+	status.ReadyReplicas = hc.readyReplicas(h)
+	status.Phase = habitatPhase(status.ReadyReplicas, status.DesiredReplicas)
+	status.Conditions = hc.reconcileConditions(h, status.Conditions, status.ReadyReplicas, failure, metav1.Now())
+	status.Leader = hc.ringLeader(h, h.Status.Leader)
+
+	if v := h.Spec.SupervisorVersion; v != "" {
+		c := habv1beta1.HabitatCondition{
+			Type:   habv1beta1.HabitatConditionSupervisorVersionMismatch,
+			Status: apiv1.ConditionFalse,
+		}
+		if hc.supervisorVersionMismatch(h) {
+			c.Status = apiv1.ConditionTrue
+			c.Reason = reasonSupervisorVersionMismatch
+			c.Message = fmt.Sprintf("Image %s does not contain supervisor version %s", h.Spec.Image, v)
 		}
 
-		level.Debug(hc.logger).Log("msg", "deployment already existed", "name", deployment.Name)
+		status.Conditions = setCondition(status.Conditions, c, metav1.Now())
+
+		if c.Status == apiv1.ConditionTrue && !hasCondition(h.Status.Conditions, c) {
+			level.Error(hc.logger).Log("msg", "Supervisor version mismatch", "name", h.Name, "image", h.Spec.Image, "version", v)
+			hc.config.EventRecorder.Event(h, apiv1.EventTypeWarning, reasonSupervisorVersionMismatch, c.Message)
+		}
 	} else {
-		level.Info(hc.logger).Log("msg", "created deployment", "name", deployment.Name)
+		status.Conditions = removeCondition(status.Conditions, habv1beta1.HabitatConditionSupervisorVersionMismatch)
+	}
+
+	warnings := validationWarnings(h.Spec)
+	warning := habv1beta1.HabitatCondition{
+		Type:   habv1beta1.HabitatConditionValidationWarning,
+		Status: apiv1.ConditionFalse,
+		Reason: reasonValid,
+	}
+	if len(warnings) > 0 {
+		warning.Status = apiv1.ConditionTrue
+		warning.Reason = reasonValidationWarning
+		warning.Message = strings.Join(warnings, "; ")
+	}
+	status.Conditions = setCondition(status.Conditions, warning, metav1.Now())
+
+	// The Events are only emitted when the warnings change, not on every
+	// reconciliation.
+	if warning.Status == apiv1.ConditionTrue && !hasConditionMessage(h.Status.Conditions, warning) {
+		for _, w := range warnings {
+			level.Warn(hc.logger).Log("msg", "Habitat might not work as expected", "name", h.Name, "warning", w)
+			hc.config.EventRecorder.Event(h, apiv1.EventTypeWarning, reasonValidationWarning, w)
+		}
 	}
 
-	// Handle creation/updating of peer IP ConfigMap.
-	if err := hc.handleConfigMap(h); err != nil {
+	if reflect.DeepEqual(h.Status, status) {
+		return nil
+	}
+
+	hCopy := stored.DeepCopy()
+	hCopy.Status = status
+
+	if hc.dryRun("update status", hCopy) {
+		return nil
+	}
+
+	habitats, cancel := hc.habitatClient(ctx)
+	defer cancel()
+
+	_, err := habitats.Habitats(h.Namespace).UpdateStatus(hCopy)
+	// Without the CustomResourceSubresources feature gate, the status is
+	// part of the Habitat.
+	if apierrors.IsNotFound(err) {
+		_, err = habitats.Habitats(h.Namespace).Update(hCopy)
+	}
+	if err != nil {
 		return err
 	}
 
+	level.Debug(hc.logger).Log("msg", "updated Habitat status", "name", h.Name, "ready", status.ReadyReplicas)
+
 	return nil
 }
 
+// reconcileConditions returns the conditions with the ones describing the
+// outcome of the reconciliation of h set. ready is the amount of ready Pods,
+// and failure the error that stopped the reconciliation, if any.
+func (hc *HabitatController) reconcileConditions(h *habv1beta1.Habitat, conditions []habv1beta1.HabitatCondition, ready int, failure error, now metav1.Time) []habv1beta1.HabitatCondition {
+	vErr, invalid := failure.(validationError)
+	cErr, conflict := failure.(nameConflictError)
+
+	validation := habv1beta1.HabitatCondition{
+		Type:   habv1beta1.HabitatConditionValidationFailed,
+		Status: apiv1.ConditionFalse,
+		Reason: reasonValid,
+	}
+	if invalid {
+		validation.Status = apiv1.ConditionTrue
+		validation.Reason = reasonValidationFailed
+		validation.Message = vErr.Error()
+	}
+	conditions = setCondition(conditions, validation, now)
+
+	// The name conflict is only checked once the Habitat is valid.
+	if conflict {
+		conditions = setCondition(conditions, habv1beta1.HabitatCondition{
+			Type:    habv1beta1.HabitatConditionNameConflict,
+			Status:  apiv1.ConditionTrue,
+			Reason:  reasonNameConflict,
+			Message: cErr.Error(),
+		}, now)
+	} else if !invalid && hasConditionType(conditions, habv1beta1.HabitatConditionNameConflict) {
+		conditions = setCondition(conditions, habv1beta1.HabitatCondition{
+			Type:   habv1beta1.HabitatConditionNameConflict,
+			Status: apiv1.ConditionFalse,
+		}, now)
+	}
+
+	available := habv1beta1.HabitatCondition{
+		Type:    habv1beta1.HabitatConditionAvailable,
+		Status:  apiv1.ConditionTrue,
+		Reason:  reasonMinimumReplicasAvailable,
+		Message: fmt.Sprintf("%d of %d Pods are ready", ready, h.Spec.Count),
+	}
+	switch {
+	case conflict:
+		// The workload found in the cache is not the one of the Habitat.
+		available.Status = apiv1.ConditionFalse
+		available.Reason = reasonNameConflict
+		available.Message = cErr.Error()
+	case ready < h.Spec.Count:
+		available.Status = apiv1.ConditionFalse
+		available.Reason = reasonMinimumReplicasUnavailable
+	}
+	conditions = setCondition(conditions, available, now)
+
+	deploymentAvailable := available
+	deploymentAvailable.Type = habv1beta1.HabitatConditionDeploymentAvailable
+	conditions = setCondition(conditions, deploymentAvailable, now)
+
+	cm := habv1beta1.HabitatCondition{
+		Type:   habv1beta1.HabitatConditionConfigMapReady,
+		Status: apiv1.ConditionTrue,
+		Reason: reasonConfigMapCreated,
+	}
+	if _, err := hc.findConfigMapInCache(newConfigMap("", h)); err != nil {
+		cm.Status = apiv1.ConditionFalse
+		cm.Reason = reasonMissingConfigMap
+		cm.Message = fmt.Sprintf("ConfigMap %s containing the peer file does not exist", peerConfigMapName(h))
+	}
+	conditions = setCondition(conditions, cm, now)
+
+	return conditions
+}
+
+// supervisorVersionMismatch returns true if any Pod of the Habitat failed to
+// start because its image doesn't contain the requested supervisor version,
+// according to the cache.
+func (hc *HabitatController) supervisorVersionMismatch(h *habv1beta1.Habitat) bool {
+	for _, obj := range hc.podInformer.GetStore().List() {
+		pod, ok := obj.(*apiv1.Pod)
+		if !ok || pod.Namespace != h.Namespace || pod.Labels[habv1beta1.HabitatNameLabel] != habitatLabelValue(h) {
+			continue
+		}
+
+		if supervisorVersionCheckFailed(pod) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// supervisorVersionCheckFailed returns true if the init container checking
+// the supervisor version of the Pod failed, now or before being restarted.
+func supervisorVersionCheckFailed(pod *apiv1.Pod) bool {
+	for _, s := range pod.Status.InitContainerStatuses {
+		if s.Name != supervisorVersionContainerName {
+			continue
+		}
+
+		for _, t := range []*apiv1.ContainerStateTerminated{s.State.Terminated, s.LastTerminationState.Terminated} {
+			if t != nil && t.ExitCode != 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// workloadStore returns the kind of the workload running the Habitat, and the
+// cache it's in.
+func (hc *HabitatController) workloadStore(h *habv1beta1.Habitat) (string, cache.Store) {
+	switch h.Spec.Kind {
+	case habv1beta1.WorkloadKindStatefulSet:
+		return "StatefulSet", hc.stsInformer.GetStore()
+	case habv1beta1.WorkloadKindJob:
+		return "Job", hc.jobInformer.GetStore()
+	default:
+		return "Deployment", hc.deployInformer.GetStore()
+	}
+}
+
+// readyReplicas returns the amount of ready Pods of the workload running the
+// Habitat, according to the cache. For Jobs, these are the Pods that are
+// running or have completed.
+func (hc *HabitatController) readyReplicas(h *habv1beta1.Habitat) int {
+	key := fmt.Sprintf("%s/%s", h.Namespace, workloadName(h))
+
+	switch h.Spec.Kind {
+	case habv1beta1.WorkloadKindStatefulSet:
+		obj, exists, err := hc.stsInformer.GetStore().GetByKey(key)
+		if err != nil || !exists {
+			return 0
+		}
+
+		return int(obj.(*appsv1.StatefulSet).Status.ReadyReplicas)
+	case habv1beta1.WorkloadKindJob:
+		obj, exists, err := hc.jobInformer.GetStore().GetByKey(key)
+		if err != nil || !exists {
+			return 0
+		}
+
+		j := obj.(*batchv1.Job)
+
+		return int(j.Status.Active + j.Status.Succeeded)
+	default:
+		obj, exists, err := hc.deployInformer.GetStore().GetByKey(key)
+		if err != nil || !exists {
+			return 0
+		}
+
+		return int(obj.(*appsv1.Deployment).Status.ReadyReplicas)
+	}
+}
+
+// habitatPhase returns the phase of a Habitat with the given amount of ready
+// and desired Services. While scaling down, there can momentarily be more
+// ready Services than desired, which still means that the Habitat is running.
+func habitatPhase(ready, desired int) habv1beta1.HabitatPhase {
+	if ready >= desired {
+		return habv1beta1.HabitatPhaseRunning
+	}
+
+	return habv1beta1.HabitatPhasePending
+}
+
 func (hc *HabitatController) habitatNeedsUpdate(oldHabitat, newHabitat *habv1beta1.Habitat) bool {
-	if reflect.DeepEqual(oldHabitat.Spec, newHabitat.Spec) {
-		level.Debug(hc.logger).Log("msg", "Update ignored as it didn't change Habitat spec", "h", newHabitat)
+	// Deletions are only noticed as updates while the finalizer is present.
+	if newHabitat.DeletionTimestamp != nil {
+		return true
+	}
+
+	// The labels and annotations are propagated to the Pods.
+	if reflect.DeepEqual(oldHabitat.Spec, newHabitat.Spec) &&
+		reflect.DeepEqual(oldHabitat.Labels, newHabitat.Labels) &&
+		reflect.DeepEqual(oldHabitat.Annotations, newHabitat.Annotations) {
+		level.Debug(hc.logger).Log("msg", "Update ignored as it didn't change Habitat spec or metadata", "h", newHabitat)
 		return false
 	}
 
 	return true
 }
 
+// deploymentNeedsUpdate returns true if the desired Deployment differs from
+// the one currently running in the cluster.
+func deploymentNeedsUpdate(current, desired *appsv1.Deployment) bool {
+	if current.Annotations[specHashAnnotation] != desired.Annotations[specHashAnnotation] {
+		return true
+	}
+
+	// Deployments created by older versions of the operator lack the label.
+	if current.Labels[habv1beta1.CreatedByLabel] != desired.Labels[habv1beta1.CreatedByLabel] {
+		return true
+	}
+
+	if annotationsChanged(current.Annotations, desired.Annotations) {
+		return true
+	}
+
+	return workloadDrifted(current.Spec.Replicas, desired.Spec.Replicas, &current.Spec.Template, &desired.Spec.Template)
+}
+
+// workloadDrifted returns true if a workload has been changed out-of-band,
+// e.g. scaled manually. Only the fields users are most likely to change are
+// compared, as the workload has been defaulted by the API server.
+func workloadDrifted(currentReplicas, desiredReplicas *int32, current, desired *apiv1.PodTemplateSpec) bool {
+	if currentReplicas == nil || *currentReplicas != *desiredReplicas {
+		return true
+	}
+
+	if len(current.Spec.Containers) != len(desired.Spec.Containers) {
+		return true
+	}
+
+	for i, c := range desired.Spec.Containers {
+		if current.Spec.Containers[i].Name != c.Name || current.Spec.Containers[i].Image != c.Image {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (hc *HabitatController) podNeedsUpdate(oldPod, newPod *apiv1.Pod) bool {
 	// Ignore identical objects.
 	// https://github.com/kubernetes/kubernetes/blob/7e630154dfc7b2155f8946a06f92e96e268dcbcd/pkg/controller/replicaset/replica_set.go#L276-L277
@@ -874,8 +2819,11 @@ func (hc *HabitatController) podNeedsUpdate(oldPod, newPod *apiv1.Pod) bool {
 		return false
 	}
 
-	// Ignore changes that don't change the Pod's status.
-	if oldPod.Status.Phase == newPod.Status.Phase {
+	// Ignore changes that don't change the Pod's status or IP. The IP matters,
+	// as the Pod might be the one in the peer file. Pods failing the supervisor
+	// version check don't change phase.
+	if oldPod.Status.Phase == newPod.Status.Phase && oldPod.Status.PodIP == newPod.Status.PodIP &&
+		supervisorVersionCheckFailed(oldPod) == supervisorVersionCheckFailed(newPod) {
 		level.Debug(hc.logger).Log("msg", "Update ignored as it didn't change Pod status", "pod", newPod)
 		return false
 	}
@@ -889,20 +2837,35 @@ func (hc *HabitatController) getHabitatFromLabeledResource(r metav1.Object) (*ha
 		return nil, err
 	}
 
-	obj, exists, err := hc.habInformer.GetStore().GetByKey(key)
+	h, err := hc.findHabitatByLabel(r.GetNamespace(), r.GetLabels()[habv1beta1.HabitatNameLabel])
+	if apierrors.IsNotFound(err) {
+		return nil, keyNotFoundError{key: key}
+	}
+
+	return h, err
+}
+
+// findHabitatByLabel returns the Habitat whose objects carry the given value
+// of the HabitatNameLabel, according to the cache. It's the name of the
+// Habitat, unless the name was shortened.
+func (hc *HabitatController) findHabitatByLabel(ns, value string) (*habv1beta1.Habitat, error) {
+	h, err := hc.habLister.Habitats(ns).Get(value)
+	if !apierrors.IsNotFound(err) || !shortNameRegexp.MatchString(value) {
+		return h, err
+	}
+
+	habitats, err := hc.habLister.Habitats(ns).List(labels.Everything())
 	if err != nil {
 		return nil, err
 	}
-	if !exists {
-		return nil, keyNotFoundError{key: key}
-	}
 
-	h, ok := obj.(*habv1beta1.Habitat)
-	if !ok {
-		return nil, fmt.Errorf("unknown object type in Habitat cache: %v", obj)
+	for _, h := range habitats {
+		if habitatLabelValue(h) == value {
+			return h, nil
+		}
 	}
 
-	return h, nil
+	return nil, apierrors.NewNotFound(habv1beta1.Resource("habitats"), value)
 }
 
 // habitatKeyFromLabeledResource returns a Store key for any resource tagged
@@ -918,17 +2881,23 @@ func habitatKeyFromLabeledResource(r metav1.Object) (string, error) {
 	return key, nil
 }
 
-func newConfigMap(ip string, h *habv1beta1.Habitat) *apiv1.ConfigMap {
+// newConfigMap returns the peer IP ConfigMap for the Habitat's ring.
+// The ConfigMap is shared by all Habitats of the ring in a namespace, so it
+// deliberately has no OwnerReferences: it must not be garbage collected
+// together with the Deployment of any single Habitat.
+func newConfigMap(peers string, h *habv1beta1.Habitat) *apiv1.ConfigMap {
 	return &apiv1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      configMapName,
+			Name:      peerConfigMapName(h),
 			Namespace: h.Namespace,
 			Labels: map[string]string{
-				habv1beta1.HabitatLabel: "true",
+				habv1beta1.HabitatLabel:   "true",
+				habv1beta1.CreatedByLabel: habv1beta1.CreatedBy,
 			},
+			Annotations: operatorAnnotations(),
 		},
 		Data: map[string]string{
-			peerFile: ip,
+			peerFile: peers,
 		},
 	}
 }
@@ -954,3 +2923,21 @@ func (hc *HabitatController) findConfigMapInCache(cm *apiv1.ConfigMap) (*apiv1.C
 
 	return obj.(*apiv1.ConfigMap), nil
 }
+
+func (hc *HabitatController) findDeploymentInCache(d *appsv1.Deployment) (*appsv1.Deployment, error) {
+	k, err := cache.MetaNamespaceKeyFunc(d)
+	if err != nil {
+		level.Error(hc.logger).Log("msg", "Deployment key could not be retrieved", "name", d)
+		return nil, err
+	}
+
+	obj, exists, err := hc.deployInformer.GetStore().GetByKey(k)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, keyNotFoundError{key: k}
+	}
+
+	return obj.(*appsv1.Deployment), nil
+}
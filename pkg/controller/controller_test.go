@@ -0,0 +1,2271 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	habclientset "github.com/kinvolk/habitat-operator/pkg/client/clientset/versioned"
+	hablisters "github.com/kinvolk/habitat-operator/pkg/client/listers/habitat/v1beta1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestWorkloadSelectorIsUniquePerHabitat(t *testing.T) {
+	hc := &HabitatController{}
+
+	newHabitat := func(name string) *habv1beta1.Habitat {
+		return &habv1beta1.Habitat{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+		}
+	}
+
+	foo := newHabitat("foo")
+	bar := newHabitat("bar")
+
+	d, err := hc.newDeployment(context.Background(), foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(d.Spec.Selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !selector.Matches(labels.Set(d.Spec.Template.Labels)) {
+		t.Errorf("selector %s doesn't match the Pods of its own Habitat", selector)
+	}
+
+	other, err := hc.newPodTemplate(context.Background(), bar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if selector.Matches(labels.Set(other.Labels)) {
+		t.Errorf("selector %s matches the Pods of another Habitat", selector)
+	}
+}
+
+func TestLongHabitatNameIsShortened(t *testing.T) {
+	hc := &HabitatController{}
+	minAvailable := int32(1)
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: strings.Repeat("a", 70), Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:        1,
+			Service:      habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			MinAvailable: &minAvailable,
+			Expose:       &habv1beta1.Expose{},
+		},
+	}
+	owner := metav1.OwnerReference{}
+
+	d, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := newService(h, owner)
+	exposed := newExposedService(h, owner)
+	pdb := newPodDisruptionBudget(h, owner)
+
+	for _, name := range []string{d.Name, svc.Name, exposed.Name, pdb.Name, userConfigMapName(h)} {
+		if msgs := validation.IsDNS1123Label(name); len(msgs) > 0 {
+			t.Errorf("expected %q to be a DNS label: %v", name, msgs)
+		}
+	}
+
+	for _, l := range []map[string]string{
+		d.Labels,
+		d.Spec.Selector.MatchLabels,
+		d.Spec.Template.Labels,
+		svc.Labels,
+		svc.Spec.Selector,
+		exposed.Labels,
+		exposed.Spec.Selector,
+		pdb.Labels,
+	} {
+		for k, v := range l {
+			if msgs := validation.IsValidLabelValue(v); len(msgs) > 0 {
+				t.Errorf("expected the value %q of label %s to be valid: %v", v, k, msgs)
+			}
+		}
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	indexer.Add(h)
+	hc.habLister = hablisters.NewHabitatLister(indexer)
+
+	found, err := hc.findHabitatByLabel(h.Namespace, d.Labels[habv1beta1.HabitatNameLabel])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != h.Name {
+		t.Errorf("expected the label to lead to Habitat %s, got %s", h.Name, found.Name)
+	}
+}
+
+func TestFindHabitatByShortenedLabel(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	hc := &HabitatController{habLister: hablisters.NewHabitatLister(indexer)}
+
+	for _, name := range []string{
+		strings.Repeat("a", 70),
+		// The dash before the hash is trimmed, so the label value is shorter
+		// than a DNS label.
+		strings.Repeat("a", 53) + "-" + strings.Repeat("b", 16),
+	} {
+		h := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		indexer.Add(h)
+
+		found, err := hc.findHabitatByLabel(h.Namespace, habitatLabelValue(h))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if found.Name != name {
+			t.Errorf("%s: expected the label to lead to the Habitat, got %s", name, found.Name)
+		}
+	}
+}
+
+func TestDeploymentNeedsUpdate(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:                 2,
+			Image:                 "foo/bar",
+			Service:               habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			DeploymentAnnotations: map[string]string{"argocd.argoproj.io/sync-wave": "1"},
+		},
+	}
+
+	desired, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]string{"argocd.argoproj.io/sync-wave": "1", managedByAnnotation: habv1beta1.CreatedBy, operatorVersionAnnotation: "unknown"} {
+		if desired.Annotations[k] != v {
+			t.Errorf("expected the Deployment to be annotated with %s=%s, got %v", k, v, desired.Annotations)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(d *appsv1.Deployment)
+		update bool
+	}{
+		{
+			name:   "unchanged",
+			mutate: func(d *appsv1.Deployment) {},
+		},
+		{
+			name: "defaulted by the API server",
+			mutate: func(d *appsv1.Deployment) {
+				d.Spec.Template.Spec.RestartPolicy = apiv1.RestartPolicyAlways
+			},
+		},
+		{
+			name: "spec changed",
+			mutate: func(d *appsv1.Deployment) {
+				d.Annotations[specHashAnnotation] = "outdated"
+			},
+			update: true,
+		},
+		{
+			name: "annotations added by others",
+			mutate: func(d *appsv1.Deployment) {
+				d.Annotations["deployment.kubernetes.io/revision"] = "2"
+			},
+		},
+		{
+			name: "annotations changed",
+			mutate: func(d *appsv1.Deployment) {
+				d.Annotations["argocd.argoproj.io/sync-wave"] = "0"
+			},
+			update: true,
+		},
+		{
+			name: "created by another version of the operator",
+			mutate: func(d *appsv1.Deployment) {
+				d.Annotations[operatorVersionAnnotation] = "0.3.0"
+			},
+			update: true,
+		},
+		{
+			name: "scaled manually",
+			mutate: func(d *appsv1.Deployment) {
+				replicas := int32(5)
+				d.Spec.Replicas = &replicas
+			},
+			update: true,
+		},
+		{
+			name: "image changed manually",
+			mutate: func(d *appsv1.Deployment) {
+				d.Spec.Template.Spec.Containers[0].Image = "foo/baz"
+			},
+			update: true,
+		},
+	}
+
+	for _, tt := range tests {
+		current := desired.DeepCopy()
+		tt.mutate(current)
+
+		if u := deploymentNeedsUpdate(current, desired); u != tt.update {
+			t.Errorf("%s: expected update to be %t, got %t", tt.name, tt.update, u)
+		}
+	}
+
+	// The annotations removed from the Habitat are removed from the
+	// Deployment.
+	current := desired.DeepCopy()
+	h.Spec.DeploymentAnnotations = nil
+
+	desired, err = hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !deploymentNeedsUpdate(current, desired) {
+		t.Error("expected the removal of an annotation to update the Deployment")
+	}
+	for _, k := range []string{"argocd.argoproj.io/sync-wave", deploymentAnnotationsAnnotation} {
+		if _, ok := desired.Annotations[k]; ok {
+			t.Errorf("expected the Deployment not to be annotated with %s, got %v", k, desired.Annotations)
+		}
+	}
+}
+
+func TestDeploymentFollowsHabitatSpec(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Image:   "foo/bar",
+			Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+
+	var updated *appsv1.Deployment
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+
+		updated = &appsv1.Deployment{}
+		if err := json.NewDecoder(r.Body).Decode(updated); err != nil {
+			t.Errorf("could not decode Deployment: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(updated)
+	}))
+	defer srv.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{
+		config: Config{
+			KubernetesClientset: clientset,
+			EventRecorder:       record.NewFakeRecorder(10),
+		},
+		logger:         log.NewNopLogger(),
+		deployInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.Deployment{}, 0, cache.Indexers{}),
+	}
+
+	current, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.deployInformer.GetStore().Add(current)
+
+	// Resyncs of an unchanged Habitat don't touch the Deployment.
+	if _, err := hc.handleDeployment(context.Background(), h); err != nil {
+		t.Fatal(err)
+	}
+	if updated != nil {
+		t.Fatal("expected the up to date Deployment not to be updated")
+	}
+
+	h.Spec.Count = 3
+	h.Spec.Image = "foo/bar:2"
+	if _, err := hc.handleDeployment(context.Background(), h); err != nil {
+		t.Fatal(err)
+	}
+	if updated == nil {
+		t.Fatal("expected the Deployment to be updated")
+	}
+
+	if r := updated.Spec.Replicas; r == nil || *r != 3 {
+		t.Errorf("expected the Deployment to be scaled to 3 replicas, got %v", r)
+	}
+	if image := updated.Spec.Template.Spec.Containers[0].Image; image != h.Spec.Image {
+		t.Errorf("expected the Deployment to run image %s, got %s", h.Spec.Image, image)
+	}
+}
+
+func TestDeploymentHistoryAndDeadline(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Image:   "foo/bar",
+			Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+
+	current, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l := current.Spec.RevisionHistoryLimit; l == nil || *l != defaultRevisionHistoryLimit {
+		t.Errorf("expected default revision history limit of %d, got %v", defaultRevisionHistoryLimit, l)
+	}
+	if d := current.Spec.ProgressDeadlineSeconds; d == nil || *d != defaultProgressDeadlineSeconds {
+		t.Errorf("expected default progress deadline of %d seconds, got %v", defaultProgressDeadlineSeconds, d)
+	}
+
+	h.Spec.RevisionHistoryLimit = int32Ptr(2)
+	h.Spec.ProgressDeadlineSeconds = int32Ptr(120)
+
+	desired, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !deploymentNeedsUpdate(current, desired) {
+		t.Fatal("expected a change of revision history limit and progress deadline to update the Deployment")
+	}
+
+	// The Deployment is updated, and reconciled again.
+	updated := desired.DeepCopy()
+	if *updated.Spec.RevisionHistoryLimit != 2 || *updated.Spec.ProgressDeadlineSeconds != 120 {
+		t.Errorf("expected custom revision history limit and progress deadline, got %v and %v", *updated.Spec.RevisionHistoryLimit, *updated.Spec.ProgressDeadlineSeconds)
+	}
+	if deploymentNeedsUpdate(updated, desired) {
+		t.Error("expected updated Deployment to be up to date")
+	}
+}
+
+func TestJob(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   2,
+			Image:   "foo/bar",
+			Kind:    habv1beta1.WorkloadKindJob,
+			Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+
+	current, err := hc.newJob(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := current.Spec.Template.Spec.RestartPolicy; p != apiv1.RestartPolicyOnFailure {
+		t.Errorf("expected default restart policy %s, got %s", apiv1.RestartPolicyOnFailure, p)
+	}
+	if current.Spec.BackoffLimit != nil {
+		t.Errorf("expected the backoff limit to be left to the default, got %d", *current.Spec.BackoffLimit)
+	}
+	if *current.Spec.Parallelism != 2 || *current.Spec.Completions != 2 {
+		t.Errorf("expected 2 Pods to run to completion, got parallelism %d and completions %d", *current.Spec.Parallelism, *current.Spec.Completions)
+	}
+	// The selector is generated by the API server.
+	if current.Spec.Selector != nil {
+		t.Errorf("expected no selector, got %v", current.Spec.Selector)
+	}
+
+	h.Spec.BackoffLimit = int32Ptr(1)
+	h.Spec.RestartPolicy = apiv1.RestartPolicyNever
+
+	desired, err := hc.newJob(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *desired.Spec.BackoffLimit != 1 || desired.Spec.Template.Spec.RestartPolicy != apiv1.RestartPolicyNever {
+		t.Errorf("expected custom backoff limit and restart policy, got %d and %s", *desired.Spec.BackoffLimit, desired.Spec.Template.Spec.RestartPolicy)
+	}
+	if !jobNeedsUpdate(current, desired) {
+		t.Error("expected a change of backoff limit and restart policy to replace the Job")
+	}
+	if jobNeedsUpdate(desired, desired.DeepCopy()) {
+		t.Error("expected the replaced Job to be up to date")
+	}
+}
+
+func TestJobAnnotationsArePatched(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:                 1,
+			Image:                 "foo/bar",
+			Kind:                  habv1beta1.WorkloadKindJob,
+			Service:               habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			DeploymentAnnotations: map[string]string{"old": "value"},
+		},
+	}
+
+	var patch map[string]map[string]map[string]*string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/apis/batch/v1/namespaces/default/jobs/"+workloadName(h) {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			t.Errorf("could not decode patch: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: workloadName(h), Namespace: h.Namespace}})
+	}))
+	defer srv.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{
+		config:      Config{KubernetesClientset: clientset},
+		logger:      log.NewNopLogger(),
+		jobInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &batchv1.Job{}, 0, cache.Indexers{}),
+	}
+
+	current, err := hc.newJob(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.jobInformer.GetStore().Add(current)
+
+	if _, err := hc.handleJob(context.Background(), h); err != nil {
+		t.Fatal(err)
+	}
+	if patch != nil {
+		t.Fatal("expected the up to date Job not to be patched")
+	}
+
+	h.Spec.DeploymentAnnotations = map[string]string{"new": "value"}
+	ref, err := hc.handleJob(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref == nil {
+		t.Error("expected the Job not to be replaced for a change of annotations")
+	}
+	if patch == nil {
+		t.Fatal("expected the annotations of the Job to be patched")
+	}
+
+	annotations := patch["metadata"]["annotations"]
+	if v := annotations["new"]; v == nil || *v != "value" {
+		t.Errorf("expected the patch to add the new annotation, got %v", v)
+	}
+	if v, ok := annotations["old"]; !ok || v != nil {
+		t.Errorf("expected the patch to remove the old annotation, got %v", v)
+	}
+}
+
+func TestHabitatMetadataPropagatesToPods(t *testing.T) {
+	hc := &HabitatController{logger: log.NewNopLogger()}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "default",
+			Labels: map[string]string{
+				"team":                      "ops",
+				habv1beta1.HabitatNameLabel: "bar",
+			},
+			Annotations: map[string]string{
+				"owner":                           "ops@example.com",
+				apiv1.LastAppliedConfigAnnotation: "{}",
+			},
+		},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Image:   "foo/bar",
+			Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+
+	current, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := current.Spec.Template
+	if template.Labels["team"] != "ops" || template.Annotations["owner"] != "ops@example.com" {
+		t.Errorf("expected Habitat metadata on the Pods, got labels %v and annotations %v", template.Labels, template.Annotations)
+	}
+	if l := template.Labels[habv1beta1.HabitatNameLabel]; l != "foo" {
+		t.Errorf("expected operator label not to be overridden, got %s", l)
+	}
+	if _, ok := template.Annotations[apiv1.LastAppliedConfigAnnotation]; ok {
+		t.Error("expected last applied configuration not to be copied to the Pods")
+	}
+
+	updated := h.DeepCopy()
+	delete(updated.Labels, "team")
+	if !hc.habitatNeedsUpdate(h, updated) {
+		t.Fatal("expected removal of a label to be handled")
+	}
+
+	desired, err := hc.newDeployment(context.Background(), updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := desired.Spec.Template.Labels["team"]; ok {
+		t.Error("expected removed label to be removed from the Pods")
+	}
+	if !deploymentNeedsUpdate(current, desired) {
+		t.Error("expected removal of a label to update the Deployment")
+	}
+}
+
+func TestEnvChangeTriggersUpdate(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Image:   "foo/bar",
+			Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+
+	current, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.Spec.Env = []apiv1.EnvVar{{Name: "HAB_LICENSE", Value: "accept-no-persist"}}
+
+	desired, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if env := desired.Spec.Template.Spec.Containers[0].Env; len(env) != 1 || env[0].Name != "HAB_LICENSE" {
+		t.Errorf("expected HAB_LICENSE to be set in the container, got %v", env)
+	}
+
+	if !deploymentNeedsUpdate(current, desired) {
+		t.Error("expected a change of env to update the Deployment")
+	}
+}
+
+func TestDNSChangeTriggersUpdate(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Image:   "foo/bar",
+			Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+
+	current, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.Spec.DNSPolicy = apiv1.DNSNone
+	h.Spec.DNSConfig = &apiv1.PodDNSConfig{Nameservers: []string{"10.0.0.53"}}
+	h.Spec.HostAliases = []apiv1.HostAlias{{IP: "10.0.1.10", Hostnames: []string{"db.example.com"}}}
+
+	desired, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := desired.Spec.Template.Spec
+	if spec.DNSPolicy != h.Spec.DNSPolicy {
+		t.Errorf("expected DNS policy %q, got %q", h.Spec.DNSPolicy, spec.DNSPolicy)
+	}
+	if !reflect.DeepEqual(spec.DNSConfig, h.Spec.DNSConfig) {
+		t.Errorf("expected DNS config %v, got %v", h.Spec.DNSConfig, spec.DNSConfig)
+	}
+	if !reflect.DeepEqual(spec.HostAliases, h.Spec.HostAliases) {
+		t.Errorf("expected host aliases %v, got %v", h.Spec.HostAliases, spec.HostAliases)
+	}
+
+	if !deploymentNeedsUpdate(current, desired) {
+		t.Error("expected a change of DNS settings to update the Deployment")
+	}
+}
+
+func TestPodTemplateHostNetwork(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:       3,
+			Image:       "foo/bar",
+			Service:     habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			HostNetwork: true,
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !template.Spec.HostNetwork {
+		t.Error("expected the Pods to use the host network")
+	}
+	if template.Spec.DNSPolicy != apiv1.DNSClusterFirstWithHostNet {
+		t.Errorf("expected DNS policy %q, got %q", apiv1.DNSClusterFirstWithHostNet, template.Spec.DNSPolicy)
+	}
+	if w := validationWarnings(h.Spec); len(w) != 1 {
+		t.Errorf("expected a warning about the ports bound on the node, got %v", w)
+	}
+
+	// An explicit DNS policy is kept.
+	h.Spec.DNSPolicy = apiv1.DNSDefault
+	template, err = hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.Spec.DNSPolicy != apiv1.DNSDefault {
+		t.Errorf("expected DNS policy %q, got %q", apiv1.DNSDefault, template.Spec.DNSPolicy)
+	}
+
+	h.Spec.Count = 1
+	if w := validationWarnings(h.Spec); len(w) != 0 {
+		t.Errorf("expected no warnings with a single Pod, got %v", w)
+	}
+}
+
+func TestPodTemplateListenPorts(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:    1,
+			Image:    "foo/bar",
+			Service:  habv1beta1.Service{Name: "foo", Topology: habv1beta1.TopologyStandalone},
+			Services: []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The defaults are left implicit.
+	if args := strings.Join(template.Spec.Containers[0].Args, " "); strings.Contains(args, "--listen") {
+		t.Errorf("expected no listen args with the default ports, got %q", args)
+	}
+	if _, ok := template.Annotations[gossipPortAnnotation]; ok {
+		t.Errorf("expected no gossip port annotation with the default port")
+	}
+
+	h.Spec.GossipListenPort = 19638
+	h.Spec.HTTPListenPort = 19631
+
+	template, err = hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	main, redis := template.Spec.Containers[0], template.Spec.Containers[1]
+	if args := strings.Join(main.Args, " "); !strings.Contains(args, "--listen-gossip 0.0.0.0:19638 --listen-http 0.0.0.0:19631") {
+		t.Errorf("expected the custom listen ports in the args, got %q", args)
+	}
+	if args := strings.Join(redis.Args, " "); !strings.Contains(args, "--listen-gossip 0.0.0.0:19738 --listen-http 0.0.0.0:19731 --peer 127.0.0.1:19638") {
+		t.Errorf("expected the additional service to listen on the shifted ports, got %q", args)
+	}
+	if p := main.ReadinessProbe.HTTPGet.Port.IntValue(); p != 19631 {
+		t.Errorf("expected the probes to check port 19631, got %d", p)
+	}
+	if p := template.Annotations[gossipPortAnnotation]; p != "19638" {
+		t.Errorf("expected the gossip port annotation to be 19638, got %q", p)
+	}
+
+	pod := apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: template.Annotations},
+		Status:     apiv1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	if peers := choosePeerIPs("", []apiv1.Pod{pod}, 1); peers != "10.0.0.1:19638" {
+		t.Errorf("expected the peer file to contain the gossip port, got %q", peers)
+	}
+}
+
+func TestPodsWaitingForIP(t *testing.T) {
+	hc := &HabitatController{
+		podInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Pod{}, 0, cache.Indexers{ringIndex: podRingIndexFunc}),
+	}
+	h := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}}
+
+	pod := func(name, habitat, node, ip string) *apiv1.Pod {
+		return &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels:    map[string]string{habv1beta1.HabitatLabel: "true", habv1beta1.HabitatNameLabel: habitat},
+			},
+			Spec:   apiv1.PodSpec{NodeName: node},
+			Status: apiv1.PodStatus{PodIP: ip},
+		}
+	}
+
+	indexer := hc.podInformer.GetIndexer()
+	indexer.Add(pod("db-0", "db", "node-1", "10.0.0.1"))
+	// Unscheduled Pods may wait for a node for a long time.
+	indexer.Add(pod("db-1", "db", "", ""))
+	// Pods of other Habitats of the ring don't matter.
+	indexer.Add(pod("web-0", "web", "node-1", ""))
+
+	if hc.podsWaitingForIP(h) {
+		t.Error("expected no Pod of the Habitat to be waiting for an IP")
+	}
+
+	indexer.Add(pod("db-2", "db", "node-2", ""))
+	if !hc.podsWaitingForIP(h) {
+		t.Error("expected a scheduled Pod without IP to be waiting for an IP")
+	}
+}
+
+func TestChoosePeerIPFollowsPodChurn(t *testing.T) {
+	pod := func(ip string) apiv1.Pod {
+		return apiv1.Pod{Status: apiv1.PodStatus{PodIP: ip}}
+	}
+
+	// Each step is the set of running Pods after some churn, and the peer
+	// expected to be in the peer file afterwards.
+	steps := []struct {
+		name    string
+		running []apiv1.Pod
+		peer    string
+	}{
+		{
+			name:    "first Pod started",
+			running: []apiv1.Pod{pod("10.0.0.1")},
+			peer:    "10.0.0.1",
+		},
+		{
+			name:    "second Pod started",
+			running: []apiv1.Pod{pod("10.0.0.2"), pod("10.0.0.1")},
+			peer:    "10.0.0.1",
+		},
+		{
+			name:    "peer Pod deleted",
+			running: []apiv1.Pod{pod("10.0.0.2")},
+			peer:    "10.0.0.2",
+		},
+		{
+			name:    "peer Pod restarted with a new IP",
+			running: []apiv1.Pod{pod("10.0.0.3"), pod("10.0.0.4")},
+			peer:    "10.0.0.3",
+		},
+		{
+			name: "all Pods gone",
+			peer: "",
+		},
+		{
+			name:    "Pod started again",
+			running: []apiv1.Pod{pod("10.0.0.5")},
+			peer:    "10.0.0.5",
+		},
+	}
+
+	peer := ""
+	for _, s := range steps {
+		peer = choosePeerIPs(peer, s.running, 1)
+		if peer != s.peer {
+			t.Fatalf("%s: expected peer %q, got %q", s.name, s.peer, peer)
+		}
+	}
+}
+
+func TestChoosePeerIPsKeepsRunningPeers(t *testing.T) {
+	pod := func(ip string) apiv1.Pod {
+		return apiv1.Pod{Status: apiv1.PodStatus{PodIP: ip}}
+	}
+
+	tests := []struct {
+		name    string
+		current string
+		running []apiv1.Pod
+		peers   string
+	}{
+		{
+			name:    "fewer running Pods than max",
+			running: []apiv1.Pod{pod("10.0.0.1"), pod("10.0.0.2")},
+			peers:   "10.0.0.1\n10.0.0.2",
+		},
+		{
+			name:    "more running Pods than max",
+			running: []apiv1.Pod{pod("10.0.0.1"), pod("10.0.0.2"), pod("10.0.0.3"), pod("10.0.0.4")},
+			peers:   "10.0.0.1\n10.0.0.2\n10.0.0.3",
+		},
+		{
+			name:    "peers still running",
+			current: "10.0.0.4\n10.0.0.3",
+			running: []apiv1.Pod{pod("10.0.0.1"), pod("10.0.0.2"), pod("10.0.0.3"), pod("10.0.0.4")},
+			peers:   "10.0.0.4\n10.0.0.3\n10.0.0.1",
+		},
+		{
+			name:    "peer replaced",
+			current: "10.0.0.1\n10.0.0.2\n10.0.0.3",
+			running: []apiv1.Pod{pod("10.0.0.1"), pod("10.0.0.3"), pod("10.0.0.5")},
+			peers:   "10.0.0.1\n10.0.0.3\n10.0.0.5",
+		},
+		{
+			name:    "no running Pods",
+			current: "10.0.0.1",
+			peers:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		if peers := choosePeerIPs(tt.current, tt.running, 3); peers != tt.peers {
+			t.Errorf("%s: expected peers %q, got %q", tt.name, tt.peers, peers)
+		}
+	}
+}
+
+func TestRunningPodsOfRing(t *testing.T) {
+	pod := func(name, ns, ring, ip string) *apiv1.Pod {
+		p := &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ns,
+				Labels:    map[string]string{habv1beta1.HabitatLabel: "true"},
+			},
+			Status: apiv1.PodStatus{Phase: apiv1.PodRunning, PodIP: ip},
+		}
+		if ring != "" {
+			p.Labels[habv1beta1.RingLabel] = ring
+		}
+		return p
+	}
+
+	hc := &HabitatController{
+		podInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Pod{}, 0, cache.Indexers{ringIndex: podRingIndexFunc}),
+	}
+	pending := pod("db-2", "default", "payments", "")
+	pending.Status.Phase = apiv1.PodPending
+	for _, p := range []*apiv1.Pod{
+		pod("web-0", "default", "", "10.0.0.1"),
+		pod("db-0", "default", "payments", "10.0.0.2"),
+		pod("api-0", "default", "payments", "10.0.0.3"),
+		pod("db-1", "other", "payments", "10.0.0.4"),
+		pending,
+		// Running Pods may not have been assigned an IP yet.
+		pod("api-1", "default", "payments", ""),
+	} {
+		hc.podInformer.GetIndexer().Add(p)
+	}
+
+	tests := []struct {
+		name  string
+		ring  string
+		peers []string
+	}{
+		{name: "default ring", peers: []string{"web-0"}},
+		{name: "named ring", ring: "payments", peers: []string{"api-0", "db-0"}},
+		{name: "empty ring", ring: "checkout"},
+	}
+
+	for _, tt := range tests {
+		h := &habv1beta1.Habitat{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec:       habv1beta1.HabitatSpec{Ring: tt.ring},
+		}
+
+		pods, err := hc.getRunningPods(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var peers []string
+		for _, p := range pods {
+			peers = append(peers, p.Name)
+		}
+		if !reflect.DeepEqual(peers, tt.peers) {
+			t.Errorf("%s: expected peers %v, got %v", tt.name, tt.peers, peers)
+		}
+
+		template, err := hc.newPodTemplate(context.Background(), h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ring := template.Labels[habv1beta1.RingLabel]; ring != tt.ring {
+			t.Errorf("%s: expected ring label %q, got %q", tt.name, tt.ring, ring)
+		}
+		if cm := template.Spec.Volumes[0].ConfigMap.Name; cm != newConfigMap("", h).Name {
+			t.Errorf("%s: expected Pods to mount ConfigMap %q, got %q", tt.name, newConfigMap("", h).Name, cm)
+		}
+	}
+}
+
+func TestPodNeedsUpdateOnIPChange(t *testing.T) {
+	hc := &HabitatController{logger: log.NewNopLogger()}
+
+	old := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{ResourceVersion: "1"},
+		Status:     apiv1.PodStatus{Phase: apiv1.PodRunning, PodIP: "10.0.0.1"},
+	}
+	updated := old.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Status.PodIP = "10.0.0.2"
+
+	if !hc.podNeedsUpdate(old, updated) {
+		t.Error("expected a change of IP to be handled")
+	}
+}
+
+func TestPodTemplateTermination(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:    1,
+			Image:    "foo/bar",
+			Service:  habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			Services: []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := template.Spec.TerminationGracePeriodSeconds; p == nil || *p != defaultTerminationGracePeriod {
+		t.Errorf("expected default grace period of %d seconds, got %v", defaultTerminationGracePeriod, p)
+	}
+	for _, c := range template.Spec.Containers {
+		if c.Lifecycle == nil || c.Lifecycle.PreStop == nil || c.Lifecycle.PreStop.Exec == nil {
+			t.Errorf("expected default preStop hook in container %s, got %v", c.Name, c.Lifecycle)
+		}
+	}
+
+	period := int64(120)
+	h.Spec.TerminationGracePeriodSeconds = &period
+	h.Spec.PreStop = &apiv1.Handler{Exec: &apiv1.ExecAction{Command: []string{"sleep", "10"}}}
+
+	template, err = hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := template.Spec.TerminationGracePeriodSeconds; p == nil || *p != period {
+		t.Errorf("expected grace period of %d seconds, got %v", period, p)
+	}
+	for _, c := range template.Spec.Containers {
+		if c.Lifecycle == nil || c.Lifecycle.PreStop != h.Spec.PreStop {
+			t.Errorf("expected custom preStop hook in container %s, got %v", c.Name, c.Lifecycle)
+		}
+	}
+}
+
+func TestPodTemplatePeerWatchFile(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:         1,
+			Image:         "foo/bar",
+			Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			PeerWatchFile: &habv1beta1.PeerWatchFile{MountPath: "/etc/peers"},
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := template.Spec.Containers[0]
+	if !containsArgs(c.Args, "--peer-watch-file", "/etc/peers/"+defaultPeerWatchFilename) {
+		t.Errorf("expected peer watch file in /etc/peers, got args %v", c.Args)
+	}
+
+	mounted := false
+	for _, m := range c.VolumeMounts {
+		if m.Name == configVolumeName && m.MountPath == "/etc/peers" {
+			mounted = true
+		}
+	}
+	if !mounted {
+		t.Errorf("expected peer file volume to be mounted at /etc/peers, got %v", c.VolumeMounts)
+	}
+}
+
+func TestPodTemplateUpdateArgs(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:             1,
+			Image:             "foo/bar",
+			Service:           habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			Services:          []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+			HabUpdateStrategy: habv1beta1.HabUpdateStrategyRolling,
+			UpdateChannel:     "stable",
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range template.Spec.Containers {
+		if !containsArgs(c.Args, "--strategy", "rolling", "--channel", "stable") {
+			t.Errorf("expected update strategy and channel in container %s, got args %v", c.Name, c.Args)
+		}
+	}
+}
+
+func TestPodTemplateApplicationAndEnvironment(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:       1,
+			Image:       "foo/bar",
+			Service:     habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			Services:    []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+			Application: "shop",
+			Environment: "staging",
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range template.Spec.Containers {
+		if !containsArgs(c.Args, "--application", "shop", "--environment", "staging") {
+			t.Errorf("expected application and environment in container %s, got args %v", c.Name, c.Args)
+		}
+	}
+
+	if app, env := template.Labels[habv1beta1.ApplicationLabel], template.Labels[habv1beta1.EnvironmentLabel]; app != "shop" || env != "staging" {
+		t.Errorf("expected Pods to be labeled with application shop and environment staging, got %q and %q", app, env)
+	}
+}
+
+func TestPodTemplateCommand(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:          1,
+			Image:          "foo/bar",
+			Service:        habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			Command:        []string{"/bin/hab"},
+			Args:           []string{"sup", "run", "foo/bar"},
+			SupervisorArgs: []string{"--no-color"},
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := template.Spec.Containers[0]
+	if !reflect.DeepEqual(c.Command, h.Spec.Command) {
+		t.Errorf("expected command %v, got %v", h.Spec.Command, c.Command)
+	}
+	if !containsArgs(c.Args[:3], h.Spec.Args...) {
+		t.Errorf("expected args to start with %v, got %v", h.Spec.Args, c.Args)
+	}
+	if !containsArgs(c.Args, "--topology", "standalone") {
+		t.Errorf("expected the supervisor arguments set by the operator, got %v", c.Args)
+	}
+	if last := c.Args[len(c.Args)-1]; last != "--no-color" {
+		t.Errorf("expected supervisor args to come last, got %v", c.Args)
+	}
+}
+
+// containsArgs returns whether args contains the given sequence of arguments.
+func containsArgs(args []string, seq ...string) bool {
+	for i := 0; i+len(seq) <= len(args); i++ {
+		if reflect.DeepEqual(args[i:i+len(seq)], seq) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPodTemplateSecurityContext(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:    1,
+			Image:    "foo/bar",
+			Service:  habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			Services: []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sc := template.Spec.SecurityContext; sc != nil {
+		t.Errorf("expected no Pod security context by default, got %v", sc)
+	}
+	for _, c := range template.Spec.Containers {
+		sc := c.SecurityContext
+		if sc == nil || sc.Privileged == nil || *sc.Privileged || sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+			t.Errorf("expected default non-privileged security context in container %s, got %v", c.Name, sc)
+			continue
+		}
+		if caps := sc.Capabilities; caps == nil || !reflect.DeepEqual(caps.Drop, []apiv1.Capability{"ALL"}) {
+			t.Errorf("expected all capabilities to be dropped by default in container %s, got %v", c.Name, caps)
+		}
+	}
+
+	nonRoot := true
+	uid := int64(42)
+	h.Spec.SecurityContext = &apiv1.PodSecurityContext{RunAsNonRoot: &nonRoot}
+	h.Spec.ContainerSecurityContext = &apiv1.SecurityContext{RunAsUser: &uid}
+	h.Spec.Services[0].SecurityContext = &apiv1.SecurityContext{ReadOnlyRootFilesystem: &nonRoot}
+
+	template, err = hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sc := template.Spec.SecurityContext; sc != h.Spec.SecurityContext {
+		t.Errorf("expected custom Pod security context, got %v", sc)
+	}
+	if sc := template.Spec.Containers[0].SecurityContext; sc != h.Spec.ContainerSecurityContext {
+		t.Errorf("expected custom security context in the Habitat Service container, got %v", sc)
+	}
+	if sc := template.Spec.Containers[1].SecurityContext; sc != h.Spec.Services[0].SecurityContext {
+		t.Errorf("expected security context of the additional service, got %v", sc)
+	}
+}
+
+func TestPodTemplateSidecars(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:        1,
+			Image:        "foo/bar",
+			Service:      habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			Services:     []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+			Sidecars:     []apiv1.Container{{Name: "fluentd", Image: "fluentd"}},
+			Volumes:      []apiv1.Volume{{Name: "logs", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}}},
+			VolumeMounts: []apiv1.VolumeMount{{Name: "logs", MountPath: "/var/log/hab"}},
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, c := range template.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	if expected := []string{serviceContainerName, "redis", "fluentd"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected containers %v, got %v", expected, names)
+	}
+
+	if v := template.Spec.Volumes[len(template.Spec.Volumes)-1]; v.Name != "logs" {
+		t.Errorf("expected logs volume to be added to the Pods, got %v", template.Spec.Volumes)
+	}
+
+	mounts := template.Spec.Containers[0].VolumeMounts
+	if m := mounts[len(mounts)-1]; m != h.Spec.VolumeMounts[0] {
+		t.Errorf("expected logs volume to be mounted in the Habitat Service container, got %v", mounts)
+	}
+
+	h.Spec.ContainerName = "app"
+	template, err = hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := template.Spec.Containers[0].Name; name != "app" {
+		t.Errorf("expected the Habitat Service container to be named app, got %q", name)
+	}
+}
+
+func TestProbesWithGatewayAuthToken(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		Spec: habv1beta1.HabitatSpec{GatewayAuthTokenSecretName: "token"},
+	}
+
+	readiness, liveness := newProbes(h)
+	for _, p := range []*apiv1.Probe{readiness, liveness} {
+		if p.HTTPGet != nil || p.TCPSocket == nil {
+			t.Errorf("expected TCP probe when the gateway requires a token, got %v", p.Handler)
+		}
+	}
+}
+
+func TestGetHabitatFromLabeledResource(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	hc := &HabitatController{habLister: hablisters.NewHabitatLister(indexer)}
+
+	foo := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	if err := indexer.Add(foo); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Labels:    map[string]string{habv1beta1.HabitatNameLabel: "foo"},
+		},
+	}
+
+	h, err := hc.getHabitatFromLabeledResource(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != foo {
+		t.Errorf("expected Habitat %v, got %v", foo, h)
+	}
+
+	pod.Namespace = "other"
+	if _, err := hc.getHabitatFromLabeledResource(pod); err == nil {
+		t.Error("expected Habitat in another namespace not to be found")
+	} else if _, ok := err.(keyNotFoundError); !ok {
+		t.Errorf("expected keyNotFoundError, got %v", err)
+	}
+}
+
+func TestReconcileConditions(t *testing.T) {
+	hc := &HabitatController{
+		logger:     log.NewNopLogger(),
+		cmInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.ConfigMap{}, 0, cache.Indexers{}),
+	}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec:       habv1beta1.HabitatSpec{Count: 2},
+	}
+	now := metav1.Now()
+
+	status := func(conditions []habv1beta1.HabitatCondition) map[habv1beta1.HabitatConditionType]apiv1.ConditionStatus {
+		m := map[habv1beta1.HabitatConditionType]apiv1.ConditionStatus{}
+		for _, c := range conditions {
+			m[c.Type] = c.Status
+		}
+		return m
+	}
+
+	invalid := validationError{errs: field.ErrorList{field.Required(field.NewPath("spec", "image"), "")}}
+	conditions := hc.reconcileConditions(h, nil, 0, invalid, now)
+	expected := map[habv1beta1.HabitatConditionType]apiv1.ConditionStatus{
+		habv1beta1.HabitatConditionValidationFailed:    apiv1.ConditionTrue,
+		habv1beta1.HabitatConditionAvailable:           apiv1.ConditionFalse,
+		habv1beta1.HabitatConditionDeploymentAvailable: apiv1.ConditionFalse,
+		habv1beta1.HabitatConditionConfigMapReady:      apiv1.ConditionFalse,
+	}
+	if s := status(conditions); !reflect.DeepEqual(s, expected) {
+		t.Errorf("invalid Habitat: expected conditions %v, got %v", expected, s)
+	}
+
+	hc.cmInformer.GetStore().Add(newConfigMap("", h))
+
+	conditions = hc.reconcileConditions(h, conditions, 2, nil, now)
+	expected = map[habv1beta1.HabitatConditionType]apiv1.ConditionStatus{
+		habv1beta1.HabitatConditionValidationFailed:    apiv1.ConditionFalse,
+		habv1beta1.HabitatConditionAvailable:           apiv1.ConditionTrue,
+		habv1beta1.HabitatConditionDeploymentAvailable: apiv1.ConditionTrue,
+		habv1beta1.HabitatConditionConfigMapReady:      apiv1.ConditionTrue,
+	}
+	if s := status(conditions); !reflect.DeepEqual(s, expected) {
+		t.Errorf("reconciled Habitat: expected conditions %v, got %v", expected, s)
+	}
+
+	conflict := nameConflictError{kind: "Deployment", name: "foo"}
+	conditions = hc.reconcileConditions(h, conditions, 2, conflict, now)
+	expected = map[habv1beta1.HabitatConditionType]apiv1.ConditionStatus{
+		habv1beta1.HabitatConditionValidationFailed:    apiv1.ConditionFalse,
+		habv1beta1.HabitatConditionNameConflict:        apiv1.ConditionTrue,
+		habv1beta1.HabitatConditionAvailable:           apiv1.ConditionFalse,
+		habv1beta1.HabitatConditionDeploymentAvailable: apiv1.ConditionFalse,
+		habv1beta1.HabitatConditionConfigMapReady:      apiv1.ConditionTrue,
+	}
+	if s := status(conditions); !reflect.DeepEqual(s, expected) {
+		t.Errorf("conflicting Habitat: expected conditions %v, got %v", expected, s)
+	}
+}
+
+func TestHabitatPhase(t *testing.T) {
+	hc := &HabitatController{
+		deployInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.Deployment{}, 0, cache.Indexers{}),
+	}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec:       habv1beta1.HabitatSpec{Count: 2},
+	}
+
+	tests := []struct {
+		name  string
+		ready int32
+		count int
+		phase habv1beta1.HabitatPhase
+	}{
+		{name: "starting", ready: 1, count: 2, phase: habv1beta1.HabitatPhasePending},
+		{name: "running", ready: 2, count: 2, phase: habv1beta1.HabitatPhaseRunning},
+		{name: "scaling down", ready: 3, count: 2, phase: habv1beta1.HabitatPhaseRunning},
+	}
+
+	for _, tt := range tests {
+		d := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: h.Name, Namespace: h.Namespace},
+			Status:     appsv1.DeploymentStatus{ReadyReplicas: tt.ready},
+		}
+		hc.deployInformer.GetStore().Update(d)
+		h.Spec.Count = tt.count
+
+		ready := hc.readyReplicas(h)
+		if ready != int(tt.ready) {
+			t.Errorf("%s: expected %d ready replicas, got %d", tt.name, tt.ready, ready)
+		}
+		if phase := habitatPhase(ready, h.Spec.Count); phase != tt.phase {
+			t.Errorf("%s: expected phase %s, got %s", tt.name, tt.phase, phase)
+		}
+	}
+}
+
+func TestPodDisruptionBudget(t *testing.T) {
+	hc := &HabitatController{}
+	minAvailable := int32(2)
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:        3,
+			Image:        "foo/bar",
+			Service:      habv1beta1.Service{Topology: habv1beta1.TopologyLeader},
+			MinAvailable: &minAvailable,
+		},
+	}
+	owner := metav1.OwnerReference{Kind: "Deployment", Name: h.Name}
+
+	d, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pdb := newPodDisruptionBudget(h, owner)
+
+	if pdb.Spec.MinAvailable.IntValue() != 2 {
+		t.Errorf("expected minAvailable 2, got %s", pdb.Spec.MinAvailable.String())
+	}
+	if !reflect.DeepEqual(pdb.OwnerReferences, []metav1.OwnerReference{owner}) {
+		t.Errorf("expected PodDisruptionBudget to be owned by %v, got %v", owner, pdb.OwnerReferences)
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !selector.Matches(labels.Set(d.Spec.Template.Labels)) {
+		t.Errorf("expected selector %s to match the Pods of the Habitat, labeled %v", selector, d.Spec.Template.Labels)
+	}
+}
+
+func TestPeerFileHasIPOfRunningPod(t *testing.T) {
+	var created *apiv1.ConfigMap
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+
+		created = &apiv1.ConfigMap{}
+		if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+			t.Errorf("could not decode ConfigMap: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}))
+	defer srv.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{
+		config:      Config{KubernetesClientset: clientset, MaxPeers: 3},
+		logger:      log.NewNopLogger(),
+		podInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Pod{}, 0, cache.Indexers{ringIndex: podRingIndexFunc}),
+	}
+	h := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}}
+
+	pod := func(name, ip string) *apiv1.Pod {
+		return &apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels:    map[string]string{habv1beta1.HabitatLabel: "true", habv1beta1.HabitatNameLabel: "db"},
+			},
+			Status: apiv1.PodStatus{Phase: apiv1.PodRunning, PodIP: ip},
+		}
+	}
+
+	// The first Pod is running, but hasn't been assigned an IP yet.
+	hc.podInformer.GetIndexer().Add(pod("db-0", ""))
+	hc.podInformer.GetIndexer().Add(pod("db-1", "10.0.0.2"))
+
+	if err := hc.handleConfigMap(context.Background(), h); err != nil {
+		t.Fatal(err)
+	}
+
+	if created == nil {
+		t.Fatal("expected the peer ConfigMap to be created")
+	}
+	if peers := created.Data[peerFile]; peers != "10.0.0.2" {
+		t.Errorf("expected the peer file to contain the IP of the Pod that has one, got %q", peers)
+	}
+}
+
+func TestPeerConfigMapHasNoOwner(t *testing.T) {
+	var created []apiv1.ConfigMap
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+
+		var cm apiv1.ConfigMap
+		if err := json.NewDecoder(r.Body).Decode(&cm); err != nil {
+			t.Errorf("could not decode ConfigMap: %v", err)
+		}
+		created = append(created, cm)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&cm)
+	}))
+	defer srv.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{
+		config:      Config{KubernetesClientset: clientset},
+		logger:      log.NewNopLogger(),
+		podInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Pod{}, 0, cache.Indexers{ringIndex: podRingIndexFunc}),
+	}
+
+	// The ConfigMap is shared by the Habitats of the ring, so deleting the
+	// workload of one of them must not garbage collect it.
+	for _, name := range []string{"db", "web"} {
+		h := &habv1beta1.Habitat{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       habv1beta1.HabitatSpec{Ring: "payments"},
+		}
+		if err := hc.handleConfigMap(context.Background(), h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(created) != 2 {
+		t.Fatalf("expected a ConfigMap to be created for each Habitat, got %v", created)
+	}
+	for _, cm := range created {
+		if cm.Name != "peer-watch-file-payments" {
+			t.Errorf("expected the Habitats of the ring to share ConfigMap peer-watch-file-payments, got %s", cm.Name)
+		}
+		if len(cm.OwnerReferences) != 0 {
+			t.Errorf("expected the peer ConfigMap to have no owner, got %v", cm.OwnerReferences)
+		}
+	}
+}
+
+func TestPeerConfigMapDeletionEnqueuesHabitats(t *testing.T) {
+	hc := &HabitatController{
+		logger:      log.NewNopLogger(),
+		habInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &habv1beta1.Habitat{}, 0, cache.Indexers{}),
+		queue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer hc.queue.ShutDown()
+
+	foo := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	bar := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "other"}}
+	hc.habInformer.GetStore().Add(foo)
+	hc.habInformer.GetStore().Add(bar)
+
+	cm := newConfigMap("10.0.0.1", foo)
+	for _, obj := range []interface{}{cm, cache.DeletedFinalStateUnknown{Key: "default/" + configMapName, Obj: cm}} {
+		hc.handleCMDelete(obj)
+
+		if l := hc.queue.Len(); l != 1 {
+			t.Fatalf("expected only the Habitat in the namespace of the ConfigMap to be enqueued, got %d Habitats", l)
+		}
+		key, _ := hc.queue.Get()
+		if key != "default/foo" {
+			t.Errorf("expected default/foo to be enqueued, got %v", key)
+		}
+		hc.queue.Done(key)
+	}
+}
+
+func TestDeletionTombstonesEnqueueHabitats(t *testing.T) {
+	hc := &HabitatController{
+		logger:      log.NewNopLogger(),
+		habInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &habv1beta1.Habitat{}, 0, cache.Indexers{}),
+		queue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	defer hc.queue.ShutDown()
+	hc.habLister = hablisters.NewHabitatLister(hc.habInformer.GetIndexer())
+
+	h := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	hc.habInformer.GetStore().Add(h)
+
+	d, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		handle func(interface{})
+		obj    interface{}
+	}{
+		// The Habitat itself is gone, but it still needs to be cleaned up.
+		{"Habitat", hc.handleHabDelete, cache.DeletedFinalStateUnknown{Key: "default/foo", Obj: h}},
+		{"Deployment", hc.handleDeployDelete, cache.DeletedFinalStateUnknown{Key: "default/foo", Obj: d}},
+	}
+
+	for _, tt := range tests {
+		tt.handle(tt.obj)
+
+		if l := hc.queue.Len(); l != 1 {
+			t.Fatalf("%s: expected the Habitat to be enqueued, got %d keys", tt.name, l)
+		}
+		key, _ := hc.queue.Get()
+		if key != "default/foo" {
+			t.Errorf("%s: expected default/foo to be enqueued, got %v", tt.name, key)
+		}
+		hc.queue.Done(key)
+	}
+}
+
+func TestAdoptDeployment(t *testing.T) {
+	hc := &HabitatController{
+		config: Config{DryRun: true, EventRecorder: record.NewFakeRecorder(10)},
+		logger: log.NewNopLogger(),
+	}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:     1,
+			Image:     "foo/bar",
+			Service:   habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			PodLabels: map[string]string{"app": "foo"},
+		},
+	}
+
+	desired, err := hc.newDeployment(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Labels: map[string]string{"app": "foo"}},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "foo"}},
+		},
+	}
+
+	if _, err := hc.adoptDeployment(context.Background(), h, existing, desired.DeepCopy()); err == nil {
+		t.Error("expected name conflict without opt-in")
+	}
+
+	h.Spec.AdoptExisting = true
+	owner, err := hc.adoptDeployment(context.Background(), h, existing, desired.DeepCopy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.Name != "foo" || owner.Kind != "Deployment" {
+		t.Errorf("expected reference to the adopted Deployment, got %v", owner)
+	}
+
+	controlled := existing.DeepCopy()
+	isController := true
+	controlled.OwnerReferences = []metav1.OwnerReference{{Kind: "Other", Name: "bar", Controller: &isController}}
+	if _, err := hc.adoptDeployment(context.Background(), h, controlled, desired.DeepCopy()); err == nil {
+		t.Error("expected name conflict for Deployment controlled by another resource")
+	}
+
+	mismatched := existing.DeepCopy()
+	mismatched.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "bar"}}
+	if _, err := hc.adoptDeployment(context.Background(), h, mismatched, desired.DeepCopy()); err == nil {
+		t.Error("expected name conflict for Deployment selecting other Pods")
+	}
+}
+
+func TestEnqueueAll(t *testing.T) {
+	hc := &HabitatController{
+		logger:      log.NewNopLogger(),
+		queue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		habInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &habv1beta1.Habitat{}, 0, cache.Indexers{}),
+	}
+	defer hc.queue.ShutDown()
+
+	for _, name := range []string{"foo", "bar"} {
+		hc.habInformer.GetStore().Add(&habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}})
+	}
+
+	// The cache might be incomplete until it's synced.
+	if n := hc.EnqueueAll(); n != 0 || hc.queue.Len() != 0 {
+		t.Fatalf("expected no Habitat to be enqueued before the caches are synced, got %d", n)
+	}
+
+	hc.synced = 1
+	if n := hc.EnqueueAll(); n != 2 || hc.queue.Len() != 2 {
+		t.Errorf("expected 2 Habitats to be enqueued, got %d and a queue of length %d", n, hc.queue.Len())
+	}
+}
+
+func TestDrainFinishesReconciliationsInFlight(t *testing.T) {
+	hc := &HabitatController{
+		logger: log.NewNopLogger(),
+		queue:  workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+
+	hc.queue.Add("default/foo")
+	hc.queue.Add("default/bar")
+
+	// A worker is in the middle of reconciling foo.
+	key, _ := hc.queue.Get()
+	finished := false
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(10 * time.Millisecond)
+		finished = true
+		hc.queue.Done(key)
+
+		// bar must not be reconciled: the controller would panic without
+		// a lister.
+		for hc.processNextItem(context.Background()) {
+		}
+	}()
+
+	hc.drain(&wg, func() { t.Error("expected reconciliation to finish before the timeout") })
+
+	if !finished {
+		t.Error("expected drain to wait for the reconciliation in flight")
+	}
+
+	// Items are neither taken from, nor added to, the queue after shutdown.
+	hc.queue.Add("default/baz")
+	if l := hc.queue.Len(); l != 0 {
+		t.Errorf("expected queue to be empty after shutdown, got %d items", l)
+	}
+}
+
+func TestConfigMapRefChangeTriggersUpdate(t *testing.T) {
+	cm := &apiv1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "default"},
+		Data:       map[string]string{"default.toml": "port = 80", "README": "foo"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cm)
+	}))
+	defer srv.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{config: Config{KubernetesClientset: clientset}}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Image:   "foo/bar",
+			Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone, Name: "bar"},
+			ConfigMapRef: &habv1beta1.ConfigMapRef{
+				Name:  cm.Name,
+				Items: []apiv1.KeyToPath{{Key: "default.toml", Path: "default.toml"}},
+			},
+		},
+	}
+
+	hash := func() string {
+		template, err := hc.newPodTemplate(context.Background(), h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return template.Annotations[configMapHashAnnotation]
+	}
+
+	before := hash()
+	if before == "" {
+		t.Fatal("expected the Pod template to be annotated with the hash of the config")
+	}
+
+	cm.Data["README"] = "bar"
+	if after := hash(); after != before {
+		t.Errorf("expected a change of a key that isn't mounted to keep the hash %q, got %q", before, after)
+	}
+
+	cm.Data["default.toml"] = "port = 8080"
+	if after := hash(); after == before {
+		t.Error("expected a change of the config to change the hash")
+	}
+}
+
+func TestExposedService(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Expose: &habv1beta1.Expose{
+				Type:        apiv1.ServiceTypeNodePort,
+				Ports:       []apiv1.ServicePort{{Name: "http", Port: 80}},
+				Annotations: map[string]string{"foo": "bar"},
+			},
+		},
+	}
+	owner := metav1.OwnerReference{Kind: "Deployment", Name: h.Name}
+
+	svc := newExposedService(h, owner)
+	if svc.Name != h.Name {
+		t.Errorf("expected the Service to be named %q, got %q", h.Name, svc.Name)
+	}
+	if !isOwnedByHabitat(svc, h) {
+		t.Error("expected the Service to be labeled with the Habitat")
+	}
+
+	// The Service as defaulted by the API server.
+	current := svc.DeepCopy()
+	current.Spec.ClusterIP = "10.0.0.10"
+	current.Spec.Ports[0].Protocol = apiv1.ProtocolTCP
+	current.Spec.Ports[0].TargetPort = intstr.FromInt(80)
+	current.Spec.Ports[0].NodePort = 30080
+	current.Annotations["kubectl.kubernetes.io/last-applied-configuration"] = "{}"
+
+	if serviceNeedsUpdate(current, svc) {
+		t.Error("expected the defaulted Service to be up to date")
+	}
+
+	h.Spec.Expose.Ports[0].TargetPort = intstr.FromInt(8080)
+	svc = newExposedService(h, owner)
+	if !serviceNeedsUpdate(current, svc) {
+		t.Fatal("expected a change of the target port to update the Service")
+	}
+	if ports := withAllocatedNodePorts(svc, current); ports[0].NodePort != 30080 {
+		t.Errorf("expected the allocated node port to be kept, got %d", ports[0].NodePort)
+	}
+
+	h.Spec.Expose.Type = apiv1.ServiceTypeClusterIP
+	svc = newExposedService(h, owner)
+	if ports := withAllocatedNodePorts(svc, current); ports[0].NodePort != 0 {
+		t.Errorf("expected no node port with the ClusterIP type, got %d", ports[0].NodePort)
+	}
+}
+
+func TestSupervisorServiceFollowsPorts(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+	owner := metav1.OwnerReference{Kind: "Deployment", Name: h.Name}
+
+	var updated *apiv1.Service
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+
+		updated = &apiv1.Service{}
+		if err := json.NewDecoder(r.Body).Decode(updated); err != nil {
+			t.Errorf("could not decode Service: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(updated)
+	}))
+	defer srv.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{
+		config:      Config{KubernetesClientset: clientset},
+		logger:      log.NewNopLogger(),
+		svcInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Service{}, 0, cache.Indexers{}),
+	}
+
+	// The Service as created with the default ports, and defaulted by the API
+	// server.
+	current := newService(h, owner)
+	current.Spec.Type = apiv1.ServiceTypeClusterIP
+	for i := range current.Spec.Ports {
+		current.Spec.Ports[i].TargetPort = intstr.FromInt(int(current.Spec.Ports[i].Port))
+	}
+	hc.svcInformer.GetStore().Add(current)
+
+	if err := hc.handleService(context.Background(), h, owner); err != nil {
+		t.Fatal(err)
+	}
+	if updated != nil {
+		t.Fatal("expected the up to date Service not to be updated")
+	}
+
+	h.Spec.GossipListenPort = 9640
+	h.Spec.HTTPListenPort = 9630
+	if err := hc.handleService(context.Background(), h, owner); err != nil {
+		t.Fatal(err)
+	}
+	if updated == nil {
+		t.Fatal("expected the Service to be updated")
+	}
+
+	for _, p := range updated.Spec.Ports {
+		want := h.Spec.GossipListenPort
+		if p.Name == httpGatewayPortName {
+			want = h.Spec.HTTPListenPort
+		}
+		if p.Port != want {
+			t.Errorf("expected port %s to be %d, got %d", p.Name, want, p.Port)
+		}
+	}
+	if updated.Spec.ClusterIP != apiv1.ClusterIPNone {
+		t.Errorf("expected the Service to stay headless, got cluster IP %q", updated.Spec.ClusterIP)
+	}
+}
+
+func TestHabitatStatusIsWrittenThroughSubresource(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h)
+	}))
+	defer srv.Close()
+
+	habitats, err := habclientset.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{
+		config: Config{
+			HabitatClient: habitats,
+			EventRecorder: record.NewFakeRecorder(10),
+		},
+		logger:         log.NewNopLogger(),
+		deployInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.Deployment{}, 0, cache.Indexers{}),
+		cmInformer:     cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.ConfigMap{}, 0, cache.Indexers{}),
+	}
+
+	if err := hc.updateHabitatStatus(context.Background(), h, h, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"PUT /apis/habitat.sh/v1beta1/namespaces/default/habitats/foo/status"}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected requests %v, got %v", expected, requests)
+	}
+}
+
+func TestValidationWarningsAreReportedOnChange(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:       2,
+			HostNetwork: true,
+			Service:     habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+
+	var written habv1beta1.Habitat
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&written); err != nil {
+			t.Errorf("could not decode Habitat: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&written)
+	}))
+	defer srv.Close()
+
+	habitats, err := habclientset.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	hc := &HabitatController{
+		config: Config{
+			HabitatClient: habitats,
+			EventRecorder: recorder,
+		},
+		logger:         log.NewNopLogger(),
+		deployInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.Deployment{}, 0, cache.Indexers{}),
+		cmInformer:     cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.ConfigMap{}, 0, cache.Indexers{}),
+	}
+
+	warned := func() int {
+		n := 0
+		for {
+			select {
+			case e := <-recorder.Events:
+				if strings.Contains(e, reasonValidationWarning) {
+					n++
+				}
+			default:
+				return n
+			}
+		}
+	}
+
+	if err := hc.updateHabitatStatus(context.Background(), h, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := warned(); n != 1 {
+		t.Errorf("expected the warning to be reported once, got %d Events", n)
+	}
+	if !hasCondition(written.Status.Conditions, habv1beta1.HabitatCondition{Type: habv1beta1.HabitatConditionValidationWarning, Status: apiv1.ConditionTrue}) {
+		t.Errorf("expected the ValidationWarning condition to be true, got %v", written.Status.Conditions)
+	}
+
+	// The next reconciliations of the unchanged Habitat don't report it again.
+	h = written.DeepCopy()
+	if err := hc.updateHabitatStatus(context.Background(), h, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := warned(); n != 0 {
+		t.Errorf("expected the unchanged warning not to be reported again, got %d Events", n)
+	}
+
+	h.Spec.Count = 1
+	if err := hc.updateHabitatStatus(context.Background(), h, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !hasCondition(written.Status.Conditions, habv1beta1.HabitatCondition{Type: habv1beta1.HabitatConditionValidationWarning, Status: apiv1.ConditionFalse}) {
+		t.Errorf("expected the ValidationWarning condition to be false without warnings, got %v", written.Status.Conditions)
+	}
+}
+
+func TestHabitatStatusWithoutSubresource(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+
+	// Without the CustomResourceSubresources feature gate, the status
+	// subresource doesn't exist.
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/status") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h)
+	}))
+	defer srv.Close()
+
+	habitats, err := habclientset.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{
+		config: Config{
+			HabitatClient: habitats,
+			EventRecorder: record.NewFakeRecorder(10),
+		},
+		logger:         log.NewNopLogger(),
+		deployInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.Deployment{}, 0, cache.Indexers{}),
+		cmInformer:     cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.ConfigMap{}, 0, cache.Indexers{}),
+	}
+
+	if err := hc.updateHabitatStatus(context.Background(), h, h, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"PUT /apis/habitat.sh/v1beta1/namespaces/default/habitats/foo/status",
+		"PUT /apis/habitat.sh/v1beta1/namespaces/default/habitats/foo",
+	}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected requests %v, got %v", expected, requests)
+	}
+}
+
+func TestConfigMapRefUpdateEnqueuesHabitats(t *testing.T) {
+	hc := &HabitatController{
+		logger:      log.NewNopLogger(),
+		queue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		habInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &habv1beta1.Habitat{}, 0, cache.Indexers{configMapRefIndex: habitatConfigMapRefIndexFunc}),
+	}
+
+	for _, h := range []*habv1beta1.Habitat{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Spec:       habv1beta1.HabitatSpec{ConfigMapRef: &habv1beta1.ConfigMapRef{Name: "settings"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "default"},
+		},
+		// The same name in another namespace is another ConfigMap.
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "baz", Namespace: "other"},
+			Spec:       habv1beta1.HabitatSpec{ConfigMapRef: &habv1beta1.ConfigMapRef{Name: "settings"}},
+		},
+	} {
+		hc.habInformer.GetIndexer().Add(h)
+	}
+
+	old := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "default", ResourceVersion: "1"},
+		Data:       map[string]string{"default.toml": "a = 1"},
+	}
+
+	// Resyncs don't change the ConfigMap.
+	hc.handleConfigMapRefUpdate(old, old)
+	if n := hc.queue.Len(); n != 0 {
+		t.Errorf("expected no Habitat to be enqueued on resync, got %d", n)
+	}
+
+	updated := old.DeepCopy()
+	updated.ResourceVersion = "2"
+	updated.Data["default.toml"] = "a = 2"
+	hc.handleConfigMapRefUpdate(old, updated)
+
+	if n := hc.queue.Len(); n != 1 {
+		t.Fatalf("expected 1 Habitat to be enqueued, got %d", n)
+	}
+	if k, _ := hc.queue.Get(); k != "default/foo" {
+		t.Errorf("expected the referencing Habitat to be enqueued, got %v", k)
+	}
+}
+
+func TestPodTemplateConfigProjections(t *testing.T) {
+	hc := &HabitatController{}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Image:   "foo/bar",
+			Service: habv1beta1.Service{Name: "foo", Topology: habv1beta1.TopologyStandalone},
+		},
+	}
+
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without projections the peer file is mounted from a plain ConfigMap
+	// volume.
+	if v := template.Spec.Volumes[0]; v.Name != configVolumeName || v.ConfigMap == nil {
+		t.Errorf("expected the peer file in a ConfigMap volume, got %v", v)
+	}
+
+	app := apiv1.VolumeProjection{ConfigMap: &apiv1.ConfigMapProjection{LocalObjectReference: apiv1.LocalObjectReference{Name: "app"}}}
+	h.Spec.ConfigProjections = []apiv1.VolumeProjection{app}
+
+	template, err = hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := template.Spec.Volumes[0]
+	if v.Name != configVolumeName || v.Projected == nil {
+		t.Fatalf("expected the peer file in a projected volume, got %v", v)
+	}
+
+	sources := v.Projected.Sources
+	if len(sources) != 2 {
+		t.Fatalf("expected the peer file and 1 projection, got %d sources", len(sources))
+	}
+	if cm := sources[0].ConfigMap; cm == nil || cm.Name != peerConfigMapName(h) || cm.Items[0].Path != defaultPeerWatchFilename {
+		t.Errorf("expected the peer file to be projected first, got %v", sources[0])
+	}
+	if !reflect.DeepEqual(sources[1], app) {
+		t.Errorf("expected the projection of the Habitat, got %v", sources[1])
+	}
+}
+
+func TestPeerConfigMapFailureCreatesNoWorkload(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{
+		config: Config{
+			KubernetesClientset: clientset,
+			EventRecorder:       record.NewFakeRecorder(10),
+		},
+		logger:         log.NewNopLogger(),
+		habInformer:    cache.NewSharedIndexInformer(&cache.ListWatch{}, &habv1beta1.Habitat{}, 0, cache.Indexers{}),
+		deployInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.Deployment{}, 0, cache.Indexers{}),
+		podInformer:    cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Pod{}, 0, cache.Indexers{ringIndex: podRingIndexFunc}),
+	}
+	hc.habLister = hablisters.NewHabitatLister(hc.habInformer.GetIndexer())
+
+	hc.habInformer.GetStore().Add(&habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Finalizers: []string{habitatFinalizer}},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   1,
+			Image:   "foo/bar",
+			Service: habv1beta1.Service{Name: "foo", Topology: habv1beta1.TopologyStandalone},
+		},
+	})
+
+	if _, err := hc.conform(context.Background(), "default/foo"); err == nil {
+		t.Fatal("expected the failure to create the peer ConfigMap to be returned")
+	}
+
+	// The Pods of the Deployment would be left pending without the peer
+	// ConfigMap, so it must not be created.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 || !strings.HasSuffix(requests[0], "/configmaps") {
+		t.Errorf("expected only the peer ConfigMap to be created, got requests %v", requests)
+	}
+}
+
+func TestPodTemplatePriorityClass(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	hc := &HabitatController{
+		config: Config{KubernetesClientset: clientset, EventRecorder: recorder},
+		logger: log.NewNopLogger(),
+	}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:             1,
+			Image:             "foo/bar",
+			Service:           habv1beta1.Service{Name: "foo", Topology: habv1beta1.TopologyStandalone},
+			PriorityClassName: "critical-rings",
+		},
+	}
+
+	// A missing PriorityClass might still be created, so the Pods are
+	// created anyway.
+	template, err := hc.newPodTemplate(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := template.Spec.PriorityClassName; name != "critical-rings" {
+		t.Errorf("expected the priority class of the Habitat, got %q", name)
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, reasonMissingPriorityClass) {
+			t.Errorf("expected a %s event, got %q", reasonMissingPriorityClass, e)
+		}
+	default:
+		t.Error("expected a warning about the missing PriorityClass")
+	}
+}
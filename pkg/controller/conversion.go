@@ -0,0 +1,115 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/kit/log/level"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// conversionReview is the ConversionReview of the apiextensions.k8s.io/v1beta1
+// API, which the API server sends to the conversion webhooks of custom
+// resources. The vendored version of the API predates it.
+type conversionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Request         *conversionRequest  `json:"request,omitempty"`
+	Response        *conversionResponse `json:"response,omitempty"`
+}
+
+type conversionRequest struct {
+	UID               types.UID              `json:"uid"`
+	DesiredAPIVersion string                 `json:"desiredAPIVersion"`
+	Objects           []runtime.RawExtension `json:"objects"`
+}
+
+type conversionResponse struct {
+	UID              types.UID              `json:"uid"`
+	ConvertedObjects []runtime.RawExtension `json:"convertedObjects"`
+	Result           metav1.Status          `json:"result"`
+}
+
+// conversionHandler serves the conversion webhook for Habitats. Habitats are
+// converted with the scheme of the controller, so supporting a new version of
+// the API only requires registering its conversions.
+func (hc *HabitatController) conversionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var review conversionReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode conversion review: %v", err), http.StatusBadRequest)
+			return
+		}
+		if review.Request == nil {
+			http.Error(w, "conversion review contains no request", http.StatusBadRequest)
+			return
+		}
+
+		review.Response = hc.convert(review.Request)
+		review.Request = nil
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(review); err != nil {
+			level.Error(hc.logger).Log("msg", "Failed to encode conversion review", "err", err)
+		}
+	})
+}
+
+// convert converts the Habitats in the conversion request to the desired
+// version. Either all of them are converted, or none.
+func (hc *HabitatController) convert(req *conversionRequest) *conversionResponse {
+	resp := &conversionResponse{UID: req.UID}
+
+	gv, err := schema.ParseGroupVersion(req.DesiredAPIVersion)
+	if err != nil {
+		resp.Result = metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+		return resp
+	}
+
+	decoder := serializer.NewCodecFactory(hc.config.Scheme).UniversalDeserializer()
+
+	for _, raw := range req.Objects {
+		obj, err := runtime.Decode(decoder, raw.Raw)
+		if err != nil {
+			resp.Result = metav1.Status{Status: metav1.StatusFailure, Message: fmt.Sprintf("could not decode object: %v", err)}
+			return resp
+		}
+
+		converted, err := hc.config.Scheme.ConvertToVersion(obj, gv)
+		if err != nil {
+			level.Debug(hc.logger).Log("msg", "Could not convert object", "version", req.DesiredAPIVersion, "err", err)
+			resp.Result = metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+			return resp
+		}
+
+		b, err := json.Marshal(converted)
+		if err != nil {
+			resp.Result = metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+			return resp
+		}
+
+		resp.ConvertedObjects = append(resp.ConvertedObjects, runtime.RawExtension{Raw: b})
+	}
+
+	resp.Result = metav1.Status{Status: metav1.StatusSuccess}
+
+	return resp
+}
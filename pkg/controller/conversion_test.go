@@ -0,0 +1,98 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestConversionWebhook(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := habv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{config: Config{Scheme: scheme}, logger: log.NewNopLogger()}
+	handler := hc.webhookHandler()
+
+	h := habv1beta1.Habitat{
+		TypeMeta:   metav1.TypeMeta{APIVersion: habv1beta1.SchemeGroupVersion.String(), Kind: "Habitat"},
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count:   3,
+			Image:   "foo/bar",
+			Service: habv1beta1.Service{Name: "bar", Topology: habv1beta1.TopologyLeader},
+		},
+	}
+	raw, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	review := func(version string) *conversionResponse {
+		body, err := json.Marshal(conversionReview{
+			Request: &conversionRequest{
+				UID:               "42",
+				DesiredAPIVersion: version,
+				Objects:           []runtime.RawExtension{{Raw: raw}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/convert", bytes.NewReader(body)))
+
+		var got conversionReview
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Response == nil || got.Response.UID != "42" {
+			t.Fatalf("expected a response to request 42, got %v", got.Response)
+		}
+
+		return got.Response
+	}
+
+	// Habitats are converted to their own version as they are.
+	resp := review(habv1beta1.SchemeGroupVersion.String())
+	if resp.Result.Status != metav1.StatusSuccess || len(resp.ConvertedObjects) != 1 {
+		t.Fatalf("expected the Habitat to be converted, got %v", resp)
+	}
+
+	var converted habv1beta1.Habitat
+	if err := json.Unmarshal(resp.ConvertedObjects[0].Raw, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if converted.APIVersion != h.APIVersion || converted.Kind != h.Kind || converted.Name != h.Name || converted.Spec.Count != h.Spec.Count {
+		t.Errorf("expected the converted Habitat to equal %v, got %v", h, converted)
+	}
+
+	// Unknown versions can't be converted to.
+	resp = review("habitat.sh/v2")
+	if resp.Result.Status != metav1.StatusFailure || len(resp.ConvertedObjects) != 0 {
+		t.Errorf("expected the conversion to an unknown version to fail, got %v", resp)
+	}
+}
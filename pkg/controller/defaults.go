@@ -0,0 +1,131 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+)
+
+// undefaultableFields are the fields of the spec that can't have defaults:
+// changing the defaults would change them for existing Habitats, which isn't
+// supported, and the count of a Habitat may be deliberately set to 0.
+var undefaultableFields = map[string]bool{
+	"count":             true,
+	"service":           true,
+	"kind":              true,
+	"deploymentName":    true,
+	"ring":              true,
+	"persistentStorage": true,
+}
+
+// LoadDefaults reads the defaults of the spec of Habitats from a YAML or JSON
+// file, and checks that they only set fields that can have defaults.
+func LoadDefaults(path string) (*habv1beta1.HabitatSpec, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var defaults habv1beta1.HabitatSpec
+	if err := yaml.Unmarshal(b, &defaults); err != nil {
+		return nil, fmt.Errorf("could not decode Habitat defaults %s: %v", path, err)
+	}
+
+	if err := validateDefaults(defaults); err != nil {
+		return nil, fmt.Errorf("invalid Habitat defaults %s: %v", path, err)
+	}
+
+	return &defaults, nil
+}
+
+// validateDefaults returns an error listing the fields set in defaults that
+// can't have defaults.
+func validateDefaults(defaults habv1beta1.HabitatSpec) error {
+	var set []string
+
+	v := reflect.ValueOf(defaults)
+	for i := 0; i < v.NumField(); i++ {
+		name := jsonName(v.Type().Field(i))
+		if undefaultableFields[name] && !isZero(v.Field(i)) {
+			set = append(set, name)
+		}
+	}
+
+	if len(set) > 0 {
+		return fmt.Errorf("fields can't have defaults: %s", strings.Join(set, ", "))
+	}
+
+	return nil
+}
+
+// applyDefaults returns a copy of the Habitat with the fields of its spec that
+// are unset taken from defaults. Maps are merged key by key, the keys of the
+// Habitat taking precedence. Other fields are taken as a whole: e.g. a Habitat
+// setting resources gets none of the default resources.
+func applyDefaults(h *habv1beta1.Habitat, defaults *habv1beta1.HabitatSpec) *habv1beta1.Habitat {
+	if defaults == nil {
+		return h
+	}
+
+	h = h.DeepCopy()
+	d := defaults.DeepCopy()
+
+	spec := reflect.ValueOf(&h.Spec).Elem()
+	def := reflect.ValueOf(d).Elem()
+	for i := 0; i < spec.NumField(); i++ {
+		f, df := spec.Field(i), def.Field(i)
+
+		switch {
+		case isZero(df):
+		case isZero(f):
+			f.Set(df)
+		case f.Kind() == reflect.Map:
+			for _, k := range df.MapKeys() {
+				if !f.MapIndex(k).IsValid() {
+					f.SetMapIndex(k, df.MapIndex(k))
+				}
+			}
+		}
+	}
+
+	return h
+}
+
+// isZero returns true if v is the zero value of its type. Empty slices and
+// maps are considered unset, like nil ones.
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// jsonName returns the name of the field in JSON.
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+
+	return name
+}
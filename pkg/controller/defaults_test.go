@@ -0,0 +1,123 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestApplyDefaults(t *testing.T) {
+	defaults := &habv1beta1.HabitatSpec{
+		Image: "foo/default",
+		Resources: &apiv1.ResourceRequirements{
+			Requests: apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("100m")},
+		},
+		PodLabels:        map[string]string{"team": "platform", "tier": "backend"},
+		ImagePullSecrets: []string{"registry"},
+	}
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Count: 0,
+			Resources: &apiv1.ResourceRequirements{
+				Limits: apiv1.ResourceList{apiv1.ResourceMemory: resource.MustParse("1Gi")},
+			},
+			PodLabels: map[string]string{"tier": "frontend"},
+		},
+	}
+
+	got := applyDefaults(h, defaults)
+
+	if got.Spec.Image != defaults.Image {
+		t.Errorf("expected the default image %q, got %q", defaults.Image, got.Spec.Image)
+	}
+	// Fields set by the Habitat are taken as a whole.
+	if !reflect.DeepEqual(got.Spec.Resources, h.Spec.Resources) {
+		t.Errorf("expected the resources of the Habitat %v, got %v", h.Spec.Resources, got.Spec.Resources)
+	}
+	if want := map[string]string{"team": "platform", "tier": "frontend"}; !reflect.DeepEqual(got.Spec.PodLabels, want) {
+		t.Errorf("expected the labels to be merged into %v, got %v", want, got.Spec.PodLabels)
+	}
+	if !reflect.DeepEqual(got.Spec.ImagePullSecrets, defaults.ImagePullSecrets) {
+		t.Errorf("expected the default image pull secrets %v, got %v", defaults.ImagePullSecrets, got.Spec.ImagePullSecrets)
+	}
+	if got.Spec.Count != 0 {
+		t.Errorf("expected the count to be left alone, got %d", got.Spec.Count)
+	}
+
+	// Neither the Habitat nor the defaults are modified.
+	if h.Spec.Image != "" || len(h.Spec.PodLabels) != 1 {
+		t.Errorf("expected the Habitat to be copied, got %v", h.Spec)
+	}
+	got.Spec.ImagePullSecrets[0] = "other"
+	if defaults.ImagePullSecrets[0] != "registry" {
+		t.Error("expected the defaults to be copied")
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{
+			name:    "valid",
+			content: "image: foo/bar\npodLabels:\n  team: platform\n",
+			valid:   true,
+		},
+		{
+			name:    "undefaultable fields",
+			content: "count: 3\nring: payments\n",
+		},
+		{
+			name:    "malformed",
+			content: "podLabels: [",
+		},
+	}
+
+	for _, tt := range tests {
+		f, err := ioutil.TempFile("", "habitat-defaults")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+
+		if _, err := f.WriteString(tt.content); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		defaults, err := LoadDefaults(f.Name())
+		if tt.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			} else if defaults.Image != "foo/bar" || defaults.PodLabels["team"] != "platform" {
+				t.Errorf("%s: unexpected defaults %v", tt.name, defaults)
+			}
+		} else if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ghodss/yaml"
+	"github.com/go-kit/kit/log/level"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The functions in this file write to the API server, unless the controller
+// runs in dry-run mode, in which case they only log the objects they would
+// have written.
+// In dry-run mode, objects that are in the cache are reported as already
+// existing, so that the reconciliation takes the same path it would
+// otherwise take.
+
+// dryRun logs what the controller would have done with the object, and
+// returns true if the controller runs in dry-run mode.
+func (hc *HabitatController) dryRun(verb string, obj interface{}) bool {
+	if !hc.config.DryRun {
+		return false
+	}
+
+	y, err := yaml.Marshal(obj)
+	if err != nil {
+		level.Error(hc.logger).Log("msg", "Could not marshal object", "err", err)
+	}
+
+	level.Info(hc.logger).Log("msg", "dry run", "verb", verb, "object", string(y))
+
+	return true
+}
+
+func (hc *HabitatController) createDeployment(ctx context.Context, d *appsv1.Deployment) (*appsv1.Deployment, error) {
+	if hc.config.DryRun {
+		if _, err := hc.findDeploymentInCache(d); err == nil {
+			return nil, apierrors.NewAlreadyExists(schema.GroupResource{Group: appsv1.GroupName, Resource: "deployments"}, d.Name)
+		}
+	}
+	if hc.dryRun("create", d) {
+		return d, nil
+	}
+
+	apps, cancel := hc.appsClient(ctx)
+	defer cancel()
+
+	return apps.Deployments(d.Namespace).Create(d)
+}
+
+func (hc *HabitatController) updateDeployment(ctx context.Context, d *appsv1.Deployment) (*appsv1.Deployment, error) {
+	if hc.dryRun("update", d) {
+		return d, nil
+	}
+
+	apps, cancel := hc.appsClient(ctx)
+	defer cancel()
+
+	return apps.Deployments(d.Namespace).Update(d)
+}
+
+func (hc *HabitatController) createStatefulSet(ctx context.Context, sts *appsv1.StatefulSet) (*appsv1.StatefulSet, error) {
+	if hc.config.DryRun {
+		if _, err := hc.findStatefulSetInCache(sts); err == nil {
+			return nil, apierrors.NewAlreadyExists(schema.GroupResource{Group: appsv1.GroupName, Resource: "statefulsets"}, sts.Name)
+		}
+	}
+	if hc.dryRun("create", sts) {
+		return sts, nil
+	}
+
+	apps, cancel := hc.appsClient(ctx)
+	defer cancel()
+
+	return apps.StatefulSets(sts.Namespace).Create(sts)
+}
+
+func (hc *HabitatController) updateStatefulSet(ctx context.Context, sts *appsv1.StatefulSet) (*appsv1.StatefulSet, error) {
+	if hc.dryRun("update", sts) {
+		return sts, nil
+	}
+
+	apps, cancel := hc.appsClient(ctx)
+	defer cancel()
+
+	return apps.StatefulSets(sts.Namespace).Update(sts)
+}
+
+func (hc *HabitatController) createJob(ctx context.Context, j *batchv1.Job) (*batchv1.Job, error) {
+	if hc.dryRun("create", j) {
+		return j, nil
+	}
+
+	batch, cancel := hc.batchClient(ctx)
+	defer cancel()
+
+	return batch.Jobs(j.Namespace).Create(j)
+}
+
+func (hc *HabitatController) patchJob(ctx context.Context, j *batchv1.Job, patch []byte) (*batchv1.Job, error) {
+	if hc.dryRun("patch", json.RawMessage(patch)) {
+		return j, nil
+	}
+
+	batch, cancel := hc.batchClient(ctx)
+	defer cancel()
+
+	return batch.Jobs(j.Namespace).Patch(j.Name, types.MergePatchType, patch)
+}
+
+func (hc *HabitatController) deleteJob(ctx context.Context, j *batchv1.Job) error {
+	if hc.dryRun("delete", j) {
+		return nil
+	}
+
+	batch, cancel := hc.batchClient(ctx)
+	defer cancel()
+
+	// The Pods of the Job are deleted with it.
+	deletePolicy := metav1.DeletePropagationBackground
+
+	return batch.Jobs(j.Namespace).Delete(j.Name, &metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
+}
+
+func (hc *HabitatController) createService(ctx context.Context, svc *apiv1.Service) (*apiv1.Service, error) {
+	if hc.dryRun("create", svc) {
+		return svc, nil
+	}
+
+	core, cancel := hc.coreClient(ctx)
+	defer cancel()
+
+	return core.Services(svc.Namespace).Create(svc)
+}
+
+func (hc *HabitatController) updateService(ctx context.Context, svc *apiv1.Service) (*apiv1.Service, error) {
+	if hc.dryRun("update", svc) {
+		return svc, nil
+	}
+
+	core, cancel := hc.coreClient(ctx)
+	defer cancel()
+
+	return core.Services(svc.Namespace).Update(svc)
+}
+
+func (hc *HabitatController) deleteService(ctx context.Context, svc *apiv1.Service) error {
+	if hc.dryRun("delete", svc) {
+		return nil
+	}
+
+	core, cancel := hc.coreClient(ctx)
+	defer cancel()
+
+	return core.Services(svc.Namespace).Delete(svc.Name, &metav1.DeleteOptions{})
+}
+
+func (hc *HabitatController) createPodDisruptionBudget(ctx context.Context, pdb *policyv1beta1.PodDisruptionBudget) (*policyv1beta1.PodDisruptionBudget, error) {
+	if hc.dryRun("create", pdb) {
+		return pdb, nil
+	}
+
+	policy, cancel := hc.policyClient(ctx)
+	defer cancel()
+
+	return policy.PodDisruptionBudgets(pdb.Namespace).Create(pdb)
+}
+
+func (hc *HabitatController) deletePodDisruptionBudget(ctx context.Context, pdb *policyv1beta1.PodDisruptionBudget) error {
+	if hc.dryRun("delete", pdb) {
+		return nil
+	}
+
+	policy, cancel := hc.policyClient(ctx)
+	defer cancel()
+
+	return policy.PodDisruptionBudgets(pdb.Namespace).Delete(pdb.Name, &metav1.DeleteOptions{})
+}
+
+func (hc *HabitatController) createConfigMap(ctx context.Context, cm *apiv1.ConfigMap) (*apiv1.ConfigMap, error) {
+	if hc.config.DryRun {
+		if _, err := hc.findConfigMapInCache(cm); err == nil {
+			return nil, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+		}
+	}
+	if hc.dryRun("create", cm) {
+		return cm, nil
+	}
+
+	core, cancel := hc.coreClient(ctx)
+	defer cancel()
+
+	return core.ConfigMaps(cm.Namespace).Create(cm)
+}
+
+func (hc *HabitatController) updateConfigMap(ctx context.Context, cm *apiv1.ConfigMap) (*apiv1.ConfigMap, error) {
+	if hc.dryRun("update", cm) {
+		return cm, nil
+	}
+
+	core, cancel := hc.coreClient(ctx)
+	defer cancel()
+
+	return core.ConfigMaps(cm.Namespace).Update(cm)
+}
+
+func (hc *HabitatController) deleteConfigMap(ctx context.Context, cm *apiv1.ConfigMap) error {
+	if hc.dryRun("delete", cm) {
+		return nil
+	}
+
+	core, cancel := hc.coreClient(ctx)
+	defer cancel()
+
+	return core.ConfigMaps(cm.Namespace).Delete(cm.Name, &metav1.DeleteOptions{})
+}
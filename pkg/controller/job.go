@@ -0,0 +1,275 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func (hc *HabitatController) cacheJobs() {
+	source := newListWatchFromClientWithLabels(
+		hc.config.KubernetesClientset.BatchV1().RESTClient(),
+		"jobs",
+		hc.config.Namespace,
+		labelListOptions())
+
+	hc.jobInformer = cache.NewSharedIndexInformer(
+		source,
+		&batchv1.Job{},
+		hc.config.ResyncPeriod,
+		cache.Indexers{},
+	)
+
+	hc.jobInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    hc.handleJobAdd,
+		UpdateFunc: hc.handleJobUpdate,
+		DeleteFunc: hc.handleJobDelete,
+	})
+
+	hc.jobInformerSynced = hc.jobInformer.HasSynced
+}
+
+func (hc *HabitatController) handleJobAdd(obj interface{}) {
+	j, ok := obj.(*batchv1.Job)
+	if !ok {
+		level.Error(hc.logger).Log("msg", "Failed to type assert Job", "obj", obj)
+		return
+	}
+
+	h, err := hc.getHabitatFromLabeledResource(j)
+	if err != nil {
+		level.Error(hc.logger).Log("msg", "Could not find Habitat for Job", "name", j.Name)
+		return
+	}
+
+	hc.enqueue(h)
+}
+
+func (hc *HabitatController) handleJobUpdate(oldObj, newObj interface{}) {
+	j, ok := newObj.(*batchv1.Job)
+	if !ok {
+		level.Error(hc.logger).Log("msg", "Failed to type assert Job", "obj", newObj)
+		return
+	}
+
+	h, err := hc.getHabitatFromLabeledResource(j)
+	if err != nil {
+		level.Error(hc.logger).Log("msg", "Could not find Habitat for Job", "name", j.Name)
+		return
+	}
+
+	hc.enqueue(h)
+}
+
+func (hc *HabitatController) handleJobDelete(obj interface{}) {
+	j, ok := unwrapTombstone(obj).(*batchv1.Job)
+	if !ok {
+		level.Error(hc.logger).Log("msg", "Failed to type assert Job", "obj", obj)
+		return
+	}
+
+	h, err := hc.getHabitatFromLabeledResource(j)
+	if err != nil {
+		// Could not find Habitat, it must have already been removed.
+		level.Debug(hc.logger).Log("msg", "Could not find Habitat for Job", "name", j.Name)
+		return
+	}
+
+	hc.enqueue(h)
+}
+
+func (hc *HabitatController) newJob(ctx context.Context, h *habv1beta1.Habitat) (*batchv1.Job, error) {
+	// This value needs to be passed as a *int32, so we convert it, assign it to a
+	// variable and afterwards pass a pointer to it.
+	count := int32(h.Spec.Count)
+
+	template, err := hc.newPodTemplate(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	// Jobs don't support the default restart policy of Pods, Always.
+	template.Spec.RestartPolicy = h.Spec.RestartPolicy
+	if template.Spec.RestartPolicy == "" {
+		template.Spec.RestartPolicy = apiv1.RestartPolicyOnFailure
+	}
+
+	base := &batchv1.Job{
+		ObjectMeta: newWorkloadObjectMeta(h),
+		// The selector is generated by the API server, as a selector on the
+		// labels of the Habitat would also match the Pods of previous runs.
+		Spec: batchv1.JobSpec{
+			Parallelism:  &count,
+			Completions:  &count,
+			BackoffLimit: h.Spec.BackoffLimit,
+			Template:     *template,
+		},
+	}
+
+	hash, err := specHash(&base.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	base.Annotations[specHashAnnotation] = hash
+
+	immutable, err := json.Marshal(immutableSpec(h.Spec))
+	if err != nil {
+		return nil, err
+	}
+
+	base.Annotations[immutableSpecAnnotation] = string(immutable)
+
+	return base, nil
+}
+
+// handleJob creates the Job running the Habitat, and returns a reference to
+// it. If the spec of the Job changed, it's deleted to be replaced, and no
+// reference is returned.
+func (hc *HabitatController) handleJob(ctx context.Context, h *habv1beta1.Habitat) (*metav1.OwnerReference, error) {
+	job, err := hc.newJob(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	cachedJob, err := hc.findJobInCache(job)
+	if err != nil {
+		if _, ok := err.(keyNotFoundError); !ok {
+			return nil, err
+		}
+
+		// Create Job, if it doesn't already exist.
+		err = hc.retryCreate(ctx, h, "Job", job.Name, func() (err error) {
+			cachedJob, err = hc.createJob(ctx, job)
+			return err
+		})
+		if err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				return nil, err
+			}
+
+			// Either the cache is not in sync yet, or the Job was not
+			// created by the operator.
+			existing, err := hc.getJob(ctx, job.Namespace, job.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			if !isOwnedByHabitat(existing, h) {
+				return nil, nameConflictError{kind: "Job", name: job.Name}
+			}
+
+			// It's ours, it's replaced on the next reconciliation if needed.
+			cachedJob = existing
+
+			level.Debug(hc.logger).Log("msg", "job already existed", "name", job.Name)
+		} else {
+			level.Info(hc.logger).Log("msg", "created job", "name", job.Name)
+			hc.config.EventRecorder.Eventf(h, apiv1.EventTypeNormal, reasonCreated, "Created job %s", job.Name)
+		}
+	} else if !isOwnedByHabitat(cachedJob, h) {
+		return nil, nameConflictError{kind: "Job", name: job.Name}
+	} else if jobNeedsUpdate(cachedJob, job) {
+		// The template and the completions of a Job are immutable, so it's
+		// replaced, which runs it again. The new Job is created once the
+		// deletion is noticed, as its name is taken until then.
+		if err := hc.deleteJob(ctx, cachedJob); err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+
+		level.Info(hc.logger).Log("msg", "deleted job to replace it", "name", job.Name)
+		hc.config.EventRecorder.Eventf(h, apiv1.EventTypeNormal, reasonUpdated, "Replacing job %s", job.Name)
+
+		return nil, nil
+	} else if annotationsChanged(cachedJob.Annotations, job.Annotations) {
+		// Replacing the Job would run it again, only its metadata is patched.
+		patch, err := jobAnnotationsPatch(cachedJob, job)
+		if err != nil {
+			return nil, err
+		}
+
+		if cachedJob, err = hc.patchJob(ctx, cachedJob, patch); err != nil {
+			return nil, err
+		}
+
+		level.Info(hc.logger).Log("msg", "updated job annotations", "name", job.Name)
+	} else {
+		level.Debug(hc.logger).Log("msg", "job up to date", "name", job.Name)
+	}
+
+	return newOwnerReference(cachedJob, batchv1.SchemeGroupVersion.WithKind("Job")), nil
+}
+
+// jobNeedsUpdate returns true if the desired Job differs from the one
+// currently running in the cluster.
+func jobNeedsUpdate(current, desired *batchv1.Job) bool {
+	return current.Annotations[specHashAnnotation] != desired.Annotations[specHashAnnotation]
+}
+
+// jobAnnotationsPatch returns the merge patch setting the desired annotations
+// on the current Job, and removing the DeploymentAnnotations that are no
+// longer desired.
+func jobAnnotationsPatch(current, desired *batchv1.Job) ([]byte, error) {
+	annotations := make(map[string]interface{}, len(desired.Annotations))
+	for k, v := range desired.Annotations {
+		annotations[k] = v
+	}
+
+	if applied := current.Annotations[deploymentAnnotationsAnnotation]; applied != "" {
+		for _, k := range strings.Split(applied, ",") {
+			if _, ok := desired.Annotations[k]; !ok {
+				annotations[k] = nil
+			}
+		}
+
+		if _, ok := desired.Annotations[deploymentAnnotationsAnnotation]; !ok {
+			annotations[deploymentAnnotationsAnnotation] = nil
+		}
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+}
+
+func (hc *HabitatController) findJobInCache(j *batchv1.Job) (*batchv1.Job, error) {
+	k, err := cache.MetaNamespaceKeyFunc(j)
+	if err != nil {
+		level.Error(hc.logger).Log("msg", "Job key could not be retrieved", "name", j)
+		return nil, err
+	}
+
+	obj, exists, err := hc.jobInformer.GetStore().GetByKey(k)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, keyNotFoundError{key: k}
+	}
+
+	return obj.(*batchv1.Job), nil
+}
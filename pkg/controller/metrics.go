@@ -0,0 +1,71 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"github.com/kinvolk/habitat-operator/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "habitat_operator"
+
+type metrics struct {
+	// Each controller has its own registry, so that creating several
+	// controllers doesn't fail with duplicate registrations.
+	registry *prometheus.Registry
+
+	reconcileErrors   prometheus.Counter
+	reconcileDuration prometheus.Histogram
+}
+
+func newMetrics(hc *HabitatController) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		reconcileErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reconcile_errors_total",
+			Help:      "Number of failed reconciliations of Habitats.",
+		}),
+		reconcileDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "reconcile_duration_seconds",
+			Help:      "Time taken to reconcile a Habitat.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+
+	// The cache already knows how many Habitats there are, so it's only
+	// queried when the metrics are scraped.
+	habitats := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "habitats",
+		Help:      "Number of Habitats managed by the operator.",
+	}, func() float64 {
+		return float64(len(hc.habInformer.GetStore().ListKeys()))
+	})
+
+	// The build is described by the labels, so that it can be joined with
+	// other metrics.
+	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_info",
+		Help:      "Build information of the operator. Always 1.",
+	}, []string{"version", "commit", "build_date"})
+	buildInfo.WithLabelValues(version.Version, version.Commit, version.BuildDate).Set(1)
+
+	m.registry.MustRegister(m.reconcileErrors, m.reconcileDuration, habitats, buildInfo)
+
+	return m
+}
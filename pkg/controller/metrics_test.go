@@ -0,0 +1,72 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestMetrics(t *testing.T) {
+	hc := &HabitatController{
+		habInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &habv1beta1.Habitat{}, 0, cache.Indexers{}),
+	}
+	hc.metrics = newMetrics(hc)
+
+	hc.habInformer.GetStore().Add(&habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+	})
+	hc.metrics.reconcileErrors.Inc()
+
+	families, err := hc.metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]float64{}
+	for _, f := range families {
+		m := f.GetMetric()[0]
+		switch {
+		case m.Counter != nil:
+			values[f.GetName()] = m.Counter.GetValue()
+		case m.Gauge != nil:
+			values[f.GetName()] = m.Gauge.GetValue()
+		case m.Histogram != nil:
+			values[f.GetName()] = float64(m.Histogram.GetSampleCount())
+		}
+	}
+
+	expected := map[string]float64{
+		"habitat_operator_habitats":                   1,
+		"habitat_operator_reconcile_errors_total":     1,
+		"habitat_operator_reconcile_duration_seconds": 0,
+		"habitat_operator_build_info":                 1,
+	}
+
+	for name, value := range expected {
+		v, ok := values[name]
+		if !ok {
+			t.Errorf("metric %s not found", name)
+			continue
+		}
+		if v != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, v)
+		}
+	}
+}
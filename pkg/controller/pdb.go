@@ -0,0 +1,154 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/go-kit/kit/log/level"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+func (hc *HabitatController) cachePodDisruptionBudgets() {
+	source := newListWatchFromClientWithLabels(
+		hc.config.KubernetesClientset.PolicyV1beta1().RESTClient(),
+		"poddisruptionbudgets",
+		hc.config.Namespace,
+		labelListOptions())
+
+	hc.pdbInformer = cache.NewSharedIndexInformer(
+		source,
+		&policyv1beta1.PodDisruptionBudget{},
+		hc.config.ResyncPeriod,
+		cache.Indexers{},
+	)
+
+	hc.pdbInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: hc.handlePDBDelete,
+	})
+
+	hc.pdbInformerSynced = hc.pdbInformer.HasSynced
+}
+
+func (hc *HabitatController) handlePDBDelete(obj interface{}) {
+	pdb, ok := unwrapTombstone(obj).(*policyv1beta1.PodDisruptionBudget)
+	if !ok {
+		level.Error(hc.logger).Log("msg", "Failed to type assert PodDisruptionBudget", "obj", obj)
+		return
+	}
+
+	h, err := hc.getHabitatFromLabeledResource(pdb)
+	if err != nil {
+		// Could not find Habitat, it must have already been removed.
+		level.Debug(hc.logger).Log("msg", "Could not find Habitat for PodDisruptionBudget", "name", pdb.Name)
+		return
+	}
+
+	// Recreate the PodDisruptionBudget, if it was deleted while the Habitat
+	// still exists.
+	hc.enqueue(h)
+}
+
+// pdbName returns the name of the PodDisruptionBudget of a Habitat.
+func pdbName(h *habv1beta1.Habitat) string {
+	return shortName(h.Name)
+}
+
+// newPodDisruptionBudget returns the PodDisruptionBudget keeping MinAvailable
+// Pods of a Habitat available during voluntary disruptions. It's owned by the
+// workload running the Habitat, so that it gets garbage collected together
+// with it.
+func newPodDisruptionBudget(h *habv1beta1.Habitat, owner metav1.OwnerReference) *policyv1beta1.PodDisruptionBudget {
+	minAvailable := intstr.FromInt(int(*h.Spec.MinAvailable))
+
+	return &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pdbName(h),
+			Namespace: h.Namespace,
+			Labels: map[string]string{
+				habv1beta1.HabitatLabel:     "true",
+				habv1beta1.HabitatNameLabel: habitatLabelValue(h),
+				habv1beta1.CreatedByLabel:   habv1beta1.CreatedBy,
+			},
+			Annotations:     operatorAnnotations(),
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector:     newWorkloadSelector(h),
+		},
+	}
+}
+
+// handlePodDisruptionBudget creates the PodDisruptionBudget of the Habitat, if
+// MinAvailable is set, and deletes it otherwise. The spec of a
+// PodDisruptionBudget can't be updated, so it's replaced when MinAvailable
+// changes.
+func (hc *HabitatController) handlePodDisruptionBudget(ctx context.Context, h *habv1beta1.Habitat, owner metav1.OwnerReference) error {
+	obj, exists, err := hc.pdbInformer.GetStore().GetByKey(h.Namespace + "/" + pdbName(h))
+	if err != nil {
+		return err
+	}
+
+	var current *policyv1beta1.PodDisruptionBudget
+	if exists {
+		current = obj.(*policyv1beta1.PodDisruptionBudget)
+	}
+
+	if h.Spec.MinAvailable == nil {
+		if current == nil {
+			return nil
+		}
+
+		if err := hc.deletePodDisruptionBudget(ctx, current); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		level.Info(hc.logger).Log("msg", "deleted PodDisruptionBudget", "name", current.Name)
+
+		return nil
+	}
+
+	pdb := newPodDisruptionBudget(h, owner)
+
+	if current != nil {
+		if reflect.DeepEqual(current.Spec.MinAvailable, pdb.Spec.MinAvailable) {
+			return nil
+		}
+
+		if err := hc.deletePodDisruptionBudget(ctx, current); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if _, err := hc.createPodDisruptionBudget(ctx, pdb); err != nil {
+		// The cache is not in sync yet.
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	level.Info(hc.logger).Log("msg", "created PodDisruptionBudget", "name", pdb.Name, "minAvailable", pdb.Spec.MinAvailable.String())
+
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serve serves the handler on the given address, until the context is
+// canceled.
+func (hc *HabitatController) serve(ctx context.Context, name, addr string, handler http.Handler) {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	hc.runServer(ctx, name, srv, srv.ListenAndServe)
+}
+
+// serveTLS is like serve, but serves HTTPS using the given certificate and
+// key.
+func (hc *HabitatController) serveTLS(ctx context.Context, name, addr string, handler http.Handler, certFile, keyFile string) {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	hc.runServer(ctx, name, srv, func() error {
+		return srv.ListenAndServeTLS(certFile, keyFile)
+	})
+}
+
+// runServer runs listen, which must start srv, until the context is canceled.
+func (hc *HabitatController) runServer(ctx context.Context, name string, srv *http.Server, listen func() error) {
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			level.Error(hc.logger).Log("msg", "Failed to shut down server", "server", name, "err", err)
+		}
+	}()
+
+	level.Info(hc.logger).Log("msg", "Starting server", "server", name, "address", srv.Addr)
+
+	if err := listen(); err != http.ErrServerClosed {
+		level.Error(hc.logger).Log("msg", "Server failed", "server", name, "err", err)
+	}
+}
+
+// metricsHandler serves the Prometheus metrics of the controller.
+// It must only be used after the informers have been created.
+func (hc *HabitatController) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(hc.metrics.registry, promhttp.HandlerOpts{}))
+
+	return mux
+}
+
+// ServeHealth serves the health endpoints of the controller on
+// Config.HealthAddress until the context is canceled. It's independent of Run,
+// so that replicas waiting to be elected leader serve them too.
+func (hc *HabitatController) ServeHealth(ctx context.Context) {
+	if hc.config.HealthAddress == "" {
+		return
+	}
+
+	hc.serve(ctx, "health", hc.config.HealthAddress, hc.healthHandler())
+}
+
+// healthHandler serves the health endpoints of the controller.
+// `/healthz` succeeds as long as the process is serving requests, while
+// `/readyz` only succeeds once the caches have been synced, or while waiting
+// to be elected leader.
+func (hc *HabitatController) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if hc.config.LeaderElection && atomic.LoadInt32(&hc.started) == 0 {
+			w.Write([]byte("standby"))
+			return
+		}
+		if !hc.cachesSynced() {
+			http.Error(w, "caches not synced", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	return mux
+}
+
+// cachesSynced returns whether the caches of all the informers have been
+// synced.
+func (hc *HabitatController) cachesSynced() bool {
+	return atomic.LoadInt32(&hc.synced) == 1
+}
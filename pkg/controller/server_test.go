@@ -0,0 +1,71 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	hc := &HabitatController{}
+	handler := hc.healthHandler()
+
+	check := func(path string, expected int) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+
+		if rec.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", path, expected, rec.Code)
+		}
+	}
+
+	check("/healthz", http.StatusOK)
+	check("/readyz", http.StatusServiceUnavailable)
+
+	atomic.StoreInt32(&hc.synced, 1)
+
+	check("/healthz", http.StatusOK)
+	check("/readyz", http.StatusOK)
+}
+
+func TestHealthHandlerWithLeaderElection(t *testing.T) {
+	hc := &HabitatController{config: Config{LeaderElection: true}}
+	handler := hc.healthHandler()
+
+	check := func(path string, expected int) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+
+		if rec.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", path, expected, rec.Code)
+		}
+	}
+
+	// Replicas waiting to be elected leader are ready.
+	check("/healthz", http.StatusOK)
+	check("/readyz", http.StatusOK)
+
+	atomic.StoreInt32(&hc.started, 1)
+
+	check("/healthz", http.StatusOK)
+	check("/readyz", http.StatusServiceUnavailable)
+
+	atomic.StoreInt32(&hc.synced, 1)
+
+	check("/readyz", http.StatusOK)
+}
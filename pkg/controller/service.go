@@ -0,0 +1,346 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/go-kit/kit/log/level"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+)
+
+func (hc *HabitatController) cacheServices() {
+	source := newListWatchFromClientWithLabels(
+		hc.config.KubernetesClientset.CoreV1().RESTClient(),
+		"services",
+		hc.config.Namespace,
+		labelListOptions())
+
+	hc.svcInformer = cache.NewSharedIndexInformer(
+		source,
+		&apiv1.Service{},
+		hc.config.ResyncPeriod,
+		cache.Indexers{},
+	)
+
+	hc.svcInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: hc.handleSvcDelete,
+	})
+
+	hc.svcInformerSynced = hc.svcInformer.HasSynced
+}
+
+func (hc *HabitatController) handleSvcDelete(obj interface{}) {
+	svc, ok := unwrapTombstone(obj).(*apiv1.Service)
+	if !ok {
+		level.Error(hc.logger).Log("msg", "Failed to type assert Service", "obj", obj)
+		return
+	}
+
+	h, err := hc.getHabitatFromLabeledResource(svc)
+	if err != nil {
+		// Could not find Habitat, it must have already been removed.
+		level.Debug(hc.logger).Log("msg", "Could not find Habitat for Service", "name", svc.Name)
+		return
+	}
+
+	// Recreate the Service, if it was deleted while the Habitat still exists.
+	hc.enqueue(h)
+}
+
+// supervisorServiceName returns the name of the Service exposing the
+// supervisors of a Habitat. It differs from the Habitat's name, so that users
+// are free to create a Service for their application with that name.
+func supervisorServiceName(h *habv1beta1.Habitat) string {
+	return shortName(fmt.Sprintf("%s-supervisor", h.Name))
+}
+
+// exposedServiceName returns the name of the Service publishing the ports of a
+// Habitat.
+func exposedServiceName(h *habv1beta1.Habitat) string {
+	return shortName(h.Name)
+}
+
+// newService returns a headless Service exposing the gossip and HTTP gateway
+// ports of the supervisors of a Habitat. It's owned by the workload running
+// the Habitat, so that it gets garbage collected together with it.
+func newService(h *habv1beta1.Habitat, owner metav1.OwnerReference) *apiv1.Service {
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      supervisorServiceName(h),
+			Namespace: h.Namespace,
+			Labels: map[string]string{
+				habv1beta1.HabitatLabel:     "true",
+				habv1beta1.HabitatNameLabel: habitatLabelValue(h),
+				habv1beta1.CreatedByLabel:   habv1beta1.CreatedBy,
+			},
+			Annotations:     operatorAnnotations(),
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Spec: apiv1.ServiceSpec{
+			ClusterIP: apiv1.ClusterIPNone,
+			Selector: map[string]string{
+				habv1beta1.HabitatNameLabel: habitatLabelValue(h),
+			},
+			// Supervisors need to find each other before they are ready.
+			PublishNotReadyAddresses: true,
+			Ports: []apiv1.ServicePort{
+				{
+					Name:     "gossip-tcp",
+					Protocol: apiv1.ProtocolTCP,
+					Port:     gossipListenPort(h),
+				},
+				{
+					Name:     "gossip-udp",
+					Protocol: apiv1.ProtocolUDP,
+					Port:     gossipListenPort(h),
+				},
+				{
+					Name:     httpGatewayPortName,
+					Protocol: apiv1.ProtocolTCP,
+					Port:     httpListenPort(h),
+				},
+			},
+		},
+	}
+}
+
+// handleService creates or updates the Service exposing the supervisors of
+// the Habitat, so that it follows changes of their ports.
+func (hc *HabitatController) handleService(ctx context.Context, h *habv1beta1.Habitat, owner metav1.OwnerReference) error {
+	svc := newService(h, owner)
+
+	k, err := cache.MetaNamespaceKeyFunc(svc)
+	if err != nil {
+		return err
+	}
+
+	obj, exists, err := hc.svcInformer.GetStore().GetByKey(k)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if _, err := hc.createService(ctx, svc); err != nil {
+			// The cache is not in sync yet.
+			if apierrors.IsAlreadyExists(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		level.Info(hc.logger).Log("msg", "created service", "name", svc.Name)
+
+		return nil
+	}
+
+	current := obj.(*apiv1.Service)
+
+	if !isOwnedByHabitat(current, h) {
+		return nameConflictError{kind: "Service", name: svc.Name}
+	}
+
+	if !serviceNeedsUpdate(current, svc) {
+		return nil
+	}
+
+	if _, err := hc.updateService(ctx, updatedService(current, svc)); err != nil {
+		return err
+	}
+
+	level.Info(hc.logger).Log("msg", "updated service", "name", svc.Name)
+
+	return nil
+}
+
+// newExposedService returns the Service publishing the ports listed in the
+// Expose field of a Habitat. Like the Service exposing the supervisors, it's
+// owned by the workload running the Habitat.
+func newExposedService(h *habv1beta1.Habitat, owner metav1.OwnerReference) *apiv1.Service {
+	annotations := operatorAnnotations()
+	for k, v := range h.Spec.Expose.Annotations {
+		annotations[k] = v
+	}
+
+	return &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      exposedServiceName(h),
+			Namespace: h.Namespace,
+			Labels: map[string]string{
+				habv1beta1.HabitatLabel:     "true",
+				habv1beta1.HabitatNameLabel: habitatLabelValue(h),
+				habv1beta1.CreatedByLabel:   habv1beta1.CreatedBy,
+			},
+			Annotations:     annotations,
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Spec: apiv1.ServiceSpec{
+			Type:     h.Spec.Expose.Type,
+			Selector: newWorkloadSelector(h).MatchLabels,
+			Ports:    h.Spec.Expose.Ports,
+		},
+	}
+}
+
+// handleExposedService creates or updates the Service publishing the ports of
+// the Habitat, if Expose is set, and deletes it otherwise. Services with the
+// name of the Habitat that weren't created for it are left alone.
+func (hc *HabitatController) handleExposedService(ctx context.Context, h *habv1beta1.Habitat, owner metav1.OwnerReference) error {
+	obj, exists, err := hc.svcInformer.GetStore().GetByKey(h.Namespace + "/" + exposedServiceName(h))
+	if err != nil {
+		return err
+	}
+
+	var current *apiv1.Service
+	if exists {
+		current = obj.(*apiv1.Service)
+	}
+
+	if h.Spec.Expose == nil {
+		if current == nil || !isOwnedByHabitat(current, h) {
+			return nil
+		}
+
+		if err := hc.deleteService(ctx, current); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+
+		level.Info(hc.logger).Log("msg", "deleted service", "name", current.Name)
+
+		return nil
+	}
+
+	svc := newExposedService(h, owner)
+
+	if current == nil {
+		if _, err := hc.createService(ctx, svc); err != nil {
+			// The cache is not in sync yet.
+			if apierrors.IsAlreadyExists(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		level.Info(hc.logger).Log("msg", "created service", "name", svc.Name)
+		hc.config.EventRecorder.Eventf(h, apiv1.EventTypeNormal, reasonCreated, "Created service %s", svc.Name)
+
+		return nil
+	}
+
+	if !isOwnedByHabitat(current, h) {
+		return nameConflictError{kind: "Service", name: svc.Name}
+	}
+
+	if !serviceNeedsUpdate(current, svc) {
+		return nil
+	}
+
+	if _, err := hc.updateService(ctx, updatedService(current, svc)); err != nil {
+		return err
+	}
+
+	level.Info(hc.logger).Log("msg", "updated service", "name", svc.Name)
+	hc.config.EventRecorder.Eventf(h, apiv1.EventTypeNormal, reasonUpdated, "Updated service %s", svc.Name)
+
+	return nil
+}
+
+// updatedService returns a copy of the current Service with the fields set by
+// the operator taken from the desired one. The fields defaulted by the API
+// server are kept.
+func updatedService(current, desired *apiv1.Service) *apiv1.Service {
+	updated := current.DeepCopy()
+	updated.Spec.Type = desired.Spec.Type
+	updated.Spec.Selector = desired.Spec.Selector
+	updated.Spec.Ports = withAllocatedNodePorts(desired, current)
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string, len(desired.Annotations))
+	}
+	for k, v := range desired.Annotations {
+		updated.Annotations[k] = v
+	}
+
+	return updated
+}
+
+// serviceNeedsUpdate returns true if the fields of the current Service set by
+// the operator differ from the desired ones. The API server defaults the
+// cluster IP, node ports and target ports, so they're only compared when set.
+func serviceNeedsUpdate(current, desired *apiv1.Service) bool {
+	desiredType := desired.Spec.Type
+	if desiredType == "" {
+		desiredType = apiv1.ServiceTypeClusterIP
+	}
+	if current.Spec.Type != desiredType {
+		return true
+	}
+
+	if !reflect.DeepEqual(current.Spec.Selector, desired.Spec.Selector) {
+		return true
+	}
+
+	if annotationsChanged(current.Annotations, desired.Annotations) {
+		return true
+	}
+
+	if len(current.Spec.Ports) != len(desired.Spec.Ports) {
+		return true
+	}
+	for i, p := range withAllocatedNodePorts(desired, current) {
+		if p.Protocol == "" {
+			p.Protocol = apiv1.ProtocolTCP
+		}
+		if p.TargetPort == (intstr.IntOrString{}) {
+			p.TargetPort = intstr.FromInt(int(p.Port))
+		}
+		if !reflect.DeepEqual(current.Spec.Ports[i], p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withAllocatedNodePorts returns the ports of the desired Service, with the
+// node ports left unset taken from the ports of the same name of the current
+// Service. Otherwise, every update of the Service would allocate new node
+// ports. Services of the ClusterIP type can't have node ports.
+func withAllocatedNodePorts(desired, current *apiv1.Service) []apiv1.ServicePort {
+	allocated := make(map[string]int32, len(current.Spec.Ports))
+	if t := desired.Spec.Type; t == apiv1.ServiceTypeNodePort || t == apiv1.ServiceTypeLoadBalancer {
+		for _, p := range current.Spec.Ports {
+			allocated[p.Name] = p.NodePort
+		}
+	}
+
+	result := make([]apiv1.ServicePort, len(desired.Spec.Ports))
+	for i, p := range desired.Spec.Ports {
+		if p.NodePort == 0 {
+			p.NodePort = allocated[p.Name]
+		}
+		result[i] = p
+	}
+
+	return result
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"reflect"
+
+	"github.com/go-kit/kit/log/level"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	jsonserializer "k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/apimachinery/pkg/runtime/serializer/streaming"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	restclientwatch "k8s.io/client-go/rest/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// The API of the ServiceMonitors of the Prometheus operator.
+	serviceMonitorGroupVersion = "monitoring.coreos.com/v1"
+	serviceMonitorResource     = "servicemonitors"
+
+	// The path on which the HTTP gateway of the supervisors serves metrics.
+	gatewayMetricsPath = "/metrics"
+)
+
+// The Prometheus operator isn't a dependency of the operator, so only the
+// fields of ServiceMonitors it sets are defined here.
+
+type serviceMonitor struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              serviceMonitorSpec `json:"spec"`
+}
+
+type serviceMonitorSpec struct {
+	Selector  metav1.LabelSelector     `json:"selector"`
+	Endpoints []serviceMonitorEndpoint `json:"endpoints"`
+}
+
+type serviceMonitorEndpoint struct {
+	Port              string                   `json:"port"`
+	Path              string                   `json:"path,omitempty"`
+	BearerTokenSecret *apiv1.SecretKeySelector `json:"bearerTokenSecret,omitempty"`
+}
+
+// detectServiceMonitors returns true if ServiceMonitors are requested, and
+// the Prometheus operator's CRD defining them exists.
+func (hc *HabitatController) detectServiceMonitors() bool {
+	if !hc.config.ServiceMonitors {
+		return false
+	}
+
+	resources, err := hc.config.KubernetesClientset.Discovery().ServerResourcesForGroupVersion(serviceMonitorGroupVersion)
+	if err == nil {
+		for _, r := range resources.APIResources {
+			if r.Name == serviceMonitorResource {
+				level.Info(hc.logger).Log("msg", "Monitoring integration enabled, creating ServiceMonitors")
+				return true
+			}
+		}
+	}
+
+	level.Warn(hc.logger).Log("msg", "ServiceMonitor CRD not found, monitoring integration is disabled", "err", err)
+
+	return false
+}
+
+// serviceMonitorsAPIPath returns the path of the ServiceMonitors of namespace
+// ns, or of all namespaces if it's empty.
+func serviceMonitorsAPIPath(ns string) string {
+	if ns == "" {
+		return path.Join("/apis", serviceMonitorGroupVersion, serviceMonitorResource)
+	}
+
+	return path.Join("/apis", serviceMonitorGroupVersion, "namespaces", ns, serviceMonitorResource)
+}
+
+// cacheServiceMonitors caches the ServiceMonitors created by the operator.
+// There's no typed client for them, so they're cached as unstructured
+// objects.
+func (hc *HabitatController) cacheServiceMonitors() {
+	client := hc.config.KubernetesClientset.CoreV1().RESTClient()
+	smPath := serviceMonitorsAPIPath(hc.config.Namespace)
+	selector := labelListOptions().LabelSelector
+
+	source := &cache.ListWatch{
+		ListFunc: func(_ metav1.ListOptions) (runtime.Object, error) {
+			raw, err := client.Get().AbsPath(smPath).Param("labelSelector", selector).Do().Raw()
+			if err != nil {
+				return nil, err
+			}
+
+			list := &unstructured.UnstructuredList{}
+			if err := list.UnmarshalJSON(raw); err != nil {
+				return nil, err
+			}
+
+			return list, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			stream, err := client.Get().
+				AbsPath(smPath).
+				Param("labelSelector", selector).
+				Param("resourceVersion", options.ResourceVersion).
+				Param("watch", "true").
+				Stream()
+			if err != nil {
+				return nil, err
+			}
+
+			decoder := streaming.NewDecoder(jsonserializer.Framer.NewFrameReader(stream), unstructured.UnstructuredJSONScheme)
+
+			return watch.NewStreamWatcher(restclientwatch.NewDecoder(decoder, unstructured.UnstructuredJSONScheme)), nil
+		},
+	}
+
+	hc.smInformer = cache.NewSharedIndexInformer(
+		source,
+		&unstructured.Unstructured{},
+		hc.config.ResyncPeriod,
+		cache.Indexers{},
+	)
+
+	hc.smInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: hc.handleServiceMonitorDelete,
+	})
+
+	hc.smInformerSynced = hc.smInformer.HasSynced
+}
+
+func (hc *HabitatController) handleServiceMonitorDelete(obj interface{}) {
+	sm, ok := unwrapTombstone(obj).(*unstructured.Unstructured)
+	if !ok {
+		level.Error(hc.logger).Log("msg", "Failed to type assert ServiceMonitor", "obj", obj)
+		return
+	}
+
+	h, err := hc.getHabitatFromLabeledResource(sm)
+	if err != nil {
+		// Could not find Habitat, it must have already been removed.
+		level.Debug(hc.logger).Log("msg", "Could not find Habitat for ServiceMonitor", "name", sm.GetName())
+		return
+	}
+
+	// Recreate the ServiceMonitor, if it was deleted while the Habitat still
+	// exists.
+	hc.enqueue(h)
+}
+
+// newServiceMonitor returns the ServiceMonitor making the Prometheus operator
+// scrape the HTTP gateways of the supervisors of a Habitat, through the
+// Service exposing them. It's owned by the workload running the Habitat, so
+// that it gets garbage collected together with it.
+func newServiceMonitor(h *habv1beta1.Habitat, owner metav1.OwnerReference) *serviceMonitor {
+	endpoint := serviceMonitorEndpoint{
+		Port: httpGatewayPortName,
+		Path: gatewayMetricsPath,
+	}
+	if name := h.Spec.GatewayAuthTokenSecretName; name != "" {
+		endpoint.BearerTokenSecret = &apiv1.SecretKeySelector{
+			LocalObjectReference: apiv1.LocalObjectReference{Name: name},
+			Key:                  gatewayAuthTokenKey,
+		}
+	}
+
+	return &serviceMonitor{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: serviceMonitorGroupVersion,
+			Kind:       "ServiceMonitor",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      supervisorServiceName(h),
+			Namespace: h.Namespace,
+			Labels: map[string]string{
+				habv1beta1.HabitatLabel:     "true",
+				habv1beta1.HabitatNameLabel: habitatLabelValue(h),
+				habv1beta1.CreatedByLabel:   habv1beta1.CreatedBy,
+			},
+			Annotations:     operatorAnnotations(),
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Spec: serviceMonitorSpec{
+			Selector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					habv1beta1.HabitatNameLabel: habitatLabelValue(h),
+					habv1beta1.CreatedByLabel:   habv1beta1.CreatedBy,
+				},
+			},
+			Endpoints: []serviceMonitorEndpoint{endpoint},
+		},
+	}
+}
+
+// handleServiceMonitor creates or updates the ServiceMonitor of the Habitat,
+// if the monitoring integration is enabled.
+func (hc *HabitatController) handleServiceMonitor(ctx context.Context, h *habv1beta1.Habitat, owner metav1.OwnerReference) error {
+	if !hc.serviceMonitors {
+		return nil
+	}
+
+	sm := newServiceMonitor(h, owner)
+
+	obj, exists, err := hc.smInformer.GetStore().GetByKey(sm.Namespace + "/" + sm.Name)
+	if err != nil {
+		return err
+	}
+
+	core, cancel := hc.coreClient(ctx)
+	defer cancel()
+
+	if exists {
+		current, err := toServiceMonitor(obj.(*unstructured.Unstructured))
+		if err != nil {
+			return err
+		}
+
+		if !isOwnedByHabitat(current, h) {
+			return nameConflictError{kind: "ServiceMonitor", name: sm.Name}
+		}
+
+		if !serviceMonitorNeedsUpdate(current, sm) {
+			return nil
+		}
+
+		if hc.dryRun("update", sm) {
+			return nil
+		}
+
+		// Annotations added by others are kept.
+		body, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations":     sm.Annotations,
+				"ownerReferences": sm.OwnerReferences,
+			},
+			"spec": sm.Spec,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = core.RESTClient().Patch(types.MergePatchType).
+			AbsPath(serviceMonitorsAPIPath(sm.Namespace), sm.Name).
+			Body(body).
+			Do().
+			Error()
+		if err != nil {
+			return err
+		}
+
+		level.Info(hc.logger).Log("msg", "updated ServiceMonitor", "name", sm.Name)
+
+		return nil
+	}
+
+	if hc.dryRun("create", sm) {
+		return nil
+	}
+
+	body, err := json.Marshal(sm)
+	if err != nil {
+		return err
+	}
+
+	err = core.RESTClient().Post().
+		AbsPath(serviceMonitorsAPIPath(sm.Namespace)).
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		Do().
+		Error()
+	if err != nil {
+		// It was created in the meantime.
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	level.Info(hc.logger).Log("msg", "created ServiceMonitor", "name", sm.Name)
+
+	return nil
+}
+
+// toServiceMonitor converts a cached ServiceMonitor to the fields of it the
+// operator knows.
+func toServiceMonitor(u *unstructured.Unstructured) (*serviceMonitor, error) {
+	b, err := u.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var sm serviceMonitor
+	if err := json.Unmarshal(b, &sm); err != nil {
+		return nil, err
+	}
+
+	return &sm, nil
+}
+
+// serviceMonitorNeedsUpdate returns true if the fields of the current
+// ServiceMonitor set by the operator differ from the desired ones.
+func serviceMonitorNeedsUpdate(current, desired *serviceMonitor) bool {
+	return !reflect.DeepEqual(current.Spec, desired.Spec) ||
+		!reflect.DeepEqual(current.OwnerReferences, desired.OwnerReferences) ||
+		annotationsChanged(current.Annotations, desired.Annotations)
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+const serviceMonitorsPath = "/apis/monitoring.coreos.com/v1"
+
+// newFakeAPIServer returns an API server serving the ServiceMonitors API if
+// withCRD is true, and recording the ServiceMonitors created and the patches
+// sent for the ServiceMonitor of the Habitat foo.
+func newFakeAPIServer(t *testing.T, withCRD bool, created, patched *[]serviceMonitor) *httptest.Server {
+	notFound := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonNotFound,
+			Code:     http.StatusNotFound,
+		})
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !withCRD:
+			notFound(w)
+		case r.Method == http.MethodGet && r.URL.Path == serviceMonitorsPath:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(metav1.APIResourceList{
+				TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+				GroupVersion: serviceMonitorGroupVersion,
+				APIResources: []metav1.APIResource{{Name: serviceMonitorResource, Namespaced: true, Kind: "ServiceMonitor"}},
+			})
+		case r.Method == http.MethodPost && r.URL.Path == serviceMonitorsPath+"/namespaces/default/servicemonitors":
+			var sm serviceMonitor
+			if err := json.NewDecoder(r.Body).Decode(&sm); err != nil {
+				t.Errorf("could not decode ServiceMonitor: %v", err)
+			}
+			*created = append(*created, sm)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(sm)
+		case r.Method == http.MethodPatch && r.URL.Path == serviceMonitorsPath+"/namespaces/default/servicemonitors/foo-supervisor":
+			if ct := r.Header.Get("Content-Type"); ct != string(types.MergePatchType) {
+				t.Errorf("expected a merge patch, got Content-Type %q", ct)
+			}
+			var sm serviceMonitor
+			if err := json.NewDecoder(r.Body).Decode(&sm); err != nil {
+				t.Errorf("could not decode ServiceMonitor patch: %v", err)
+			}
+			*patched = append(*patched, sm)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(sm)
+		default:
+			notFound(w)
+		}
+	}))
+}
+
+func TestServiceMonitors(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			GatewayAuthTokenSecretName: "gateway-token",
+		},
+	}
+	owner := metav1.OwnerReference{Kind: "Deployment", Name: h.Name}
+
+	for _, withCRD := range []bool{true, false} {
+		var created, patched []serviceMonitor
+		srv := newFakeAPIServer(t, withCRD, &created, &patched)
+		defer srv.Close()
+
+		clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hc := &HabitatController{
+			config:     Config{KubernetesClientset: clientset, ServiceMonitors: true},
+			logger:     log.NewNopLogger(),
+			smInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &unstructured.Unstructured{}, 0, cache.Indexers{}),
+		}
+
+		hc.serviceMonitors = hc.detectServiceMonitors()
+		if hc.serviceMonitors != withCRD {
+			t.Errorf("CRD present %t: expected ServiceMonitors enabled %t, got %t", withCRD, withCRD, hc.serviceMonitors)
+		}
+
+		if err := hc.handleServiceMonitor(context.Background(), h, owner); err != nil {
+			t.Fatal(err)
+		}
+
+		if !withCRD {
+			if len(created) != 0 {
+				t.Errorf("expected no ServiceMonitor to be created without the CRD, got %v", created)
+			}
+			continue
+		}
+
+		if len(created) != 1 {
+			t.Fatalf("expected a ServiceMonitor to be created, got %v", created)
+		}
+
+		sm := created[0]
+		if sm.Spec.Selector.MatchLabels[habv1beta1.HabitatNameLabel] != h.Name {
+			t.Errorf("expected ServiceMonitor to select the Service of Habitat %s, got selector %v", h.Name, sm.Spec.Selector)
+		}
+		if e := sm.Spec.Endpoints; len(e) != 1 || e[0].Port != httpGatewayPortName || e[0].BearerTokenSecret == nil || e[0].BearerTokenSecret.Name != "gateway-token" {
+			t.Errorf("expected ServiceMonitor to scrape the authenticated HTTP gateway, got endpoints %v", e)
+		}
+	}
+}
+
+func TestServiceMonitorIsUpdated(t *testing.T) {
+	h := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			GatewayAuthTokenSecretName: "gateway-token",
+		},
+	}
+	owner := metav1.OwnerReference{Kind: "Deployment", Name: h.Name}
+
+	var created, patched []serviceMonitor
+	srv := newFakeAPIServer(t, true, &created, &patched)
+	defer srv.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &HabitatController{
+		config:          Config{KubernetesClientset: clientset, ServiceMonitors: true},
+		logger:          log.NewNopLogger(),
+		serviceMonitors: true,
+		smInformer:      cache.NewSharedIndexInformer(&cache.ListWatch{}, &unstructured.Unstructured{}, 0, cache.Indexers{}),
+	}
+
+	// The ServiceMonitor was created before the gateway required a token.
+	outdated := newServiceMonitor(h, owner)
+	outdated.Spec.Endpoints[0].BearerTokenSecret = nil
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(outdated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.smInformer.GetStore().Add(&unstructured.Unstructured{Object: obj}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hc.handleServiceMonitor(context.Background(), h, owner); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(created) != 0 {
+		t.Errorf("expected the existing ServiceMonitor not to be created again, got %v", created)
+	}
+	if len(patched) != 1 {
+		t.Fatalf("expected the existing ServiceMonitor to be patched, got %v", patched)
+	}
+	if e := patched[0].Spec.Endpoints; len(e) != 1 || e[0].BearerTokenSecret == nil || e[0].BearerTokenSecret.Name != "gateway-token" {
+		t.Errorf("expected the patch to set the gateway auth token, got endpoints %v", e)
+	}
+
+	// Once up to date, the ServiceMonitor is left alone.
+	obj, err = runtime.DefaultUnstructuredConverter.ToUnstructured(newServiceMonitor(h, owner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.smInformer.GetStore().Update(&unstructured.Unstructured{Object: obj}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hc.handleServiceMonitor(context.Background(), h, owner); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(patched) != 1 {
+		t.Errorf("expected an up to date ServiceMonitor not to be patched, got %d patches", len(patched))
+	}
+}
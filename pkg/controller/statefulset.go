@@ -0,0 +1,291 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func (hc *HabitatController) cacheStatefulSets() {
+	source := newListWatchFromClientWithLabels(
+		hc.config.KubernetesClientset.AppsV1().RESTClient(),
+		"statefulsets",
+		hc.config.Namespace,
+		labelListOptions())
+
+	hc.stsInformer = cache.NewSharedIndexInformer(
+		source,
+		&appsv1.StatefulSet{},
+		hc.config.ResyncPeriod,
+		cache.Indexers{},
+	)
+
+	hc.stsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    hc.handleStsAdd,
+		UpdateFunc: hc.handleStsUpdate,
+		DeleteFunc: hc.handleStsDelete,
+	})
+
+	hc.stsInformerSynced = hc.stsInformer.HasSynced
+}
+
+func (hc *HabitatController) handleStsAdd(obj interface{}) {
+	sts, ok := obj.(*appsv1.StatefulSet)
+	if !ok {
+		level.Error(hc.logger).Log("msg", "Failed to type assert StatefulSet", "obj", obj)
+		return
+	}
+
+	h, err := hc.getHabitatFromLabeledResource(sts)
+	if err != nil {
+		level.Error(hc.logger).Log("msg", "Could not find Habitat for StatefulSet", "name", sts.Name)
+		return
+	}
+
+	hc.enqueue(h)
+}
+
+func (hc *HabitatController) handleStsUpdate(oldObj, newObj interface{}) {
+	sts, ok := newObj.(*appsv1.StatefulSet)
+	if !ok {
+		level.Error(hc.logger).Log("msg", "Failed to type assert StatefulSet", "obj", newObj)
+		return
+	}
+
+	h, err := hc.getHabitatFromLabeledResource(sts)
+	if err != nil {
+		level.Error(hc.logger).Log("msg", "Could not find Habitat for StatefulSet", "name", sts.Name)
+		return
+	}
+
+	hc.enqueue(h)
+}
+
+func (hc *HabitatController) handleStsDelete(obj interface{}) {
+	sts, ok := unwrapTombstone(obj).(*appsv1.StatefulSet)
+	if !ok {
+		level.Error(hc.logger).Log("msg", "Failed to type assert StatefulSet", "obj", obj)
+		return
+	}
+
+	h, err := hc.getHabitatFromLabeledResource(sts)
+	if err != nil {
+		// Could not find Habitat, it must have already been removed.
+		level.Debug(hc.logger).Log("msg", "Could not find Habitat for StatefulSet", "name", sts.Name)
+		return
+	}
+
+	hc.enqueue(h)
+}
+
+func (hc *HabitatController) newStatefulSet(ctx context.Context, h *habv1beta1.Habitat) (*appsv1.StatefulSet, error) {
+	// This value needs to be passed as a *int32, so we convert it, assign it to a
+	// variable and afterwards pass a pointer to it.
+	count := int32(h.Spec.Count)
+
+	template, err := hc.newPodTemplate(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	base := &appsv1.StatefulSet{
+		ObjectMeta: newWorkloadObjectMeta(h),
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &count,
+			Selector: newWorkloadSelector(h),
+			// The governing Service is created after the StatefulSet, as it's
+			// owned by it. It's only needed for the Pods' DNS entries.
+			ServiceName:         supervisorServiceName(h),
+			Template:            *template,
+			PodManagementPolicy: h.Spec.PodManagementPolicy,
+		},
+	}
+
+	if ps := h.Spec.PersistentStorage; ps != nil {
+		// Validation has already been performed by this point.
+		size, err := resource.ParseQuantity(ps.Size)
+		if err != nil {
+			return nil, err
+		}
+
+		claim := apiv1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: persistentVolumeName,
+			},
+			Spec: apiv1.PersistentVolumeClaimSpec{
+				AccessModes: []apiv1.PersistentVolumeAccessMode{
+					apiv1.ReadWriteOnce,
+				},
+				Resources: apiv1.ResourceRequirements{
+					Requests: apiv1.ResourceList{
+						apiv1.ResourceStorage: size,
+					},
+				},
+			},
+		}
+
+		if ps.StorageClassName != "" {
+			claim.Spec.StorageClassName = &ps.StorageClassName
+		}
+
+		mountPath := ps.MountPath
+		if mountPath == "" {
+			mountPath = fmt.Sprintf("/hab/svc/%s/data", h.Spec.Service.Name)
+		}
+
+		base.Spec.VolumeClaimTemplates = []apiv1.PersistentVolumeClaim{claim}
+		base.Spec.Template.Spec.Containers[0].VolumeMounts = append(base.Spec.Template.Spec.Containers[0].VolumeMounts, apiv1.VolumeMount{
+			Name:      persistentVolumeName,
+			MountPath: mountPath,
+		})
+	}
+
+	hash, err := specHash(&base.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	base.Annotations[specHashAnnotation] = hash
+
+	immutable, err := json.Marshal(immutableSpec(h.Spec))
+	if err != nil {
+		return nil, err
+	}
+
+	base.Annotations[immutableSpecAnnotation] = string(immutable)
+
+	return base, nil
+}
+
+// handleStatefulSet creates or updates the StatefulSet running the Habitat,
+// and returns a reference to it.
+func (hc *HabitatController) handleStatefulSet(ctx context.Context, h *habv1beta1.Habitat) (*metav1.OwnerReference, error) {
+	sts, err := hc.newStatefulSet(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+
+	cachedSts, err := hc.findStatefulSetInCache(sts)
+	if err != nil {
+		if _, ok := err.(keyNotFoundError); !ok {
+			return nil, err
+		}
+
+		// Create StatefulSet, if it doesn't already exist.
+		err = hc.retryCreate(ctx, h, "StatefulSet", sts.Name, func() (err error) {
+			cachedSts, err = hc.createStatefulSet(ctx, sts)
+			return err
+		})
+		if err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				return nil, err
+			}
+
+			// Either the cache is not in sync yet, or the StatefulSet was not
+			// created by the operator.
+			existing, err := hc.getStatefulSet(ctx, sts.Namespace, sts.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			if !isOwnedByHabitat(existing, h) {
+				return nil, nameConflictError{kind: "StatefulSet", name: sts.Name}
+			}
+
+			// It's ours, so update it, keeping the immutable fields.
+			sts.Spec.Selector = existing.Spec.Selector
+			sts.Spec.VolumeClaimTemplates = existing.Spec.VolumeClaimTemplates
+			sts.Spec.PodManagementPolicy = existing.Spec.PodManagementPolicy
+			sts.ResourceVersion = existing.ResourceVersion
+
+			if cachedSts, err = hc.updateStatefulSet(ctx, sts); err != nil {
+				return nil, err
+			}
+
+			level.Debug(hc.logger).Log("msg", "statefulset already existed", "name", sts.Name)
+		} else {
+			level.Info(hc.logger).Log("msg", "created statefulset", "name", sts.Name)
+			hc.config.EventRecorder.Eventf(h, apiv1.EventTypeNormal, reasonCreated, "Created statefulset %s", sts.Name)
+		}
+	} else if !isOwnedByHabitat(cachedSts, h) {
+		return nil, nameConflictError{kind: "StatefulSet", name: sts.Name}
+	} else if statefulSetNeedsUpdate(cachedSts, sts) {
+		// The selector is immutable, see handleDeployment.
+		sts.Spec.Selector = cachedSts.Spec.Selector
+		// So are the claim templates and the pod management policy, changes to
+		// them only apply to new StatefulSets.
+		sts.Spec.VolumeClaimTemplates = cachedSts.Spec.VolumeClaimTemplates
+		sts.Spec.PodManagementPolicy = cachedSts.Spec.PodManagementPolicy
+
+		if cachedSts, err = hc.updateStatefulSet(ctx, sts); err != nil {
+			return nil, err
+		}
+
+		level.Info(hc.logger).Log("msg", "updated statefulset", "name", sts.Name)
+		hc.config.EventRecorder.Eventf(h, apiv1.EventTypeNormal, reasonUpdated, "Updated statefulset %s", sts.Name)
+	} else {
+		level.Debug(hc.logger).Log("msg", "statefulset up to date", "name", sts.Name)
+	}
+
+	return newOwnerReference(cachedSts, appsv1.SchemeGroupVersion.WithKind("StatefulSet")), nil
+}
+
+// statefulSetNeedsUpdate returns true if the desired StatefulSet differs from
+// the one currently running in the cluster.
+func statefulSetNeedsUpdate(current, desired *appsv1.StatefulSet) bool {
+	if current.Annotations[specHashAnnotation] != desired.Annotations[specHashAnnotation] {
+		return true
+	}
+
+	// StatefulSets created by older versions of the operator lack the label.
+	if current.Labels[habv1beta1.CreatedByLabel] != desired.Labels[habv1beta1.CreatedByLabel] {
+		return true
+	}
+
+	if annotationsChanged(current.Annotations, desired.Annotations) {
+		return true
+	}
+
+	return workloadDrifted(current.Spec.Replicas, desired.Spec.Replicas, &current.Spec.Template, &desired.Spec.Template)
+}
+
+func (hc *HabitatController) findStatefulSetInCache(sts *appsv1.StatefulSet) (*appsv1.StatefulSet, error) {
+	k, err := cache.MetaNamespaceKeyFunc(sts)
+	if err != nil {
+		level.Error(hc.logger).Log("msg", "StatefulSet key could not be retrieved", "name", sts)
+		return nil, err
+	}
+
+	obj, exists, err := hc.stsInformer.GetStore().GetByKey(k)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, keyNotFoundError{key: k}
+	}
+
+	return obj.(*appsv1.StatefulSet), nil
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The operator may stop at any point of a reconciliation, e.g. after creating
+// the workload of a Habitat but before creating its Service, and Habitats may
+// be deleted while it isn't running. sweep is run on startup, once the caches
+// are synced, to catch up with both.
+
+// sweep enqueues the Habitats whose resources are missing, and deletes the
+// resources created by the operator for Habitats that don't exist anymore.
+func (hc *HabitatController) sweep(ctx context.Context) error {
+	habitats, err := hc.habLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	for _, h := range habitats {
+		if missing := hc.missingResources(applyDefaults(h, hc.config.Defaults)); len(missing) > 0 {
+			level.Info(hc.logger).Log("msg", "Habitat resources missing, reconciling", "name", h.Name, "namespace", h.Namespace, "missing", fmt.Sprint(missing))
+			hc.enqueue(h)
+		}
+	}
+
+	orphans, err := hc.orphanedResources()
+	if err != nil {
+		return err
+	}
+
+	for _, o := range orphans {
+		if err := hc.deleteOrphan(ctx, o); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// missingResources returns the kinds of the resources of the Habitat that are
+// not in the cache.
+func (hc *HabitatController) missingResources(h *habv1beta1.Habitat) []string {
+	workloadKind, workloadStore := hc.workloadStore(h)
+
+	type check struct {
+		kind  string
+		store cache.Store
+		name  string
+	}
+
+	checks := []check{
+		{workloadKind, workloadStore, workloadName(h)},
+		{"Service", hc.svcInformer.GetStore(), supervisorServiceName(h)},
+		{"ConfigMap", hc.cmInformer.GetStore(), peerConfigMapName(h)},
+	}
+	if h.Spec.Config != "" {
+		checks = append(checks, check{"ConfigMap", hc.cmInformer.GetStore(), userConfigMapName(h)})
+	}
+	if h.Spec.Expose != nil {
+		checks = append(checks, check{"Service", hc.svcInformer.GetStore(), h.Name})
+	}
+	if h.Spec.MinAvailable != nil {
+		checks = append(checks, check{"PodDisruptionBudget", hc.pdbInformer.GetStore(), h.Name})
+	}
+
+	var missing []string
+	for _, c := range checks {
+		if _, exists, err := c.store.GetByKey(h.Namespace + "/" + c.name); err != nil || !exists {
+			missing = append(missing, c.kind)
+		}
+	}
+
+	return missing
+}
+
+// orphanedResources returns the resources created by the operator for
+// Habitats that are not in the cache, and the peer ConfigMaps of the rings no
+// Habitat joins anymore.
+func (hc *HabitatController) orphanedResources() ([]metav1.Object, error) {
+	var orphans []metav1.Object
+
+	for _, obj := range hc.cmInformer.GetStore().List() {
+		cm, ok := obj.(*apiv1.ConfigMap)
+		if !ok {
+			return nil, fmt.Errorf("unknown object type in cache: %v", obj)
+		}
+
+		if cm.Labels[habv1beta1.CreatedByLabel] != habv1beta1.CreatedBy || !isPeerConfigMapName(cm.Name) {
+			continue
+		}
+
+		used, err := hc.peerConfigMapInUse(cm.Namespace, cm.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !used {
+			orphans = append(orphans, cm)
+		}
+	}
+
+	for _, store := range []cache.Store{hc.deployInformer.GetStore(), hc.stsInformer.GetStore(), hc.jobInformer.GetStore(), hc.svcInformer.GetStore()} {
+		for _, obj := range store.List() {
+			o, ok := obj.(metav1.Object)
+			if !ok {
+				return nil, fmt.Errorf("unknown object type in cache: %v", obj)
+			}
+
+			l := o.GetLabels()
+			if l[habv1beta1.CreatedByLabel] != habv1beta1.CreatedBy || l[habv1beta1.HabitatNameLabel] == "" {
+				continue
+			}
+
+			_, err := hc.findHabitatByLabel(o.GetNamespace(), l[habv1beta1.HabitatNameLabel])
+			if apierrors.IsNotFound(err) {
+				orphans = append(orphans, o)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return orphans, nil
+}
+
+// deleteOrphan deletes a resource returned by orphanedResources.
+func (hc *HabitatController) deleteOrphan(ctx context.Context, o metav1.Object) error {
+	var kind string
+	switch o.(type) {
+	case *appsv1.Deployment:
+		kind = "Deployment"
+	case *appsv1.StatefulSet:
+		kind = "StatefulSet"
+	case *batchv1.Job:
+		kind = "Job"
+	case *apiv1.Service:
+		kind = "Service"
+	case *apiv1.ConfigMap:
+		kind = "ConfigMap"
+	default:
+		return fmt.Errorf("unexpected orphaned object: %v", o)
+	}
+
+	if hc.config.DryRun {
+		level.Info(hc.logger).Log("msg", "dry run", "verb", "delete", "kind", kind, "name", o.GetName(), "namespace", o.GetNamespace())
+		return nil
+	}
+
+	deletePolicy := metav1.DeletePropagationBackground
+	deleteOptions := &metav1.DeleteOptions{
+		PropagationPolicy: &deletePolicy,
+	}
+
+	var err error
+	switch kind {
+	case "Deployment":
+		apps, cancel := hc.appsClient(ctx)
+		defer cancel()
+		err = apps.Deployments(o.GetNamespace()).Delete(o.GetName(), deleteOptions)
+	case "StatefulSet":
+		apps, cancel := hc.appsClient(ctx)
+		defer cancel()
+		err = apps.StatefulSets(o.GetNamespace()).Delete(o.GetName(), deleteOptions)
+	case "Job":
+		batch, cancel := hc.batchClient(ctx)
+		defer cancel()
+		err = batch.Jobs(o.GetNamespace()).Delete(o.GetName(), deleteOptions)
+	case "Service":
+		core, cancel := hc.coreClient(ctx)
+		defer cancel()
+		err = core.Services(o.GetNamespace()).Delete(o.GetName(), deleteOptions)
+	case "ConfigMap":
+		core, cancel := hc.coreClient(ctx)
+		defer cancel()
+		err = core.ConfigMaps(o.GetNamespace()).Delete(o.GetName(), deleteOptions)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	level.Info(hc.logger).Log("msg", "deleted orphaned resource", "kind", kind, "name", o.GetName(), "namespace", o.GetNamespace())
+
+	return nil
+}
+
+// peerConfigMapInUse returns true if a Habitat of the namespace joins the ring
+// of the peer ConfigMap. Habitats being deleted don't count, as they're
+// leaving the ring.
+func (hc *HabitatController) peerConfigMapInUse(ns, name string) (bool, error) {
+	habitats, err := hc.habLister.Habitats(ns).List(labels.Everything())
+	if err != nil {
+		return false, err
+	}
+
+	for _, h := range habitats {
+		if h.DeletionTimestamp != nil {
+			continue
+		}
+		if peerConfigMapName(h) == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// deleteUnusedPeerConfigMap deletes the peer ConfigMap of the ring of the
+// Habitat being deleted, if no other Habitat joins that ring. A Habitat
+// joining the ring afterwards creates it again.
+func (hc *HabitatController) deleteUnusedPeerConfigMap(ctx context.Context, h *habv1beta1.Habitat) error {
+	name := peerConfigMapName(h)
+
+	used, err := hc.peerConfigMapInUse(h.Namespace, name)
+	if err != nil || used {
+		return err
+	}
+
+	_, exists, err := hc.cmInformer.GetStore().GetByKey(h.Namespace + "/" + name)
+	if err != nil || !exists {
+		return err
+	}
+
+	return hc.deleteOrphan(ctx, newConfigMap("", h))
+}
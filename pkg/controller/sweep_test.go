@@ -0,0 +1,167 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	hablisters "github.com/kinvolk/habitat-operator/pkg/client/listers/habitat/v1beta1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSweep(t *testing.T) {
+	habInformer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &habv1beta1.Habitat{}, 0, cache.Indexers{})
+	hc := &HabitatController{
+		habInformer:    habInformer,
+		deployInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.Deployment{}, 0, cache.Indexers{}),
+		stsInformer:    cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.StatefulSet{}, 0, cache.Indexers{}),
+		jobInformer:    cache.NewSharedIndexInformer(&cache.ListWatch{}, &batchv1.Job{}, 0, cache.Indexers{}),
+		svcInformer:    cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Service{}, 0, cache.Indexers{}),
+		cmInformer:     cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.ConfigMap{}, 0, cache.Indexers{}),
+		habLister:      hablisters.NewHabitatLister(habInformer.GetIndexer()),
+	}
+
+	foo := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	hc.habInformer.GetStore().Add(foo)
+
+	// foo's Deployment was created, but the operator stopped before creating
+	// its Service.
+	d, err := hc.newDeployment(context.Background(), foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.deployInformer.GetStore().Add(d)
+	hc.cmInformer.GetStore().Add(newConfigMap("", foo))
+
+	// bar was deleted while the operator wasn't running.
+	bar := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "default"}}
+	orphan, err := hc.newDeployment(context.Background(), bar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.deployInformer.GetStore().Add(orphan)
+
+	// baz wasn't created by the operator.
+	baz := orphan.DeepCopy()
+	baz.Name = "baz"
+	delete(baz.Labels, habv1beta1.CreatedByLabel)
+	hc.deployInformer.GetStore().Add(baz)
+
+	if missing := hc.missingResources(foo); !reflect.DeepEqual(missing, []string{"Service"}) {
+		t.Errorf("expected the Service of foo to be missing, got %v", missing)
+	}
+
+	orphans, err := hc.orphanedResources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].GetName() != bar.Name {
+		t.Errorf("expected the Deployment of bar to be orphaned, got %v", orphans)
+	}
+}
+
+func TestUnusedPeerConfigMapsAreDeleted(t *testing.T) {
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+
+		deleted = append(deleted, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(metav1.Status{Status: metav1.StatusSuccess})
+	}))
+	defer srv.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	habInformer := cache.NewSharedIndexInformer(&cache.ListWatch{}, &habv1beta1.Habitat{}, 0, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	hc := &HabitatController{
+		config:         Config{KubernetesClientset: clientset},
+		logger:         log.NewNopLogger(),
+		habInformer:    habInformer,
+		deployInformer: cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.Deployment{}, 0, cache.Indexers{}),
+		stsInformer:    cache.NewSharedIndexInformer(&cache.ListWatch{}, &appsv1.StatefulSet{}, 0, cache.Indexers{}),
+		jobInformer:    cache.NewSharedIndexInformer(&cache.ListWatch{}, &batchv1.Job{}, 0, cache.Indexers{}),
+		svcInformer:    cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.Service{}, 0, cache.Indexers{}),
+		cmInformer:     cache.NewSharedIndexInformer(&cache.ListWatch{}, &apiv1.ConfigMap{}, 0, cache.Indexers{}),
+		habLister:      hablisters.NewHabitatLister(habInformer.GetIndexer()),
+	}
+
+	// foo and bar share the ring blue, and baz is the last Habitat of the
+	// ring green.
+	foo := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}, Spec: habv1beta1.HabitatSpec{Ring: "blue"}}
+	bar := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "default"}, Spec: habv1beta1.HabitatSpec{Ring: "blue"}}
+	baz := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "baz", Namespace: "default"}, Spec: habv1beta1.HabitatSpec{Ring: "green"}}
+	for _, h := range []*habv1beta1.Habitat{foo, bar, baz} {
+		hc.habInformer.GetStore().Add(h)
+		hc.cmInformer.GetStore().Add(newConfigMap("", h))
+	}
+
+	// The last Habitat of the ring red was deleted while the operator wasn't
+	// running.
+	qux := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "qux", Namespace: "default"}, Spec: habv1beta1.HabitatSpec{Ring: "red"}}
+	hc.cmInformer.GetStore().Add(newConfigMap("", qux))
+
+	orphans, err := hc.orphanedResources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].GetName() != peerConfigMapName(qux) {
+		t.Errorf("expected the peer ConfigMap of the ring red to be orphaned, got %v", orphans)
+	}
+
+	// Deleting foo leaves bar in the ring blue.
+	now := metav1.Now()
+	foo.DeletionTimestamp = &now
+	hc.habInformer.GetStore().Update(foo)
+
+	if err := hc.deleteUnusedPeerConfigMap(context.Background(), foo); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("expected the peer ConfigMap of the ring blue to be kept, got deletions %v", deleted)
+	}
+
+	// Deleting baz leaves no Habitat in the ring green.
+	baz.DeletionTimestamp = &now
+	hc.habInformer.GetStore().Update(baz)
+
+	if err := hc.deleteUnusedPeerConfigMap(context.Background(), baz); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/api/v1/namespaces/default/configmaps/" + peerConfigMapName(baz)}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("expected deletions %v, got %v", want, deleted)
+	}
+}
@@ -15,18 +15,37 @@
 package controller
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/docker/distribution/reference"
 	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	"github.com/kinvolk/habitat-operator/pkg/version"
 
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/tools/cache"
 )
 
-const leaderFollowerTopologyMinCount = 3
+const (
+	leaderFollowerTopologyMinCount = 3
+
+	// defaultGroup is the group services are assigned to when none is specified.
+	defaultGroup = "default"
+)
 
 type keyNotFoundError struct {
 	key string
@@ -36,17 +55,437 @@ func (err keyNotFoundError) Error() string {
 	return fmt.Sprintf("could not find Object with key %s in the cache", err.key)
 }
 
+// nameConflictError is returned when a resource the operator needs to create
+// for a Habitat already exists, and is not managed by the operator for it.
+type nameConflictError struct {
+	kind string
+	name string
+}
+
+func (err nameConflictError) Error() string {
+	return fmt.Sprintf("%s %s already exists and is not managed by the operator for this Habitat", err.kind, err.name)
+}
+
+// validationError is returned when a Habitat's spec is invalid. It contains
+// an error for each invalid field, so that they can all be fixed at once.
+type validationError struct {
+	errs field.ErrorList
+}
+
+func (err validationError) Error() string {
+	return err.errs.ToAggregate().Error()
+}
+
 func validateCustomObject(h habv1beta1.Habitat) error {
 	spec := h.Spec
+	specPath := field.NewPath("spec")
+
+	var errs field.ErrorList
+
+	if spec.Count < 0 {
+		errs = append(errs, field.Invalid(specPath.Child("count"), spec.Count, "must not be negative"))
+	}
 
 	switch spec.Service.Topology {
 	case habv1beta1.TopologyStandalone:
 	case habv1beta1.TopologyLeader:
 		if spec.Count < leaderFollowerTopologyMinCount {
-			return fmt.Errorf("too few instances: %d, leader-follower topology requires at least %d", spec.Count, leaderFollowerTopologyMinCount)
+			errs = append(errs, field.Invalid(specPath.Child("count"), spec.Count, fmt.Sprintf("leader-follower topology requires at least %d instances", leaderFollowerTopologyMinCount)))
+		}
+	default:
+		errs = append(errs, field.NotSupported(specPath.Child("service", "topology"), spec.Service.Topology, []string{string(habv1beta1.TopologyStandalone), string(habv1beta1.TopologyLeader)}))
+	}
+
+	switch spec.Kind {
+	case "", habv1beta1.WorkloadKindDeployment, habv1beta1.WorkloadKindStatefulSet, habv1beta1.WorkloadKindJob:
+	default:
+		errs = append(errs, field.NotSupported(specPath.Child("kind"), spec.Kind, []string{string(habv1beta1.WorkloadKindDeployment), string(habv1beta1.WorkloadKindStatefulSet), string(habv1beta1.WorkloadKindJob)}))
+	}
+
+	errs = append(errs, validateImage(specPath.Child("image"), spec.Image)...)
+
+	if spec.AdoptExisting && !isDeploymentKind(spec.Kind) {
+		errs = append(errs, field.Forbidden(specPath.Child("adoptExisting"), "only supported with the Deployment kind"))
+	}
+
+	switch spec.HabUpdateStrategy {
+	case "", habv1beta1.HabUpdateStrategyNone, habv1beta1.HabUpdateStrategyAtOnce, habv1beta1.HabUpdateStrategyRolling:
+	default:
+		errs = append(errs, field.NotSupported(specPath.Child("habUpdateStrategy"), spec.HabUpdateStrategy, []string{string(habv1beta1.HabUpdateStrategyNone), string(habv1beta1.HabUpdateStrategyAtOnce), string(habv1beta1.HabUpdateStrategyRolling)}))
+	}
+
+	switch spec.PeerSelection {
+	case "", habv1beta1.PeerSelectionOldestReady, habv1beta1.PeerSelectionLowestOrdinal:
+	default:
+		errs = append(errs, field.NotSupported(specPath.Child("peerSelection"), spec.PeerSelection, []string{string(habv1beta1.PeerSelectionOldestReady), string(habv1beta1.PeerSelectionLowestOrdinal)}))
+	}
+
+	switch spec.DNSPolicy {
+	case "", apiv1.DNSClusterFirst, apiv1.DNSClusterFirstWithHostNet, apiv1.DNSDefault:
+	case apiv1.DNSNone:
+		if spec.DNSConfig == nil {
+			errs = append(errs, field.Required(specPath.Child("dnsConfig"), fmt.Sprintf("must be set with the %s DNS policy", apiv1.DNSNone)))
+		}
+	default:
+		errs = append(errs, field.NotSupported(specPath.Child("dnsPolicy"), spec.DNSPolicy, []string{string(apiv1.DNSClusterFirst), string(apiv1.DNSClusterFirstWithHostNet), string(apiv1.DNSDefault), string(apiv1.DNSNone)}))
+	}
+
+	if spec.Config != "" {
+		configPath := specPath.Child("config")
+
+		if spec.Service.ConfigSecretName != "" {
+			errs = append(errs, field.Forbidden(configPath, "can't be set together with spec.service.configSecretName"))
+		} else if _, err := renderConfig(&h); err != nil {
+			errs = append(errs, field.Invalid(configPath, spec.Config, err.Error()))
+		}
+	}
+
+	if name := spec.DeploymentName; name != "" {
+		if msgs := validation.IsDNS1123Label(name); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(specPath.Child("deploymentName"), name, strings.Join(msgs, ", ")))
+		}
+	}
+
+	// The operator relies on its own annotations to track the workload.
+	for k := range spec.DeploymentAnnotations {
+		if strings.HasPrefix(k, "habitat.sh/") {
+			errs = append(errs, field.Forbidden(specPath.Child("deploymentAnnotations").Key(k), "annotation is reserved for the operator"))
+		}
+	}
+
+	if name := spec.ServiceAccountName; name != "" {
+		if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(specPath.Child("serviceAccountName"), name, strings.Join(msgs, ", ")))
+		}
+	}
+
+	if name := spec.PriorityClassName; name != "" {
+		if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(specPath.Child("priorityClassName"), name, strings.Join(msgs, ", ")))
+		}
+	}
+
+	// The ring name is used as a label value and in the name of its peer
+	// ConfigMap.
+	if r := spec.Ring; r != "" {
+		if msgs := validation.IsDNS1123Label(r); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(specPath.Child("ring"), r, strings.Join(msgs, ", ")))
+		}
+	}
+
+	// The supervisors require both the application and the environment, which
+	// are also used as label values.
+	for _, f := range []struct {
+		name, value, other string
+	}{
+		{"application", spec.Application, spec.Environment},
+		{"environment", spec.Environment, spec.Application},
+	} {
+		if f.value == "" {
+			if f.other != "" {
+				errs = append(errs, field.Required(specPath.Child(f.name), "the application and the environment must be set together"))
+			}
+			continue
+		}
+		if msgs := validation.IsValidLabelValue(f.value); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(specPath.Child(f.name), f.value, strings.Join(msgs, ", ")))
+		}
+	}
+
+	// Args come before the flags set by the operator, which would override
+	// them.
+	for i, arg := range spec.Args {
+		if flag := strings.SplitN(arg, "=", 2)[0]; operatorFlags[flag] {
+			errs = append(errs, field.Forbidden(specPath.Child("args").Index(i), fmt.Sprintf("%s is set by the operator, use supervisorArgs to override it", flag)))
+		}
+	}
+
+	if v := spec.SupervisorVersion; v != "" && !supervisorVersionRegexp.MatchString(v) {
+		errs = append(errs, field.Invalid(specPath.Child("supervisorVersion"), v, "must be of the form <major>.<minor>.<patch>"))
+	}
+
+	if name := spec.ContainerName; name != "" {
+		if msgs := validation.IsDNS1123Label(name); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(specPath.Child("containerName"), name, strings.Join(msgs, ", ")))
+		} else if name == supervisorVersionContainerName {
+			errs = append(errs, field.Duplicate(specPath.Child("containerName"), name))
+		}
+	}
+
+	// The service names are used as container names, so they must be unique.
+	names := map[string]bool{containerName(&h): true, supervisorVersionContainerName: true}
+	for i, svc := range spec.Services {
+		svcPath := specPath.Child("services").Index(i)
+
+		if msgs := validation.IsDNS1123Label(svc.Name); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(svcPath.Child("name"), svc.Name, strings.Join(msgs, ", ")))
+		} else if names[svc.Name] {
+			errs = append(errs, field.Duplicate(svcPath.Child("name"), svc.Name))
+		}
+		names[svc.Name] = true
+
+		errs = append(errs, validateImage(svcPath.Child("image"), svc.Image)...)
+	}
+
+	// Init containers share the names with the other containers.
+	for i, c := range spec.InitContainers {
+		if names[c.Name] {
+			errs = append(errs, field.Duplicate(specPath.Child("initContainers").Index(i).Child("name"), c.Name))
+		}
+		names[c.Name] = true
+	}
+
+	for i, c := range spec.Sidecars {
+		if names[c.Name] {
+			errs = append(errs, field.Duplicate(specPath.Child("sidecars").Index(i).Child("name"), c.Name))
+		}
+		names[c.Name] = true
+	}
+
+	// The volumes share the names with the ones created by the operator.
+	volumes := map[string]bool{
+		configVolumeName:       true,
+		keysVolumeName:         true,
+		initialConfigFilename:  true,
+		configMapRefVolumeName: true,
+		persistentVolumeName:   true,
+	}
+	for i, v := range spec.Volumes {
+		if volumes[v.Name] {
+			errs = append(errs, field.Duplicate(specPath.Child("volumes").Index(i).Child("name"), v.Name))
+		}
+		volumes[v.Name] = true
+	}
+
+	// The mounts can't hide the files the operator mounts for the supervisor.
+	peerDir, _ := peerWatchFile(&h)
+	mountPaths := map[string]bool{
+		path.Clean(peerDir): true,
+		keysDir:             true,
+		fmt.Sprintf("/hab/user/%s/config", spec.Service.Name): true,
+	}
+	for i, m := range spec.VolumeMounts {
+		vmPath := specPath.Child("volumeMounts").Index(i)
+
+		if !volumes[m.Name] {
+			errs = append(errs, field.NotFound(vmPath.Child("name"), m.Name))
+		}
+		if mountPaths[path.Clean(m.MountPath)] {
+			errs = append(errs, field.Forbidden(vmPath.Child("mountPath"), "path is reserved for the operator"))
+		}
+	}
+
+	// The operator relies on its own labels to find the Pods.
+	for _, l := range []string{habv1beta1.HabitatLabel, habv1beta1.HabitatNameLabel, habv1beta1.TopologyLabel, habv1beta1.RingLabel, habv1beta1.ApplicationLabel, habv1beta1.EnvironmentLabel} {
+		if _, ok := spec.PodLabels[l]; ok {
+			errs = append(errs, field.Forbidden(specPath.Child("podLabels").Key(l), "label is reserved for the operator"))
+		}
+	}
+
+	if us := spec.UpdateStrategy; us != nil {
+		usPath := specPath.Child("updateStrategy")
+
+		if !isDeploymentKind(spec.Kind) {
+			errs = append(errs, field.Forbidden(usPath, fmt.Sprintf("not supported with the %s kind", spec.Kind)))
+		}
+
+		switch us.Type {
+		case "", appsv1.RollingUpdateDeploymentStrategyType:
+		case appsv1.RecreateDeploymentStrategyType:
+			if us.MaxSurge != nil {
+				errs = append(errs, field.Forbidden(usPath.Child("maxSurge"), "can only be set for rolling updates"))
+			}
+			if us.MaxUnavailable != nil {
+				errs = append(errs, field.Forbidden(usPath.Child("maxUnavailable"), "can only be set for rolling updates"))
+			}
+		default:
+			errs = append(errs, field.NotSupported(usPath.Child("type"), us.Type, []string{string(appsv1.RollingUpdateDeploymentStrategyType), string(appsv1.RecreateDeploymentStrategyType)}))
+		}
+	}
+
+	// The supervisors of the additional services listen on the ports
+	// following the ones of the main service, which must all be valid.
+	last := int32(len(spec.Services) * servicePortOffset)
+	for _, p := range []struct {
+		name string
+		port int32
+	}{{"gossipListenPort", spec.GossipListenPort}, {"httpListenPort", spec.HTTPListenPort}} {
+		if p.port == 0 {
+			continue
+		}
+		if msgs := validation.IsValidPortNum(int(p.port)); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(specPath.Child(p.name), p.port, strings.Join(msgs, ", ")))
+		} else if msgs := validation.IsValidPortNum(int(p.port + last)); len(msgs) > 0 {
+			errs = append(errs, field.Invalid(specPath.Child(p.name), p.port, "leaves no valid ports for the additional services"))
+		}
+	}
+	if spec.GossipListenPort != 0 || spec.HTTPListenPort != 0 {
+		diff := gossipListenPort(&h) - httpListenPort(&h)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff%servicePortOffset == 0 && diff <= last {
+			errs = append(errs, field.Invalid(specPath.Child("httpListenPort"), httpListenPort(&h), "clashes with the gossip port of a supervisor"))
+		}
+	}
+
+	if e := spec.Expose; e != nil {
+		exposePath := specPath.Child("expose")
+
+		switch e.Type {
+		case "", apiv1.ServiceTypeClusterIP, apiv1.ServiceTypeNodePort, apiv1.ServiceTypeLoadBalancer:
+		default:
+			errs = append(errs, field.NotSupported(exposePath.Child("type"), e.Type, []string{string(apiv1.ServiceTypeClusterIP), string(apiv1.ServiceTypeNodePort), string(apiv1.ServiceTypeLoadBalancer)}))
+		}
+
+		if len(e.Ports) == 0 {
+			errs = append(errs, field.Required(exposePath.Child("ports"), ""))
+		}
+		for i, p := range e.Ports {
+			portPath := exposePath.Child("ports").Index(i)
+
+			// The ports of a Service must be named if there are several.
+			if len(e.Ports) > 1 {
+				if msgs := validation.IsDNS1123Label(p.Name); len(msgs) > 0 {
+					errs = append(errs, field.Invalid(portPath.Child("name"), p.Name, strings.Join(msgs, ", ")))
+				}
+			}
+			if msgs := validation.IsValidPortNum(int(p.Port)); len(msgs) > 0 {
+				errs = append(errs, field.Invalid(portPath.Child("port"), p.Port, strings.Join(msgs, ", ")))
+			}
+			if p.NodePort != 0 && e.Type != apiv1.ServiceTypeNodePort && e.Type != apiv1.ServiceTypeLoadBalancer {
+				errs = append(errs, field.Forbidden(portPath.Child("nodePort"), "only supported with the NodePort and LoadBalancer types"))
+			}
+		}
+	}
+
+	if m := spec.MinAvailable; m != nil {
+		if *m < 0 {
+			errs = append(errs, field.Invalid(specPath.Child("minAvailable"), *m, "must not be negative"))
+		} else if int(*m) > spec.Count {
+			errs = append(errs, field.Invalid(specPath.Child("minAvailable"), *m, "must not be greater than count"))
+		}
+	}
+
+	if l := spec.RevisionHistoryLimit; l != nil {
+		rhlPath := specPath.Child("revisionHistoryLimit")
+
+		if !isDeploymentKind(spec.Kind) {
+			errs = append(errs, field.Forbidden(rhlPath, fmt.Sprintf("not supported with the %s kind", spec.Kind)))
+		}
+		if *l < 0 {
+			errs = append(errs, field.Invalid(rhlPath, *l, "must not be negative"))
+		}
+	}
+
+	if d := spec.ProgressDeadlineSeconds; d != nil {
+		pdsPath := specPath.Child("progressDeadlineSeconds")
+
+		if !isDeploymentKind(spec.Kind) {
+			errs = append(errs, field.Forbidden(pdsPath, fmt.Sprintf("not supported with the %s kind", spec.Kind)))
+		}
+		if *d <= 0 {
+			errs = append(errs, field.Invalid(pdsPath, *d, "must be positive"))
+		}
+	}
+
+	switch spec.PodManagementPolicy {
+	case "":
+	case appsv1.OrderedReadyPodManagement, appsv1.ParallelPodManagement:
+		if spec.Kind != habv1beta1.WorkloadKindStatefulSet {
+			errs = append(errs, field.Forbidden(specPath.Child("podManagementPolicy"), fmt.Sprintf("requires the %s kind", habv1beta1.WorkloadKindStatefulSet)))
+		}
+	default:
+		errs = append(errs, field.NotSupported(specPath.Child("podManagementPolicy"), spec.PodManagementPolicy, []string{string(appsv1.OrderedReadyPodManagement), string(appsv1.ParallelPodManagement)}))
+	}
+
+	if l := spec.BackoffLimit; l != nil {
+		blPath := specPath.Child("backoffLimit")
+
+		if spec.Kind != habv1beta1.WorkloadKindJob {
+			errs = append(errs, field.Forbidden(blPath, fmt.Sprintf("requires the %s kind", habv1beta1.WorkloadKindJob)))
+		}
+		if *l < 0 {
+			errs = append(errs, field.Invalid(blPath, *l, "must not be negative"))
+		}
+	}
+
+	switch spec.RestartPolicy {
+	case "":
+	case apiv1.RestartPolicyOnFailure, apiv1.RestartPolicyNever:
+		if spec.Kind != habv1beta1.WorkloadKindJob {
+			errs = append(errs, field.Forbidden(specPath.Child("restartPolicy"), fmt.Sprintf("requires the %s kind", habv1beta1.WorkloadKindJob)))
 		}
 	default:
-		return fmt.Errorf("unkown topology: %s", spec.Service.Topology)
+		errs = append(errs, field.NotSupported(specPath.Child("restartPolicy"), spec.RestartPolicy, []string{string(apiv1.RestartPolicyOnFailure), string(apiv1.RestartPolicyNever)}))
+	}
+
+	if ps := spec.PersistentStorage; ps != nil {
+		psPath := specPath.Child("persistentStorage")
+
+		// A single claim can't be shared by the replicas of a Deployment.
+		if spec.Kind != habv1beta1.WorkloadKindStatefulSet {
+			errs = append(errs, field.Forbidden(psPath, fmt.Sprintf("requires the %s kind", habv1beta1.WorkloadKindStatefulSet)))
+		}
+
+		if _, err := resource.ParseQuantity(ps.Size); err != nil {
+			errs = append(errs, field.Invalid(psPath.Child("size"), ps.Size, err.Error()))
+		}
+	}
+
+	if p := spec.TerminationGracePeriodSeconds; p != nil && *p < 0 {
+		errs = append(errs, field.Invalid(specPath.Child("terminationGracePeriodSeconds"), *p, "must not be negative"))
+	}
+
+	if ref := spec.ConfigMapRef; ref != nil {
+		refPath := specPath.Child("configMapRef")
+
+		if ref.Name == "" {
+			errs = append(errs, field.Required(refPath.Child("name"), ""))
+		}
+
+		for i, item := range ref.Items {
+			if item.Key == "" {
+				errs = append(errs, field.Required(refPath.Child("items").Index(i).Child("key"), ""))
+			}
+			if item.Path == "" || strings.HasPrefix(item.Path, "/") || strings.Contains(item.Path, "..") {
+				errs = append(errs, field.Invalid(refPath.Child("items").Index(i).Child("path"), item.Path, "must be a relative path not containing '..'"))
+			}
+		}
+	}
+
+	if pwf := spec.PeerWatchFile; pwf != nil {
+		pwfPath := specPath.Child("peerWatchFile")
+
+		if pwf.MountPath != "" && !path.IsAbs(pwf.MountPath) {
+			errs = append(errs, field.Invalid(pwfPath.Child("mountPath"), pwf.MountPath, "must be an absolute path"))
+		}
+		if strings.Contains(pwf.Filename, "/") || pwf.Filename == "." || pwf.Filename == ".." {
+			errs = append(errs, field.Invalid(pwfPath.Child("filename"), pwf.Filename, "must be a file name"))
+		}
+	}
+
+	// The projected files share the directory of the peer file.
+	_, peerFilename := peerWatchFile(&h)
+	for i, p := range spec.ConfigProjections {
+		cpPath := specPath.Child("configProjections").Index(i)
+
+		var items []apiv1.KeyToPath
+		switch {
+		case p.ConfigMap != nil && p.Secret == nil && p.DownwardAPI == nil:
+			cpPath, items = cpPath.Child("configMap"), p.ConfigMap.Items
+		case p.Secret != nil && p.ConfigMap == nil && p.DownwardAPI == nil:
+			cpPath, items = cpPath.Child("secret"), p.Secret.Items
+		default:
+			errs = append(errs, field.Invalid(cpPath, "", "must set exactly one of configMap and secret"))
+			continue
+		}
+
+		for j, item := range items {
+			if path.Clean(item.Path) == peerFilename {
+				errs = append(errs, field.Forbidden(cpPath.Child("items").Index(j).Child("path"), "path is reserved for the peer file"))
+			}
+		}
 	}
 
 	if rsn := spec.Service.RingSecretName; rsn != "" {
@@ -55,13 +494,616 @@ func validateCustomObject(h habv1beta1.Habitat) error {
 		// The ringParts slice should have a second element for the capturing group
 		// in the ringRegexp regular expression, containing the ring's name.
 		if len(ringParts) < 2 {
-			return fmt.Errorf("malformed ring secret name: %s", rsn)
+			errs = append(errs, field.Invalid(specPath.Child("service", "ringSecretName"), rsn, "must be of the form <ring name>-<revision>"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return validationError{errs: errs}
+	}
+
+	return nil
+}
+
+// validationWarnings returns the problems of spec that don't make it invalid,
+// but are likely to prevent it from working as expected.
+func validationWarnings(spec habv1beta1.HabitatSpec) []string {
+	var warnings []string
+
+	if spec.HostNetwork && spec.Count > 1 {
+		warnings = append(warnings, "spec.hostNetwork: the ports of the supervisors are bound on the node, so only one Pod can run per node and the others stay pending if there are fewer nodes than count")
+	}
+
+	return warnings
+}
+
+// validateImage checks that image is a valid reference to a Docker image.
+func validateImage(path *field.Path, image string) field.ErrorList {
+	if image == "" {
+		return field.ErrorList{field.Required(path, "")}
+	}
+
+	if _, err := reference.Parse(image); err != nil {
+		return field.ErrorList{field.Invalid(path, image, err.Error())}
+	}
+
+	return nil
+}
+
+// validateBinds checks that the target of every bind of h is a Habitat in the
+// same namespace, as the supervisors can only gossip with peers in their own
+// namespace and would otherwise wait for the bind forever, and that the binds
+// don't form a cycle.
+func validateBinds(h habv1beta1.Habitat, store cache.Store) error {
+	var errs field.ErrorList
+
+	for _, b := range bindPaths(&h) {
+		found := false
+
+		for _, obj := range store.List() {
+			t, ok := obj.(*habv1beta1.Habitat)
+			if !ok {
+				return fmt.Errorf("unknown object type in Habitat store: %T", obj)
+			}
+
+			if t.Namespace == h.Namespace && bindTargets(b.bind, t) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			errs = append(errs, field.NotFound(b.path, serviceGroup(b.bind.Service, b.bind.Group)))
+		}
+	}
+
+	cycles, err := validateBindCycles(h, store)
+	if err != nil {
+		return err
+	}
+	errs = append(errs, cycles...)
+
+	if len(errs) > 0 {
+		return validationError{errs: errs}
+	}
+
+	return nil
+}
+
+// validateBindCycles checks that no bind of h closes a cycle of binds between
+// the service groups of its namespace. The supervisors of a cycle would all
+// wait for each other to start.
+func validateBindCycles(h habv1beta1.Habitat, store cache.Store) (field.ErrorList, error) {
+	// The edges of the graph go from each service group to the service groups
+	// it binds to. h replaces its cached version, which may be outdated.
+	graph := map[string][]string{}
+	addBinds := func(h *habv1beta1.Habitat) {
+		for _, b := range bindPaths(h) {
+			graph[b.from] = append(graph[b.from], serviceGroup(b.bind.Service, b.bind.Group))
+		}
+	}
+
+	addBinds(&h)
+	for _, obj := range store.List() {
+		t, ok := obj.(*habv1beta1.Habitat)
+		if !ok {
+			return nil, fmt.Errorf("unknown object type in Habitat store: %T", obj)
+		}
+
+		if t.Namespace != h.Namespace || t.Name == h.Name {
+			continue
+		}
+
+		// The cycle is only reported for the newest Habitat on it, so that the
+		// Habitats that were running before it was closed keep running.
+		// Habitats that aren't created yet are the newest.
+		if ht, tt := h.CreationTimestamp, t.CreationTimestamp; !ht.IsZero() && (ht.Before(&tt) || ht.Equal(&tt) && h.Name < t.Name) {
+			continue
+		}
+
+		addBinds(t)
+	}
+
+	// The order of the store is random, the reported cycles shouldn't be.
+	for _, targets := range graph {
+		sort.Strings(targets)
+	}
+
+	var errs field.ErrorList
+	for _, b := range bindPaths(&h) {
+		target := serviceGroup(b.bind.Service, b.bind.Group)
+		if cycle := bindCycle(graph, target, b.from, map[string]bool{}); cycle != nil {
+			cycle = append([]string{b.from}, cycle...)
+			errs = append(errs, field.Invalid(b.path, target, fmt.Sprintf("bind cycle: %s", strings.Join(cycle, " -> "))))
+		}
+	}
+
+	return errs, nil
+}
+
+// bindCycle returns the service groups on a path of binds from one service
+// group to another, both included, or nil if there's none.
+func bindCycle(graph map[string][]string, from, to string, visited map[string]bool) []string {
+	if from == to {
+		return []string{to}
+	}
+	if visited[from] {
+		return nil
+	}
+	visited[from] = true
+
+	for _, next := range graph[from] {
+		if path := bindCycle(graph, next, to, visited); path != nil {
+			return append([]string{from}, path...)
 		}
 	}
 
 	return nil
 }
 
+// serviceGroup returns the name of the service group, as the supervisors
+// refer to it.
+func serviceGroup(service, group string) string {
+	return fmt.Sprintf("%s.%s", service, groupOrDefault(group))
+}
+
+// bindTargets returns whether h runs the service group the bind refers to.
+func bindTargets(bind habv1beta1.Bind, h *habv1beta1.Habitat) bool {
+	// All the services of a Habitat are in the same group.
+	if groupOrDefault(bind.Group) != groupOrDefault(h.Spec.Service.Group) {
+		return false
+	}
+
+	if bind.Service == h.Spec.Service.Name {
+		return true
+	}
+
+	for _, svc := range h.Spec.Services {
+		if bind.Service == svc.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bindField is a bind together with its path in the Habitat's spec, and the
+// service group binding.
+type bindField struct {
+	bind habv1beta1.Bind
+	path *field.Path
+	from string
+}
+
+// bindPaths returns the binds of all the services of h, with their paths.
+func bindPaths(h *habv1beta1.Habitat) []bindField {
+	specPath := field.NewPath("spec")
+
+	var binds []bindField
+	for i, b := range h.Spec.Service.Bind {
+		binds = append(binds, bindField{bind: b, path: specPath.Child("service", "bind").Index(i), from: serviceGroup(h.Spec.Service.Name, h.Spec.Service.Group)})
+	}
+	for i, svc := range h.Spec.Services {
+		// All the services of a Habitat are in the same group.
+		for j, b := range svc.Bind {
+			binds = append(binds, bindField{bind: b, path: specPath.Child("services").Index(i).Child("bind").Index(j), from: serviceGroup(svc.Name, h.Spec.Service.Group)})
+		}
+	}
+
+	return binds
+}
+
+// allBinds returns the binds of all the services of h.
+func allBinds(h *habv1beta1.Habitat) []habv1beta1.Bind {
+	var binds []habv1beta1.Bind
+	binds = append(binds, h.Spec.Service.Bind...)
+	for _, svc := range h.Spec.Services {
+		binds = append(binds, svc.Bind...)
+	}
+
+	return binds
+}
+
+// setCondition returns the conditions with c replacing the condition of the
+// same type. The transition time is set to now, unless the status of the
+// condition didn't change. The conditions are not modified, as they may belong
+// to a cached object.
+func setCondition(conditions []habv1beta1.HabitatCondition, c habv1beta1.HabitatCondition, now metav1.Time) []habv1beta1.HabitatCondition {
+	c.LastTransitionTime = now
+
+	var out []habv1beta1.HabitatCondition
+	for _, existing := range conditions {
+		if existing.Type != c.Type {
+			out = append(out, existing)
+			continue
+		}
+
+		if existing.Status == c.Status {
+			c.LastTransitionTime = existing.LastTransitionTime
+		}
+	}
+
+	return append(out, c)
+}
+
+// removeCondition returns the conditions without the one of the given type.
+func removeCondition(conditions []habv1beta1.HabitatCondition, t habv1beta1.HabitatConditionType) []habv1beta1.HabitatCondition {
+	var out []habv1beta1.HabitatCondition
+	for _, c := range conditions {
+		if c.Type != t {
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
+
+// hasCondition returns true if the conditions contain one of the same type and
+// status as c.
+func hasCondition(conditions []habv1beta1.HabitatCondition, c habv1beta1.HabitatCondition) bool {
+	for _, existing := range conditions {
+		if existing.Type == c.Type && existing.Status == c.Status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasConditionMessage returns true if the conditions contain one of the type,
+// status and message of c.
+func hasConditionMessage(conditions []habv1beta1.HabitatCondition, c habv1beta1.HabitatCondition) bool {
+	for _, existing := range conditions {
+		if existing.Type == c.Type && existing.Status == c.Status && existing.Message == c.Message {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasConditionType returns true if the conditions contain one of type t.
+func hasConditionType(conditions []habv1beta1.HabitatCondition, t habv1beta1.HabitatConditionType) bool {
+	for _, c := range conditions {
+		if c.Type == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isOwnedByHabitat returns true if the object carries the labels the operator
+// sets on the resources it creates for the Habitat.
+func isOwnedByHabitat(obj metav1.Object, h *habv1beta1.Habitat) bool {
+	l := obj.GetLabels()
+
+	return l[habv1beta1.HabitatLabel] == "true" && l[habv1beta1.HabitatNameLabel] == habitatLabelValue(h)
+}
+
+// isDeploymentKind returns true if Habitats of the kind are run by a
+// Deployment.
+func isDeploymentKind(kind habv1beta1.WorkloadKind) bool {
+	return kind == "" || kind == habv1beta1.WorkloadKindDeployment
+}
+
+// operatorAnnotations returns the annotations of the objects created by the
+// operator, so that tooling can tell that they're managed by it.
+func operatorAnnotations() map[string]string {
+	return map[string]string{
+		managedByAnnotation:       habv1beta1.CreatedBy,
+		operatorVersionAnnotation: version.Version,
+	}
+}
+
+// annotationsChanged returns true if any of the desired annotations is
+// missing from the current ones, or has another value, or if any of the
+// DeploymentAnnotations last applied is no longer desired. Annotations added
+// by others are left alone.
+func annotationsChanged(current, desired map[string]string) bool {
+	for k, v := range desired {
+		if current[k] != v {
+			return true
+		}
+	}
+
+	if applied := current[deploymentAnnotationsAnnotation]; applied != "" {
+		for _, k := range strings.Split(applied, ",") {
+			if _, ok := desired[k]; !ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// containerName returns the name of the container running the main service
+// of the Habitat.
+func containerName(h *habv1beta1.Habitat) string {
+	if name := h.Spec.ContainerName; name != "" {
+		return name
+	}
+
+	return serviceContainerName
+}
+
+// gossipListenPort returns the port the supervisor of the main service of the
+// Habitat gossips on.
+func gossipListenPort(h *habv1beta1.Habitat) int32 {
+	if p := h.Spec.GossipListenPort; p != 0 {
+		return p
+	}
+
+	return gossipPort
+}
+
+// httpListenPort returns the port of the HTTP gateway of the supervisor of the
+// main service of the Habitat.
+func httpListenPort(h *habv1beta1.Habitat) int32 {
+	if p := h.Spec.HTTPListenPort; p != 0 {
+		return p
+	}
+
+	return httpGatewayPort
+}
+
+// groupOrDefault returns the group a service is assigned to by the supervisor.
+func groupOrDefault(group string) string {
+	if group == "" {
+		return defaultGroup
+	}
+
+	return group
+}
+
+// propagateMetadata copies the labels and annotations of the Habitat to the
+// Pod template, unless the template already has them, so that neither the
+// labels set by the operator nor the ones set in the spec are overridden.
+// Since the template is part of the spec hash of the workload, removing them
+// from the Habitat removes them from the Pods.
+func propagateMetadata(h *habv1beta1.Habitat, template *apiv1.PodTemplateSpec) {
+	for k, v := range h.Labels {
+		// The ring of the Pods is only set by the spec.
+		if k == habv1beta1.RingLabel {
+			continue
+		}
+		if _, ok := template.Labels[k]; !ok {
+			template.Labels[k] = v
+		}
+	}
+
+	for k, v := range h.Annotations {
+		// The whole Habitat would be copied to each Pod.
+		if k == apiv1.LastAppliedConfigAnnotation {
+			continue
+		}
+		if template.Annotations == nil {
+			template.Annotations = map[string]string{}
+		}
+		if _, ok := template.Annotations[k]; !ok {
+			template.Annotations[k] = v
+		}
+	}
+}
+
+// immutableSpec returns the fields of the spec that can't be changed once the
+// workload running the Habitat has been created, without breaking its ring.
+func immutableSpec(spec habv1beta1.HabitatSpec) habv1beta1.HabitatSpec {
+	return habv1beta1.HabitatSpec{
+		Service:           habv1beta1.Service{Topology: spec.Service.Topology},
+		Ring:              spec.Ring,
+		PersistentStorage: spec.PersistentStorage,
+		DeploymentName:    spec.DeploymentName,
+	}
+}
+
+// validateImmutableFields returns an error for each field of spec that can't
+// be changed, and differs from the one of old.
+func validateImmutableFields(old, spec habv1beta1.HabitatSpec) field.ErrorList {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	// The standalone topology is the default one.
+	if (old.Service.Topology == habv1beta1.TopologyLeader) != (spec.Service.Topology == habv1beta1.TopologyLeader) {
+		errs = append(errs, field.Invalid(specPath.Child("service", "topology"), spec.Service.Topology, "field is immutable"))
+	}
+	if old.Ring != spec.Ring {
+		errs = append(errs, field.Invalid(specPath.Child("ring"), spec.Ring, "field is immutable"))
+	}
+	if !reflect.DeepEqual(old.PersistentStorage, spec.PersistentStorage) {
+		errs = append(errs, field.Forbidden(specPath.Child("persistentStorage"), "field is immutable"))
+	}
+	if old.DeploymentName != spec.DeploymentName {
+		errs = append(errs, field.Invalid(specPath.Child("deploymentName"), spec.DeploymentName, "field is immutable"))
+	}
+
+	return errs
+}
+
+// peerWatchFile returns the directory the peer file of the Habitat is mounted
+// in, and its name.
+func peerWatchFile(h *habv1beta1.Habitat) (dir, filename string) {
+	dir, filename = defaultPeerWatchDir, defaultPeerWatchFilename
+
+	if pwf := h.Spec.PeerWatchFile; pwf != nil {
+		if pwf.MountPath != "" {
+			dir = pwf.MountPath
+		}
+		if pwf.Filename != "" {
+			filename = pwf.Filename
+		}
+	}
+
+	return dir, filename
+}
+
+// peerConfigMapName returns the name of the ConfigMap containing the peer file
+// of the ring the Habitat joins.
+func peerConfigMapName(h *habv1beta1.Habitat) string {
+	if h.Spec.Ring == "" {
+		return configMapName
+	}
+
+	return configMapName + "-" + h.Spec.Ring
+}
+
+// workloadName returns the name of the Deployment or StatefulSet running the
+// Habitat.
+func workloadName(h *habv1beta1.Habitat) string {
+	if h.Spec.DeploymentName != "" {
+		return h.Spec.DeploymentName
+	}
+
+	return shortName(h.Name)
+}
+
+// habitatLabelValue returns the value of the HabitatNameLabel of the objects
+// created for the Habitat: its name, shortened if it's too long for a label
+// value.
+func habitatLabelValue(h *habv1beta1.Habitat) string {
+	return shortName(h.Name)
+}
+
+// shortName returns name if it's short enough for a DNS label, and thus for
+// a label value. Longer names are truncated, and suffixed with their hash to
+// keep them unique. All the names generated for a Habitat go through it, as
+// Habitat names can be longer.
+func shortName(name string) string {
+	if len(name) <= validation.DNS1123LabelMaxLength {
+		return name
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+
+	// Habitat names are DNS subdomains, which can contain dots, but labels
+	// can't end with them.
+	prefix := strings.TrimRight(name[:validation.DNS1123LabelMaxLength-len(suffix)], "-.")
+
+	return prefix + suffix
+}
+
+// sortPeers sorts the Pods that can act as peers according to the peer
+// selection strategy, the preferred ones first. Pods the strategy can't tell
+// apart are sorted by name.
+func sortPeers(pods []apiv1.Pod, strategy habv1beta1.PeerSelection) {
+	sort.Slice(pods, func(i, j int) bool {
+		a, b := &pods[i], &pods[j]
+
+		switch strategy {
+		case habv1beta1.PeerSelectionLowestOrdinal:
+			// Pods not created by a StatefulSet come last.
+			ai, aok := podOrdinal(a.Name)
+			bi, bok := podOrdinal(b.Name)
+			if aok != bok {
+				return aok
+			}
+			if ai != bi {
+				return ai < bi
+			}
+		default:
+			// Pods that aren't ready might be about to be replaced.
+			if ar, br := isPodReady(a), isPodReady(b); ar != br {
+				return ar
+			}
+			if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+				return a.CreationTimestamp.Before(&b.CreationTimestamp)
+			}
+		}
+
+		return a.Name < b.Name
+	})
+}
+
+// podOrdinal returns the ordinal of a Pod created by a StatefulSet, which is
+// the suffix of its name.
+func podOrdinal(name string) (int, bool) {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return 0, false
+	}
+
+	ordinal, err := strconv.Atoi(name[i+1:])
+	if err != nil || ordinal < 0 {
+		return 0, false
+	}
+
+	return ordinal, true
+}
+
+// isPodReady returns true if the Pod has the Ready condition.
+func isPodReady(pod *apiv1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == apiv1.PodReady {
+			return c.Status == apiv1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// unwrapTombstone returns the final state of the object wrapped in obj, if
+// it's the tombstone of a deletion that was missed while the informer was
+// disconnected from the API server. Otherwise, it returns obj.
+func unwrapTombstone(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+
+	return obj
+}
+
+// isPeerConfigMapName returns true if name is the name of the ConfigMap
+// containing the peer file of any ring.
+func isPeerConfigMapName(name string) bool {
+	return name == configMapName || strings.HasPrefix(name, configMapName+"-")
+}
+
+// ringIndexKey returns the key under which the Pods of the given ring are
+// indexed by podRingIndexFunc.
+func ringIndexKey(namespace, ring string) string {
+	return namespace + "/" + ring
+}
+
+// podRingIndexFunc indexes Pods by the ring they join, so that the peers of a
+// ring can be drawn from the Pods of all its Habitats.
+func podRingIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*apiv1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object of type %T", obj)
+	}
+
+	return []string{ringIndexKey(pod.Namespace, pod.Labels[habv1beta1.RingLabel])}, nil
+}
+
+// habitatConfigMapRefIndexFunc indexes Habitats by the ConfigMap they
+// reference through ConfigMapRef, so that they're reconciled when it changes.
+func habitatConfigMapRefIndexFunc(obj interface{}) ([]string, error) {
+	h, ok := obj.(*habv1beta1.Habitat)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object of type %T", obj)
+	}
+
+	if h.Spec.ConfigMapRef == nil {
+		return nil, nil
+	}
+
+	return []string{h.Namespace + "/" + h.Spec.ConfigMapRef.Name}, nil
+}
+
+// hasFinalizer returns whether the controller's finalizer is set on h.
+func hasFinalizer(h *habv1beta1.Habitat) bool {
+	for _, f := range h.Finalizers {
+		if f == habitatFinalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
 // newListWatchFromClientWithLabels is a modified newListWatchFromClient function from listWatch.
 // Instead of using fields to filter, we modify the function to use labels.
 func newListWatchFromClientWithLabels(c cache.Getter, resource string, namespace string, op metav1.ListOptions) *cache.ListWatch {
@@ -93,3 +1135,16 @@ func labelListOptions() metav1.ListOptions {
 		LabelSelector: ls.String(),
 	}
 }
+
+// specHash returns a hash of the given workload spec.
+func specHash(spec interface{}) (string, error) {
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+
+	h := fnv.New64a()
+	h.Write(b)
+
+	return fmt.Sprintf("%x", h.Sum64()), nil
+}
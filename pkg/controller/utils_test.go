@@ -0,0 +1,1265 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestValidateCustomObject(t *testing.T) {
+	maxSurge := intstr.FromInt(1)
+
+	tests := []struct {
+		name string
+		spec habv1beta1.HabitatSpec
+		// fields are the paths of the fields expected to be reported as
+		// invalid, or empty if the spec is valid.
+		fields []string
+	}{
+		{
+			name: "valid standalone",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+		},
+		{
+			name: "negative count",
+			spec: habv1beta1.HabitatSpec{
+				Count:   -1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			fields: []string{"spec.count"},
+		},
+		{
+			name: "negative count and missing image",
+			spec: habv1beta1.HabitatSpec{
+				Count:   -1,
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			fields: []string{"spec.count", "spec.image"},
+		},
+		{
+			name: "leader with too few instances",
+			spec: habv1beta1.HabitatSpec{
+				Count:   2,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyLeader},
+			},
+			fields: []string{"spec.count"},
+		},
+		{
+			name: "unknown topology",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: "foo"},
+			},
+			fields: []string{"spec.service.topology"},
+		},
+		{
+			name: "unknown kind",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Kind:    "DaemonSet",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			fields: []string{"spec.kind"},
+		},
+		{
+			name: "malformed ring secret name",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone, RingSecretName: "foobar"},
+			},
+			fields: []string{"spec.service.ringSecretName"},
+		},
+		{
+			name: "additional service",
+			spec: habv1beta1.HabitatSpec{
+				Count:    1,
+				Image:    "foo/bar",
+				Service:  habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Services: []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+			},
+		},
+		{
+			name: "additional service with invalid name",
+			spec: habv1beta1.HabitatSpec{
+				Count:    1,
+				Image:    "foo/bar",
+				Service:  habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Services: []habv1beta1.ServiceSpec{{Name: "Redis", Image: "redis"}},
+			},
+			fields: []string{"spec.services[0].name"},
+		},
+		{
+			name: "additional service clashing with main container",
+			spec: habv1beta1.HabitatSpec{
+				Count:    1,
+				Image:    "foo/bar",
+				Service:  habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Services: []habv1beta1.ServiceSpec{{Name: serviceContainerName, Image: "redis"}},
+			},
+			fields: []string{"spec.services[0].name"},
+		},
+		{
+			name: "additional service without image",
+			spec: habv1beta1.HabitatSpec{
+				Count:    1,
+				Image:    "foo/bar",
+				Service:  habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Services: []habv1beta1.ServiceSpec{{Name: "redis"}},
+			},
+			fields: []string{"spec.services[0].image"},
+		},
+		{
+			name: "persistent storage",
+			spec: habv1beta1.HabitatSpec{
+				Count:             1,
+				Image:             "foo/bar",
+				Kind:              habv1beta1.WorkloadKindStatefulSet,
+				Service:           habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PersistentStorage: &habv1beta1.PersistentStorage{Size: "1Gi"},
+			},
+		},
+		{
+			name: "persistent storage with Deployment",
+			spec: habv1beta1.HabitatSpec{
+				Count:             1,
+				Image:             "foo/bar",
+				Service:           habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PersistentStorage: &habv1beta1.PersistentStorage{Size: "1Gi"},
+			},
+			fields: []string{"spec.persistentStorage"},
+		},
+		{
+			name: "persistent storage with invalid size",
+			spec: habv1beta1.HabitatSpec{
+				Count:             1,
+				Image:             "foo/bar",
+				Kind:              habv1beta1.WorkloadKindStatefulSet,
+				Service:           habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PersistentStorage: &habv1beta1.PersistentStorage{Size: "a lot"},
+			},
+			fields: []string{"spec.persistentStorage.size"},
+		},
+		{
+			name: "pod labels",
+			spec: habv1beta1.HabitatSpec{
+				Count:     1,
+				Image:     "foo/bar",
+				Service:   habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PodLabels: map[string]string{"app": "foo"},
+			},
+		},
+		{
+			name: "reserved pod label",
+			spec: habv1beta1.HabitatSpec{
+				Count:     1,
+				Image:     "foo/bar",
+				Service:   habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PodLabels: map[string]string{habv1beta1.HabitatNameLabel: "foo"},
+			},
+			fields: []string{"spec.podLabels[habitat-name]"},
+		},
+		{
+			name: "recreate update strategy",
+			spec: habv1beta1.HabitatSpec{
+				Count:          1,
+				Image:          "foo/bar",
+				Service:        habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				UpdateStrategy: &habv1beta1.UpdateStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			},
+		},
+		{
+			name: "recreate update strategy with max surge",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				UpdateStrategy: &habv1beta1.UpdateStrategy{
+					Type:     appsv1.RecreateDeploymentStrategyType,
+					MaxSurge: &maxSurge,
+				},
+			},
+			fields: []string{"spec.updateStrategy.maxSurge"},
+		},
+		{
+			name: "update strategy with StatefulSet",
+			spec: habv1beta1.HabitatSpec{
+				Count:          1,
+				Image:          "foo/bar",
+				Kind:           habv1beta1.WorkloadKindStatefulSet,
+				Service:        habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				UpdateStrategy: &habv1beta1.UpdateStrategy{Type: appsv1.RecreateDeploymentStrategyType},
+			},
+			fields: []string{"spec.updateStrategy"},
+		},
+		{
+			name: "revision history and progress deadline",
+			spec: habv1beta1.HabitatSpec{
+				Count:                   1,
+				Image:                   "foo/bar",
+				Service:                 habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				RevisionHistoryLimit:    int32Ptr(0),
+				ProgressDeadlineSeconds: int32Ptr(120),
+			},
+		},
+		{
+			name: "invalid revision history and progress deadline",
+			spec: habv1beta1.HabitatSpec{
+				Count:                   1,
+				Image:                   "foo/bar",
+				Service:                 habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				RevisionHistoryLimit:    int32Ptr(-1),
+				ProgressDeadlineSeconds: int32Ptr(0),
+			},
+			fields: []string{"spec.revisionHistoryLimit", "spec.progressDeadlineSeconds"},
+		},
+		{
+			name: "progress deadline with StatefulSet",
+			spec: habv1beta1.HabitatSpec{
+				Count:                   1,
+				Image:                   "foo/bar",
+				Kind:                    habv1beta1.WorkloadKindStatefulSet,
+				Service:                 habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ProgressDeadlineSeconds: int32Ptr(120),
+			},
+			fields: []string{"spec.progressDeadlineSeconds"},
+		},
+		{
+			name: "init container",
+			spec: habv1beta1.HabitatSpec{
+				Count:          1,
+				Image:          "foo/bar",
+				Service:        habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				InitContainers: []apiv1.Container{{Name: "setup", Image: "busybox"}},
+			},
+		},
+		{
+			name: "init container clashing with main container",
+			spec: habv1beta1.HabitatSpec{
+				Count:          1,
+				Image:          "foo/bar",
+				Service:        habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				InitContainers: []apiv1.Container{{Name: serviceContainerName, Image: "busybox"}},
+			},
+			fields: []string{"spec.initContainers[0].name"},
+		},
+		{
+			name: "sidecar with shared volume",
+			spec: habv1beta1.HabitatSpec{
+				Count:    1,
+				Image:    "foo/bar",
+				Service:  habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Sidecars: []apiv1.Container{{Name: "fluentd", Image: "fluentd"}},
+				Volumes:  []apiv1.Volume{{Name: "logs", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}}},
+			},
+		},
+		{
+			name: "sidecars clashing with containers",
+			spec: habv1beta1.HabitatSpec{
+				Count:          1,
+				Image:          "foo/bar",
+				Service:        habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				InitContainers: []apiv1.Container{{Name: "setup", Image: "busybox"}},
+				Sidecars:       []apiv1.Container{{Name: serviceContainerName, Image: "fluentd"}, {Name: "setup", Image: "busybox"}},
+			},
+			fields: []string{"spec.sidecars[0].name", "spec.sidecars[1].name"},
+		},
+		{
+			name: "container name",
+			spec: habv1beta1.HabitatSpec{
+				Count:         1,
+				Image:         "foo/bar",
+				Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ContainerName: "app",
+				Sidecars:      []apiv1.Container{{Name: serviceContainerName, Image: "fluentd"}},
+			},
+		},
+		{
+			name: "container name clashing with containers",
+			spec: habv1beta1.HabitatSpec{
+				Count:          1,
+				Image:          "foo/bar",
+				Service:        habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ContainerName:  "app",
+				InitContainers: []apiv1.Container{{Name: "app", Image: "busybox"}},
+				Sidecars:       []apiv1.Container{{Name: "app", Image: "fluentd"}},
+			},
+			fields: []string{"spec.initContainers[0].name", "spec.sidecars[0].name"},
+		},
+		{
+			name: "invalid container name",
+			spec: habv1beta1.HabitatSpec{
+				Count:         1,
+				Image:         "foo/bar",
+				Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ContainerName: "Habitat_Service",
+			},
+			fields: []string{"spec.containerName"},
+		},
+		{
+			name: "container name of the supervisor version check",
+			spec: habv1beta1.HabitatSpec{
+				Count:         1,
+				Image:         "foo/bar",
+				Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ContainerName: supervisorVersionContainerName,
+			},
+			fields: []string{"spec.containerName"},
+		},
+		{
+			name: "volume clashing with operator volume",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Volumes: []apiv1.Volume{{Name: configVolumeName}},
+			},
+			fields: []string{"spec.volumes[0].name"},
+		},
+		{
+			name: "volume mounts",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Volumes: []apiv1.Volume{{Name: "cache", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}}},
+				VolumeMounts: []apiv1.VolumeMount{
+					{Name: "cache", MountPath: "/var/cache"},
+					{Name: configVolumeName, MountPath: "/etc/peers"},
+				},
+			},
+		},
+		{
+			name: "invalid volume mounts",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Name: "redis", Topology: habv1beta1.TopologyStandalone},
+				Volumes: []apiv1.Volume{{Name: "cache", VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}}}},
+				VolumeMounts: []apiv1.VolumeMount{
+					{Name: "missing", MountPath: "/var/cache"},
+					{Name: "cache", MountPath: "/hab/user/redis/config/"},
+				},
+			},
+			fields: []string{"spec.volumeMounts[0].name", "spec.volumeMounts[1].mountPath"},
+		},
+		{
+			name: "adopting a StatefulSet",
+			spec: habv1beta1.HabitatSpec{
+				Count:         1,
+				Image:         "foo/bar",
+				Kind:          habv1beta1.WorkloadKindStatefulSet,
+				Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				AdoptExisting: true,
+			},
+			fields: []string{"spec.adoptExisting"},
+		},
+		{
+			name: "hab update strategy",
+			spec: habv1beta1.HabitatSpec{
+				Count:             1,
+				Image:             "foo/bar",
+				Service:           habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				HabUpdateStrategy: habv1beta1.HabUpdateStrategyAtOnce,
+				UpdateChannel:     "stable",
+			},
+		},
+		{
+			name: "unknown hab update strategy",
+			spec: habv1beta1.HabitatSpec{
+				Count:             1,
+				Image:             "foo/bar",
+				Service:           habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				HabUpdateStrategy: "eventually",
+			},
+			fields: []string{"spec.habUpdateStrategy"},
+		},
+		{
+			name: "supervisor version",
+			spec: habv1beta1.HabitatSpec{
+				Count:             1,
+				Image:             "foo/bar",
+				Service:           habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				SupervisorVersion: "0.56.0",
+			},
+		},
+		{
+			name: "min available",
+			spec: habv1beta1.HabitatSpec{
+				Count:        3,
+				Image:        "foo/bar",
+				Service:      habv1beta1.Service{Topology: habv1beta1.TopologyLeader},
+				MinAvailable: int32Ptr(2),
+			},
+		},
+		{
+			name: "min available greater than count",
+			spec: habv1beta1.HabitatSpec{
+				Count:        3,
+				Image:        "foo/bar",
+				Service:      habv1beta1.Service{Topology: habv1beta1.TopologyLeader},
+				MinAvailable: int32Ptr(4),
+			},
+			fields: []string{"spec.minAvailable"},
+		},
+		{
+			name: "command and args",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Command: []string{"/bin/hab"},
+				Args:    []string{"sup", "run", "foo/bar"},
+			},
+		},
+		{
+			name: "operator flags in args",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Command: []string{"/bin/hab"},
+				Args:    []string{"sup", "run", "--topology", "leader", "--group=prod"},
+			},
+			fields: []string{"spec.args[2]", "spec.args[4]"},
+		},
+		{
+			name: "application and environment",
+			spec: habv1beta1.HabitatSpec{
+				Count:       1,
+				Image:       "foo/bar",
+				Service:     habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Application: "shop",
+				Environment: "staging",
+			},
+		},
+		{
+			name: "application without environment",
+			spec: habv1beta1.HabitatSpec{
+				Count:       1,
+				Image:       "foo/bar",
+				Service:     habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Application: "shop",
+			},
+			fields: []string{"spec.environment"},
+		},
+		{
+			name: "malformed application and environment",
+			spec: habv1beta1.HabitatSpec{
+				Count:       1,
+				Image:       "foo/bar",
+				Service:     habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Application: "web shop",
+				Environment: "-staging",
+			},
+			fields: []string{"spec.application", "spec.environment"},
+		},
+		{
+			name: "deployment annotations",
+			spec: habv1beta1.HabitatSpec{
+				Count:                 1,
+				Image:                 "foo/bar",
+				Service:               habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				DeploymentAnnotations: map[string]string{"argocd.argoproj.io/sync-wave": "1"},
+			},
+		},
+		{
+			name: "reserved deployment annotations",
+			spec: habv1beta1.HabitatSpec{
+				Count:                 1,
+				Image:                 "foo/bar",
+				Service:               habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				DeploymentAnnotations: map[string]string{specHashAnnotation: "forged"},
+			},
+			fields: []string{"spec.deploymentAnnotations[habitat.sh/spec-hash]"},
+		},
+		{
+			name: "service account",
+			spec: habv1beta1.HabitatSpec{
+				Count:              1,
+				Image:              "foo/bar",
+				Service:            habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ServiceAccountName: "habitat-db",
+			},
+		},
+		{
+			name: "priority class",
+			spec: habv1beta1.HabitatSpec{
+				Count:             1,
+				Image:             "foo/bar",
+				Service:           habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PriorityClassName: "critical-rings",
+			},
+		},
+		{
+			name: "exposed ports",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Expose: &habv1beta1.Expose{
+					Type:  apiv1.ServiceTypeLoadBalancer,
+					Ports: []apiv1.ServicePort{{Name: "http", Port: 80}, {Name: "https", Port: 443}},
+				},
+			},
+		},
+		{
+			name: "invalid exposed ports",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Expose: &habv1beta1.Expose{
+					Type:  apiv1.ServiceTypeExternalName,
+					Ports: []apiv1.ServicePort{{Port: 80, NodePort: 30080}, {Name: "https", Port: 70000}},
+				},
+			},
+			fields: []string{"spec.expose.type", "spec.expose.ports[0].name", "spec.expose.ports[0].nodePort", "spec.expose.ports[1].port"},
+		},
+		{
+			name: "unknown peer selection",
+			spec: habv1beta1.HabitatSpec{
+				Count:         1,
+				Image:         "foo/bar",
+				Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PeerSelection: "Random",
+			},
+			fields: []string{"spec.peerSelection"},
+		},
+		{
+			name: "config with a secret",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone, ConfigSecretName: "user-toml"},
+				Config:  "port = 80",
+			},
+			fields: []string{"spec.config"},
+		},
+		{
+			name: "config referring to an unknown value",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Config:  "image = {{.Spec.Image}}",
+			},
+			fields: []string{"spec.config"},
+		},
+		{
+			name: "job",
+			spec: habv1beta1.HabitatSpec{
+				Count:         1,
+				Image:         "foo/bar",
+				Kind:          habv1beta1.WorkloadKindJob,
+				Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				BackoffLimit:  int32Ptr(3),
+				RestartPolicy: apiv1.RestartPolicyNever,
+			},
+		},
+		{
+			name: "job options without the job kind",
+			spec: habv1beta1.HabitatSpec{
+				Count:         1,
+				Image:         "foo/bar",
+				Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				BackoffLimit:  int32Ptr(3),
+				RestartPolicy: apiv1.RestartPolicyNever,
+			},
+			fields: []string{"spec.backoffLimit", "spec.restartPolicy"},
+		},
+		{
+			name: "job with invalid options",
+			spec: habv1beta1.HabitatSpec{
+				Count:         1,
+				Image:         "foo/bar",
+				Kind:          habv1beta1.WorkloadKindJob,
+				Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				BackoffLimit:  int32Ptr(-1),
+				RestartPolicy: apiv1.RestartPolicyAlways,
+			},
+			fields: []string{"spec.backoffLimit", "spec.restartPolicy"},
+		},
+		{
+			name: "job with deployment options",
+			spec: habv1beta1.HabitatSpec{
+				Count:                1,
+				Image:                "foo/bar",
+				Kind:                 habv1beta1.WorkloadKindJob,
+				Service:              habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				RevisionHistoryLimit: int32Ptr(3),
+			},
+			fields: []string{"spec.revisionHistoryLimit"},
+		},
+		{
+			name: "listen ports",
+			spec: habv1beta1.HabitatSpec{
+				Count:            1,
+				Image:            "foo/bar",
+				Service:          habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Services:         []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+				GossipListenPort: 19638,
+				HTTPListenPort:   19631,
+			},
+		},
+		{
+			name: "listen ports out of range",
+			spec: habv1beta1.HabitatSpec{
+				Count:            1,
+				Image:            "foo/bar",
+				Service:          habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Services:         []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+				GossipListenPort: 65500,
+				HTTPListenPort:   -1,
+			},
+			fields: []string{"spec.gossipListenPort", "spec.httpListenPort"},
+		},
+		{
+			name: "http port clashing with gossip port of additional service",
+			spec: habv1beta1.HabitatSpec{
+				Count:          1,
+				Image:          "foo/bar",
+				Service:        habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Services:       []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+				HTTPListenPort: 9738,
+			},
+			fields: []string{"spec.httpListenPort"},
+		},
+		{
+			name: "config projections",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ConfigProjections: []apiv1.VolumeProjection{
+					{ConfigMap: &apiv1.ConfigMapProjection{LocalObjectReference: apiv1.LocalObjectReference{Name: "app"}}},
+					{Secret: &apiv1.SecretProjection{
+						LocalObjectReference: apiv1.LocalObjectReference{Name: "creds"},
+						Items:                []apiv1.KeyToPath{{Key: "password", Path: "password"}},
+					}},
+				},
+			},
+		},
+		{
+			name: "invalid config projections",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ConfigProjections: []apiv1.VolumeProjection{
+					{DownwardAPI: &apiv1.DownwardAPIProjection{}},
+					{ConfigMap: &apiv1.ConfigMapProjection{
+						LocalObjectReference: apiv1.LocalObjectReference{Name: "app"},
+						Items:                []apiv1.KeyToPath{{Key: "peers", Path: "peer-ip"}},
+					}},
+				},
+			},
+			fields: []string{"spec.configProjections[0]", "spec.configProjections[1].configMap.items[0].path"},
+		},
+		{
+			name: "deployment name",
+			spec: habv1beta1.HabitatSpec{
+				Count:          1,
+				Image:          "foo/bar",
+				Service:        habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				DeploymentName: "db",
+			},
+		},
+		{
+			name: "deployment name with dots",
+			spec: habv1beta1.HabitatSpec{
+				Count:          1,
+				Image:          "foo/bar",
+				Service:        habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				DeploymentName: "db.example",
+			},
+			fields: []string{"spec.deploymentName"},
+		},
+		{
+			name: "malformed service account",
+			spec: habv1beta1.HabitatSpec{
+				Count:              1,
+				Image:              "foo/bar",
+				Service:            habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ServiceAccountName: "Habitat DB",
+			},
+			fields: []string{"spec.serviceAccountName"},
+		},
+		{
+			name: "malformed priority class",
+			spec: habv1beta1.HabitatSpec{
+				Count:             1,
+				Image:             "foo/bar",
+				Service:           habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PriorityClassName: "Critical Rings",
+			},
+			fields: []string{"spec.priorityClassName"},
+		},
+		{
+			name: "DNS policy",
+			spec: habv1beta1.HabitatSpec{
+				Count:     1,
+				Image:     "foo/bar",
+				Service:   habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				DNSPolicy: apiv1.DNSDefault,
+			},
+		},
+		{
+			name: "unknown DNS policy",
+			spec: habv1beta1.HabitatSpec{
+				Count:     1,
+				Image:     "foo/bar",
+				Service:   habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				DNSPolicy: "ClusterLast",
+			},
+			fields: []string{"spec.dnsPolicy"},
+		},
+		{
+			name: "None DNS policy without DNS config",
+			spec: habv1beta1.HabitatSpec{
+				Count:     1,
+				Image:     "foo/bar",
+				Service:   habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				DNSPolicy: apiv1.DNSNone,
+			},
+			fields: []string{"spec.dnsConfig"},
+		},
+		{
+			name: "None DNS policy with DNS config",
+			spec: habv1beta1.HabitatSpec{
+				Count:     1,
+				Image:     "foo/bar",
+				Service:   habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				DNSPolicy: apiv1.DNSNone,
+				DNSConfig: &apiv1.PodDNSConfig{Nameservers: []string{"10.0.0.53"}},
+			},
+		},
+		{
+			name: "ring",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Ring:    "payments",
+			},
+		},
+		{
+			name: "malformed ring",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Ring:    "Payments_Ring",
+			},
+			fields: []string{"spec.ring"},
+		},
+		{
+			name: "ring label in podLabels",
+			spec: habv1beta1.HabitatSpec{
+				Count:     1,
+				Image:     "foo/bar",
+				Service:   habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PodLabels: map[string]string{habv1beta1.RingLabel: "payments"},
+			},
+			fields: []string{"spec.podLabels[habitat-ring]"},
+		},
+		{
+			name: "malformed supervisor version",
+			spec: habv1beta1.HabitatSpec{
+				Count:             1,
+				Image:             "foo/bar",
+				Service:           habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				SupervisorVersion: "latest",
+			},
+			fields: []string{"spec.supervisorVersion"},
+		},
+		{
+			name: "config map reference",
+			spec: habv1beta1.HabitatSpec{
+				Count:        1,
+				Image:        "foo/bar",
+				Service:      habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ConfigMapRef: &habv1beta1.ConfigMapRef{Name: "foo", Items: []apiv1.KeyToPath{{Key: "foo", Path: "foo.conf"}}},
+			},
+		},
+		{
+			name: "config map reference escaping the mount path",
+			spec: habv1beta1.HabitatSpec{
+				Count:        1,
+				Image:        "foo/bar",
+				Service:      habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				ConfigMapRef: &habv1beta1.ConfigMapRef{Items: []apiv1.KeyToPath{{Key: "foo", Path: "../foo.conf"}}},
+			},
+			fields: []string{"spec.configMapRef.name", "spec.configMapRef.items[0].path"},
+		},
+		{
+			name: "custom peer watch file",
+			spec: habv1beta1.HabitatSpec{
+				Count:         1,
+				Image:         "foo/bar",
+				Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PeerWatchFile: &habv1beta1.PeerWatchFile{MountPath: "/etc/peers", Filename: "peers"},
+			},
+		},
+		{
+			name: "invalid peer watch file",
+			spec: habv1beta1.HabitatSpec{
+				Count:         1,
+				Image:         "foo/bar",
+				Service:       habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PeerWatchFile: &habv1beta1.PeerWatchFile{MountPath: "etc/peers", Filename: "../peers"},
+			},
+			fields: []string{"spec.peerWatchFile.mountPath", "spec.peerWatchFile.filename"},
+		},
+		{
+			name: "parallel pod management",
+			spec: habv1beta1.HabitatSpec{
+				Count:               1,
+				Image:               "foo/bar",
+				Kind:                habv1beta1.WorkloadKindStatefulSet,
+				Service:             habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PodManagementPolicy: appsv1.ParallelPodManagement,
+			},
+		},
+		{
+			name: "pod management policy with Deployment",
+			spec: habv1beta1.HabitatSpec{
+				Count:               1,
+				Image:               "foo/bar",
+				Service:             habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PodManagementPolicy: appsv1.ParallelPodManagement,
+			},
+			fields: []string{"spec.podManagementPolicy"},
+		},
+		{
+			name: "unknown pod management policy",
+			spec: habv1beta1.HabitatSpec{
+				Count:               1,
+				Image:               "foo/bar",
+				Kind:                habv1beta1.WorkloadKindStatefulSet,
+				Service:             habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				PodManagementPolicy: "Random",
+			},
+			fields: []string{"spec.podManagementPolicy"},
+		},
+		{
+			name: "missing image",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			fields: []string{"spec.image"},
+		},
+		{
+			name: "invalid image",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   " foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			fields: []string{"spec.image"},
+		},
+		{
+			name: "additional service with invalid image",
+			spec: habv1beta1.HabitatSpec{
+				Count:    1,
+				Image:    "foo/bar",
+				Service:  habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+				Services: []habv1beta1.ServiceSpec{{Name: "redis", Image: "Redis"}},
+			},
+			fields: []string{"spec.services[0].image"},
+		},
+	}
+
+	for _, tt := range tests {
+		err := validateCustomObject(habv1beta1.Habitat{Spec: tt.spec})
+
+		if len(tt.fields) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+
+		vErr, ok := err.(validationError)
+		if !ok {
+			t.Errorf("%s: expected validationError, got %v", tt.name, err)
+			continue
+		}
+
+		var fields []string
+		for _, e := range vErr.errs {
+			fields = append(fields, e.Field)
+		}
+
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s: expected invalid fields %v, got %v", tt.name, tt.fields, fields)
+		}
+	}
+}
+
+func TestValidateBinds(t *testing.T) {
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	store.Add(&habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+		Spec: habv1beta1.HabitatSpec{
+			Service:  habv1beta1.Service{Name: "postgresql"},
+			Services: []habv1beta1.ServiceSpec{{Name: "redis", Image: "redis"}},
+		},
+	})
+
+	tests := []struct {
+		name      string
+		namespace string
+		bind      habv1beta1.Bind
+		valid     bool
+	}{
+		{
+			name:      "target in default group",
+			namespace: "default",
+			bind:      habv1beta1.Bind{Name: "db", Service: "postgresql", Group: "default"},
+			valid:     true,
+		},
+		{
+			name:      "target with omitted group",
+			namespace: "default",
+			bind:      habv1beta1.Bind{Name: "db", Service: "postgresql"},
+			valid:     true,
+		},
+		{
+			name:      "target is additional service",
+			namespace: "default",
+			bind:      habv1beta1.Bind{Name: "cache", Service: "redis"},
+			valid:     true,
+		},
+		{
+			name:      "target in other group",
+			namespace: "default",
+			bind:      habv1beta1.Bind{Name: "db", Service: "postgresql", Group: "foo"},
+		},
+		{
+			name:      "target in other namespace",
+			namespace: "foo",
+			bind:      habv1beta1.Bind{Name: "db", Service: "postgresql"},
+		},
+	}
+
+	for _, tt := range tests {
+		h := habv1beta1.Habitat{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: tt.namespace},
+			Spec: habv1beta1.HabitatSpec{
+				Service: habv1beta1.Service{Bind: []habv1beta1.Bind{tt.bind}},
+			},
+		}
+
+		err := validateBinds(h, store)
+		if tt.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+
+		vErr, ok := err.(validationError)
+		if !ok || len(vErr.errs) != 1 || vErr.errs[0].Field != "spec.service.bind[0]" {
+			t.Errorf("%s: expected validationError for field %q, got %v", tt.name, "spec.service.bind[0]", err)
+		}
+	}
+}
+
+func TestValidateBindCycles(t *testing.T) {
+	habitat := func(name, service string, binds ...string) *habv1beta1.Habitat {
+		h := &habv1beta1.Habitat{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       habv1beta1.HabitatSpec{Service: habv1beta1.Service{Name: service}},
+		}
+		for _, b := range binds {
+			h.Spec.Service.Bind = append(h.Spec.Service.Bind, habv1beta1.Bind{Name: b, Service: b})
+		}
+
+		return h
+	}
+
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	store.Add(habitat("web", "nginx", "api"))
+	store.Add(habitat("api", "api", "postgresql"))
+	// The cached version of db doesn't bind to anything yet.
+	store.Add(habitat("db", "postgresql"))
+	// Binds in other namespaces don't matter.
+	other := habitat("other", "postgresql", "nginx")
+	other.Namespace = "foo"
+	store.Add(other)
+
+	tests := []struct {
+		name  string
+		h     *habv1beta1.Habitat
+		cycle string
+	}{
+		{
+			name: "no cycle",
+			h:    habitat("db", "postgresql"),
+		},
+		{
+			name:  "cycle through other Habitats",
+			h:     habitat("db", "postgresql", "nginx"),
+			cycle: "bind cycle: postgresql.default -> nginx.default -> api.default -> postgresql.default",
+		},
+		{
+			name:  "bind to itself",
+			h:     habitat("db", "postgresql", "postgresql"),
+			cycle: "bind cycle: postgresql.default -> postgresql.default",
+		},
+	}
+
+	for _, tt := range tests {
+		errs, err := validateBindCycles(*tt.h, store)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+
+		if tt.cycle == "" {
+			if len(errs) > 0 {
+				t.Errorf("%s: unexpected errors: %v", tt.name, errs)
+			}
+			continue
+		}
+
+		if len(errs) != 1 || errs[0].Field != "spec.service.bind[0]" || errs[0].Detail != tt.cycle {
+			t.Errorf("%s: expected %q for field %q, got %v", tt.name, tt.cycle, "spec.service.bind[0]", errs)
+		}
+	}
+}
+
+func TestValidateBindCyclesOfNewestHabitat(t *testing.T) {
+	older := metav1.NewTime(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := metav1.NewTime(older.Add(time.Minute))
+
+	// api was running when db closed the cycle by binding to it.
+	api := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", CreationTimestamp: older},
+		Spec: habv1beta1.HabitatSpec{Service: habv1beta1.Service{
+			Name: "api",
+			Bind: []habv1beta1.Bind{{Name: "db", Service: "postgresql"}},
+		}},
+	}
+	db := &habv1beta1.Habitat{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", CreationTimestamp: newer},
+		Spec: habv1beta1.HabitatSpec{Service: habv1beta1.Service{
+			Name: "postgresql",
+			Bind: []habv1beta1.Bind{{Name: "api", Service: "api"}},
+		}},
+	}
+
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	store.Add(api)
+	store.Add(db)
+
+	errs, err := validateBindCycles(*api, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) > 0 {
+		t.Errorf("expected no cycle for the older Habitat, got %v", errs)
+	}
+
+	errs, err = validateBindCycles(*db, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected the cycle to be reported for the newer Habitat, got %v", errs)
+	}
+}
+
+func TestShortName(t *testing.T) {
+	long := strings.Repeat("a", 60) + ".example.com"
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "foo", want: "foo"},
+		{name: strings.Repeat("a", 63), want: strings.Repeat("a", 63)},
+		// The dot before the hash is trimmed.
+		{name: long, want: strings.Repeat("a", 54)},
+	}
+
+	for _, tt := range tests {
+		got := shortName(tt.name)
+		if msgs := validation.IsDNS1123Label(got); len(msgs) > 0 {
+			t.Errorf("%s: expected a DNS label, got %q: %v", tt.name, got, msgs)
+		}
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s: expected the name to start with %q, got %q", tt.name, tt.want, got)
+		}
+	}
+
+	if shortName(long) == shortName(long+"x") {
+		t.Error("expected long names with the same prefix to be shortened differently")
+	}
+}
+
+func TestSortPeers(t *testing.T) {
+	older := metav1.NewTime(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := metav1.NewTime(older.Add(time.Minute))
+	ready := []apiv1.PodCondition{{Type: apiv1.PodReady, Status: apiv1.ConditionTrue}}
+
+	pod := func(name string, created metav1.Time, conditions []apiv1.PodCondition) apiv1.Pod {
+		return apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: created},
+			Status:     apiv1.PodStatus{Conditions: conditions},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		strategy habv1beta1.PeerSelection
+		pods     []apiv1.Pod
+		want     []string
+	}{
+		{
+			name: "oldest ready first",
+			pods: []apiv1.Pod{
+				pod("a", older, nil),
+				pod("b", newer, ready),
+				pod("c", older, ready),
+			},
+			want: []string{"c", "b", "a"},
+		},
+		{
+			name:     "same creation time sorted by name",
+			strategy: habv1beta1.PeerSelectionOldestReady,
+			pods: []apiv1.Pod{
+				pod("c", older, ready),
+				pod("a", older, ready),
+				pod("b", older, nil),
+			},
+			want: []string{"a", "c", "b"},
+		},
+		{
+			name:     "lowest ordinal first",
+			strategy: habv1beta1.PeerSelectionLowestOrdinal,
+			pods: []apiv1.Pod{
+				pod("web-10", older, ready),
+				pod("web-7f9c-x2k4q", older, ready),
+				pod("web-2", newer, nil),
+				pod("db-2", older, ready),
+			},
+			// Equal ordinals are sorted by name, and Pods without an ordinal come last.
+			want: []string{"db-2", "web-2", "web-10", "web-7f9c-x2k4q"},
+		},
+	}
+
+	for _, tt := range tests {
+		sortPeers(tt.pods, tt.strategy)
+
+		var got []string
+		for _, p := range tt.pods {
+			got = append(got, p.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestIsOwnedByHabitat(t *testing.T) {
+	h := &habv1beta1.Habitat{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		owned  bool
+	}{
+		{
+			name:   "created by the operator",
+			labels: map[string]string{habv1beta1.HabitatLabel: "true", habv1beta1.HabitatNameLabel: "foo"},
+			owned:  true,
+		},
+		{
+			name:   "created by the operator for another Habitat",
+			labels: map[string]string{habv1beta1.HabitatLabel: "true", habv1beta1.HabitatNameLabel: "bar"},
+		},
+		{
+			name:   "created by someone else",
+			labels: map[string]string{"app": "foo"},
+		},
+	}
+
+	for _, tt := range tests {
+		d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", Labels: tt.labels}}
+
+		if owned := isOwnedByHabitat(d, h); owned != tt.owned {
+			t.Errorf("%s: expected owned to be %t, got %t", tt.name, tt.owned, owned)
+		}
+	}
+}
+
+func TestSetCondition(t *testing.T) {
+	then := metav1.NewTime(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC))
+	now := metav1.NewTime(then.Add(time.Hour))
+
+	mismatch := func(status apiv1.ConditionStatus, at metav1.Time) habv1beta1.HabitatCondition {
+		return habv1beta1.HabitatCondition{
+			Type:               habv1beta1.HabitatConditionSupervisorVersionMismatch,
+			Status:             status,
+			LastTransitionTime: at,
+		}
+	}
+
+	conditions := []habv1beta1.HabitatCondition{mismatch(apiv1.ConditionFalse, then)}
+
+	unchanged := setCondition(conditions, mismatch(apiv1.ConditionFalse, metav1.Time{}), now)
+	if !reflect.DeepEqual(unchanged, conditions) {
+		t.Errorf("expected unchanged conditions %v, got %v", conditions, unchanged)
+	}
+
+	changed := setCondition(conditions, mismatch(apiv1.ConditionTrue, metav1.Time{}), now)
+	if expected := []habv1beta1.HabitatCondition{mismatch(apiv1.ConditionTrue, now)}; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("expected conditions %v, got %v", expected, changed)
+	}
+
+	if conditions[0].Status != apiv1.ConditionFalse {
+		t.Error("expected the original conditions not to be modified")
+	}
+
+	if removed := removeCondition(changed, habv1beta1.HabitatConditionSupervisorVersionMismatch); removed != nil {
+		t.Errorf("expected no conditions, got %v", removed)
+	}
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
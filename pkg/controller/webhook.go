@@ -0,0 +1,124 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/go-kit/kit/log/level"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// webhookHandler serves the validating admission webhook for Habitats on
+// `/validate`, and their conversion webhook on `/convert`. The admission
+// webhook runs the same validation as the controller, so that invalid
+// Habitats are rejected before they are persisted.
+// Binds are not validated, as their targets may legitimately be created
+// after the Habitats binding to them.
+func (hc *HabitatController) webhookHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/convert", hc.conversionHandler())
+	mux.HandleFunc("/validate", func(w http.ResponseWriter, r *http.Request) {
+		var review admissionv1beta1.AdmissionReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			http.Error(w, fmt.Sprintf("could not decode admission review: %v", err), http.StatusBadRequest)
+			return
+		}
+		if review.Request == nil {
+			http.Error(w, "admission review contains no request", http.StatusBadRequest)
+			return
+		}
+
+		review.Response = hc.admit(review.Request)
+		review.Request = nil
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(review); err != nil {
+			level.Error(hc.logger).Log("msg", "Failed to encode admission review", "err", err)
+		}
+	})
+
+	return mux
+}
+
+// admit validates the Habitat in the admission request, and on updates, that
+// its immutable fields weren't changed. Updates leaving the spec alone, such
+// as the ones of the finalizer, and updates of Habitats being deleted are
+// always allowed, so that Habitats stored before validation was tightened
+// can still be deleted.
+func (hc *HabitatController) admit(req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	resp := &admissionv1beta1.AdmissionResponse{UID: req.UID}
+
+	// Deletions carry no object.
+	if len(req.Object.Raw) == 0 {
+		resp.Allowed = true
+		return resp
+	}
+
+	var h habv1beta1.Habitat
+	if err := json.Unmarshal(req.Object.Raw, &h); err != nil {
+		resp.Result = &apierrors.NewBadRequest(fmt.Sprintf("could not decode Habitat: %v", err)).ErrStatus
+		return resp
+	}
+
+	var old *habv1beta1.Habitat
+	if len(req.OldObject.Raw) > 0 {
+		old = &habv1beta1.Habitat{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			resp.Result = &apierrors.NewBadRequest(fmt.Sprintf("could not decode old Habitat: %v", err)).ErrStatus
+			return resp
+		}
+
+		if h.DeletionTimestamp != nil || reflect.DeepEqual(old.Spec, h.Spec) {
+			resp.Allowed = true
+			return resp
+		}
+	}
+
+	var errs field.ErrorList
+	if err := validateCustomObject(*applyDefaults(&h, hc.config.Defaults)); err != nil {
+		vErr, ok := err.(validationError)
+		if !ok {
+			resp.Result = &metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+			return resp
+		}
+
+		errs = append(errs, vErr.errs...)
+	}
+
+	// Updates can't change the fields that would break the ring.
+	if old != nil {
+		errs = append(errs, validateImmutableFields(old.Spec, h.Spec)...)
+	}
+
+	if len(errs) > 0 {
+		level.Debug(hc.logger).Log("msg", "Rejected invalid Habitat", "namespace", req.Namespace, "name", h.Name, "err", errs.ToAggregate())
+		gk := habv1beta1.SchemeGroupVersion.WithKind("Habitat").GroupKind()
+		resp.Result = &apierrors.NewInvalid(gk, h.Name, errs).ErrStatus
+
+		return resp
+	}
+
+	resp.Allowed = true
+
+	return resp
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	hc := &HabitatController{logger: log.NewNopLogger()}
+	handler := hc.webhookHandler()
+
+	tests := []struct {
+		name     string
+		spec     habv1beta1.HabitatSpec
+		old      *habv1beta1.HabitatSpec
+		deleting bool
+		allowed  bool
+		causes   int
+	}{
+		{
+			name: "valid",
+			spec: habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			allowed: true,
+		},
+		{
+			name: "negative count and missing image",
+			spec: habv1beta1.HabitatSpec{
+				Count:   -1,
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			causes: 2,
+		},
+		{
+			name: "changed topology",
+			spec: habv1beta1.HabitatSpec{
+				Count:   3,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyLeader},
+			},
+			old: &habv1beta1.HabitatSpec{
+				Count:   3,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			causes: 1,
+		},
+		{
+			name: "changed count",
+			spec: habv1beta1.HabitatSpec{
+				Count:   3,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			old: &habv1beta1.HabitatSpec{
+				Count:   1,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			allowed: true,
+		},
+		{
+			// E.g. the finalizer of a Habitat stored before validation was
+			// tightened is removed.
+			name: "invalid spec unchanged",
+			spec: habv1beta1.HabitatSpec{
+				Count:   -1,
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			old: &habv1beta1.HabitatSpec{
+				Count:   -1,
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			allowed: true,
+		},
+		{
+			name: "changed topology while deleting",
+			spec: habv1beta1.HabitatSpec{
+				Count:   3,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyLeader},
+			},
+			old: &habv1beta1.HabitatSpec{
+				Count:   3,
+				Image:   "foo/bar",
+				Service: habv1beta1.Service{Topology: habv1beta1.TopologyStandalone},
+			},
+			deleting: true,
+			allowed:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		h := habv1beta1.Habitat{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+			Spec:       tt.spec,
+		}
+		if tt.deleting {
+			now := metav1.Now()
+			h.DeletionTimestamp = &now
+		}
+		raw, err := json.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := &admissionv1beta1.AdmissionRequest{
+			UID:       "1234",
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		}
+		if tt.old != nil {
+			old := h
+			old.Spec = *tt.old
+			oldRaw, err := json.Marshal(old)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req.Operation = admissionv1beta1.Update
+			req.OldObject = runtime.RawExtension{Raw: oldRaw}
+		}
+
+		body, err := json.Marshal(admissionv1beta1.AdmissionReview{Request: req})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/validate", bytes.NewReader(body)))
+
+		var review admissionv1beta1.AdmissionReview
+		if err := json.NewDecoder(rec.Body).Decode(&review); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		resp := review.Response
+		if resp == nil {
+			t.Fatalf("%s: no response", tt.name)
+		}
+		if resp.UID != "1234" {
+			t.Errorf("%s: expected UID of the request, got %q", tt.name, resp.UID)
+		}
+		if resp.Allowed != tt.allowed {
+			t.Errorf("%s: expected allowed to be %t, got %t", tt.name, tt.allowed, resp.Allowed)
+		}
+		if tt.allowed {
+			continue
+		}
+
+		if resp.Result == nil || resp.Result.Details == nil || len(resp.Result.Details.Causes) != tt.causes {
+			t.Errorf("%s: expected %d causes, got %v", tt.name, tt.causes, resp.Result)
+		}
+	}
+}
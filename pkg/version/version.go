@@ -0,0 +1,36 @@
+// Copyright (c) 2018 Chef Software Inc. and/or applicable contributors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package version contains information about the build of the operator.
+// The variables are set at link time, e.g.:
+//
+//	go build -ldflags "-X github.com/kinvolk/habitat-operator/pkg/version.Version=0.4.0"
+package version
+
+import "fmt"
+
+var (
+	// Version is the released version of the operator, or the output of
+	// `git describe` for unreleased builds.
+	Version = "unknown"
+	// Commit is the git commit the operator was built from.
+	Commit = "unknown"
+	// BuildDate is the date the operator was built on, in RFC 3339 format.
+	BuildDate = "unknown"
+)
+
+// String returns a human readable description of the build.
+func String() string {
+	return fmt.Sprintf("habitat-operator %s (commit %s, built %s)", Version, Commit, BuildDate)
+}
@@ -17,12 +17,11 @@
 package framework
 
 import (
-	habclient "github.com/kinvolk/habitat-operator/pkg/client"
+	habclientset "github.com/kinvolk/habitat-operator/pkg/client/clientset/versioned"
 
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -33,7 +32,7 @@ const (
 type Framework struct {
 	Image      string
 	KubeClient kubernetes.Interface
-	Client     *rest.RESTClient
+	Client     habclientset.Interface
 	ExternalIP string
 }
 
@@ -49,7 +48,7 @@ func Setup(image, kubeconfig, externalIP string) (*Framework, error) {
 		return nil, err
 	}
 
-	cl, _, err := habclient.NewClient(config)
+	cl, err := habclientset.NewForConfig(config)
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +94,7 @@ func (f *Framework) setupOperator() error {
 	d.Spec.Template.Spec.Containers[0].Image = f.Image
 
 	// Create deployment for the Habitat operator.
-	_, err = f.KubeClient.AppsV1beta1().Deployments(TestNs).Create(d)
+	_, err = f.KubeClient.AppsV1().Deployments(TestNs).Create(d)
 	if err != nil {
 		return err
 	}
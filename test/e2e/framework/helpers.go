@@ -15,31 +15,32 @@
 package framework
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
 	habv1beta1 "github.com/kinvolk/habitat-operator/pkg/apis/habitat/v1beta1"
 
-	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
 	"k8s.io/api/core/v1"
 	apiv1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
 // CreateHabitat creates a Habitat.
 func (f *Framework) CreateHabitat(habitat *habv1beta1.Habitat) error {
-	return f.Client.Post().
-		Namespace(TestNs).
-		Resource(habv1beta1.HabitatResourcePlural).
-		Body(habitat).
-		Do().
-		Error()
+	_, err := f.Client.HabitatV1beta1().Habitats(TestNs).Create(habitat)
+	return err
 }
 
 // WaitForResources waits until numPods are in the "Running" state.
@@ -87,16 +88,74 @@ func (f *Framework) WaitForEndpoints(habitatName string) error {
 	})
 }
 
-// DeleteHabitat deletes a Habitat as a user would.
-func (f *Framework) DeleteHabitat(habitatName string) error {
-	return f.Client.Delete().
+// ScaleHabitat sets the replicas of a Habitat through its scale subresource,
+// as `kubectl scale` does.
+func (f *Framework) ScaleHabitat(habitatName string, replicas int32) error {
+	patch := fmt.Sprintf(`{"spec":{"replicas":%d}}`, replicas)
+
+	return f.Client.HabitatV1beta1().RESTClient().Patch(types.MergePatchType).
 		Namespace(TestNs).
 		Resource(habv1beta1.HabitatResourcePlural).
 		Name(habitatName).
+		SubResource("scale").
+		Body([]byte(patch)).
 		Do().
 		Error()
 }
 
+// GetHabitatScale returns the scale subresource of a Habitat.
+func (f *Framework) GetHabitatScale(habitatName string) (*autoscalingv1.Scale, error) {
+	b, err := f.Client.HabitatV1beta1().RESTClient().Get().
+		Namespace(TestNs).
+		Resource(habv1beta1.HabitatResourcePlural).
+		Name(habitatName).
+		SubResource("scale").
+		Do().
+		Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	scale := &autoscalingv1.Scale{}
+	if err := json.Unmarshal(b, scale); err != nil {
+		return nil, err
+	}
+
+	return scale, nil
+}
+
+// WaitForPeerConfigMap waits until the ConfigMap containing the peer file
+// exists, and contains the IP of a peer.
+func (f *Framework) WaitForPeerConfigMap(name string) (*apiv1.ConfigMap, error) {
+	var cm *apiv1.ConfigMap
+
+	err := wait.Poll(2*time.Second, 5*time.Minute, func() (bool, error) {
+		var err error
+		cm, err = f.KubeClient.CoreV1().ConfigMaps(TestNs).Get(name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		for _, ip := range cm.Data {
+			if ip != "" {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	})
+
+	return cm, err
+}
+
+// DeleteHabitat deletes a Habitat as a user would.
+func (f *Framework) DeleteHabitat(habitatName string) error {
+	return f.Client.HabitatV1beta1().Habitats(TestNs).Delete(habitatName, &metav1.DeleteOptions{})
+}
+
 // DeleteService delete a Kubernetes service provided.
 func (f *Framework) DeleteService(service string) error {
 	return f.KubeClient.CoreV1().Services(TestNs).Delete(service, &metav1.DeleteOptions{})
@@ -174,8 +233,8 @@ func convertClusterRoleBinding(pathToYaml string) (*rbacv1.ClusterRoleBinding, e
 
 // ConvertDeployment takes in a path to the YAML file containing the manifest.
 // It converts the file to the Deployment object.
-func ConvertDeployment(pathToYaml string) (*appsv1beta1.Deployment, error) {
-	d := appsv1beta1.Deployment{}
+func ConvertDeployment(pathToYaml string) (*appsv1.Deployment, error) {
+	d := appsv1.Deployment{}
 
 	if err := convertToK8sResource(pathToYaml, &d); err != nil {
 		return nil, err
@@ -157,7 +157,7 @@ func TestHabitatDelete(t *testing.T) {
 
 	// Check if all the resources the operator creates are deleted.
 	// We do not care about secrets being deleted, as the user needs to delete those manually.
-	d, err := framework.KubeClient.AppsV1beta1().Deployments(utils.TestNs).Get(habitat.ObjectMeta.Name, metav1.GetOptions{})
+	d, err := framework.KubeClient.AppsV1().Deployments(utils.TestNs).Get(habitat.ObjectMeta.Name, metav1.GetOptions{})
 	if err == nil && d != nil {
 		t.Fatal("Deployment was not deleted.")
 	}
@@ -168,3 +168,127 @@ func TestHabitatDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// TestLeaderTopology tests that all the members of a leader topology are started.
+func TestLeaderTopology(t *testing.T) {
+	habitat, err := utils.ConvertHabitat("resources/leader/habitat.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := framework.CreateHabitat(habitat); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for resources to be ready.
+	if err := framework.WaitForResources(habv1beta1.HabitatNameLabel, habitat.ObjectMeta.Name, habitat.Spec.Count); err != nil {
+		t.Fatal(err)
+	}
+
+	// All the members must have been started with the leader topology.
+	if err := framework.WaitForResources(habv1beta1.TopologyLabel, habv1beta1.TopologyLeader.String(), habitat.Spec.Count); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := framework.DeleteHabitat(habitat.ObjectMeta.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := framework.WaitForResources(habv1beta1.HabitatNameLabel, habitat.ObjectMeta.Name, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHabitatScale tests that scaling a Habitat through its scale subresource
+// updates its count, and the number of running Pods.
+func TestHabitatScale(t *testing.T) {
+	habitat, err := utils.ConvertHabitat("resources/standalone/habitat.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	habitat.Name = "scale-" + habitat.Name
+
+	if err := framework.CreateHabitat(habitat); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := framework.WaitForResources(habv1beta1.HabitatNameLabel, habitat.ObjectMeta.Name, habitat.Spec.Count); err != nil {
+		t.Fatal(err)
+	}
+
+	replicas := int32(habitat.Spec.Count + 1)
+	if err := framework.ScaleHabitat(habitat.ObjectMeta.Name, replicas); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := framework.Client.HabitatV1beta1().Habitats(utils.TestNs).Get(habitat.ObjectMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int32(h.Spec.Count) != replicas {
+		t.Fatalf("expected count to be %d, got %d", replicas, h.Spec.Count)
+	}
+
+	if err := framework.WaitForResources(habv1beta1.HabitatNameLabel, habitat.ObjectMeta.Name, int(replicas)); err != nil {
+		t.Fatal(err)
+	}
+
+	scale, err := framework.GetHabitatScale(habitat.ObjectMeta.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scale.Spec.Replicas != replicas {
+		t.Fatalf("expected scale to have %d replicas, got %d", replicas, scale.Spec.Replicas)
+	}
+
+	if err := framework.DeleteHabitat(habitat.ObjectMeta.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := framework.WaitForResources(habv1beta1.HabitatNameLabel, habitat.ObjectMeta.Name, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPeerConfigMapRecreated tests that the ConfigMap containing the peer file
+// is recreated, with the IP of a peer, when it's deleted out of band.
+func TestPeerConfigMapRecreated(t *testing.T) {
+	habitat, err := utils.ConvertHabitat("resources/standalone/habitat.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	habitat.Name = "configmap-" + habitat.Name
+
+	if err := framework.CreateHabitat(habitat); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := framework.WaitForResources(habv1beta1.HabitatNameLabel, habitat.ObjectMeta.Name, habitat.Spec.Count); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := framework.WaitForPeerConfigMap(configMapName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := framework.KubeClient.CoreV1().ConfigMaps(utils.TestNs).Delete(configMapName, &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cm, err := framework.WaitForPeerConfigMap(configMapName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.UID == old.UID {
+		t.Fatal("expected the ConfigMap to be recreated")
+	}
+
+	if err := framework.DeleteHabitat(habitat.ObjectMeta.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := framework.WaitForResources(habv1beta1.HabitatNameLabel, habitat.ObjectMeta.Name, 0); err != nil {
+		t.Fatal(err)
+	}
+}